@@ -18,18 +18,87 @@ import (
 type SecretKeys struct {
 	AllKeys      []string
 	SearchString string
+	NestedKeys   int               // trailing entries of AllKeys that came from nested values
+	KeyTokens    [][]string        // words of each key name, parallel to AllKeys
+	KeyPaths     []string          // dotted path of each key, e.g. config.db.host, parallel to AllKeys
+	Formats      map[string]string // format of each value that held a document, by key path
+	Metadata     *SecretMetadata   // KV v2 metadata; nil if Vault did not say
+	History      []*SecretKeys     // older versions, newest first; only with VAULT_HISTORY_VERSIONS
+	Deleted      bool              // the current version is deleted or destroyed; its keys are unknown
+}
+
+// newSecretKeys extracts and indexes the key names of one version of a secret.
+func newSecretKeys(secretPath string, data map[string]interface{}, policy *extractionPolicy, logEntry *logrus.Entry) *SecretKeys {
+	allKeys, keyPaths, formats := extractKeys(data, policy, logEntry)
+	return &SecretKeys{
+		AllKeys:      allKeys,
+		SearchString: buildSearchString(secretPath, append(allKeys[:len(allKeys):len(allKeys)], dottedKeyPaths(allKeys, keyPaths)...)),
+		NestedKeys:   len(allKeys) - len(data),
+		KeyTokens:    tokenizeKeys(allKeys),
+		KeyPaths:     keyPaths,
+		Formats:      formats,
+	}
+}
+
+// deletedSecretKeys returns the cache entry of a secret whose current version
+// reads as no data, or nil when the metadata does not say it was deleted or
+// destroyed. Only its path and metadata are indexed.
+func deletedSecretKeys(ctx context.Context, secretPath string, read map[string]interface{}, logEntry *logrus.Entry) *SecretKeys {
+	metadata := secretMetadata(ctx, secretPath, read, logEntry)
+	if !metadata.deleted(time.Now()) {
+		return nil
+	}
+	logEntry.WithField("destroyed", metadata.Destroyed).Debug("Current version of secret is deleted")
+	return &SecretKeys{
+		SearchString: buildSearchString(secretPath, nil),
+		Metadata:     metadata,
+		Deleted:      true,
+	}
+}
+
+func (k *SecretKeys) isDeleted() bool {
+	return k != nil && k.Deleted
+}
+
+func (k *SecretKeys) isNestedKey(i int) bool {
+	return i >= len(k.AllKeys)-k.NestedKeys
+}
+
+// keyPath returns the dotted path of AllKeys[i]; entries built without
+// KeyPaths use the bare key name.
+func (k *SecretKeys) keyPath(i int) string {
+	if i < len(k.KeyPaths) {
+		return k.KeyPaths[i]
+	}
+	return k.AllKeys[i]
+}
+
+// keyTokens returns the words of AllKeys[i], tokenizing on the fly for
+// entries built without KeyTokens.
+func (k *SecretKeys) keyTokens(i int) []string {
+	if i < len(k.KeyTokens) {
+		return k.KeyTokens[i]
+	}
+	return tokenTexts(tokenizeKey(k.AllKeys[i]))
 }
 
 type Cache struct {
 	sync.RWMutex
 	data            map[string]*SecretKeys
+	index           *trigramIndex
+	generation      uint64
+	previous        *cacheSnapshot
+	cursorGen       uint64 // newest generation a next_cursor was issued for
 	buildStartTime  time.Time
 	buildEndTime    time.Time
 	isRebuilding    int32
 	totalSecrets    int64
 	fetchedSecrets  int64
 	totalKeys       int64
+	deletedSecrets  int64
 	cachedSizeBytes uint64
+	deniedSecrets   []string // listed by the last rebuild but not readable, sorted
+	deniedFolders   []string // not listable in the last rebuild, with a trailing slash, sorted
 }
 
 func rebuildCache(ctx context.Context) error {
@@ -51,6 +120,7 @@ func rebuildCache(ctx context.Context) error {
 	pathsCh := make(chan string, 1000)
 	errCh := make(chan error, 1)
 	listingResultCh := make(chan error, 1)
+	denied := &deniedPaths{}
 
 	var wg sync.WaitGroup
 
@@ -60,7 +130,7 @@ func rebuildCache(ctx context.Context) error {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		listAllSecrets(listCtx, "", pathsCh, errCh)
+		listAllSecrets(listCtx, "", pathsCh, errCh, denied)
 		close(pathsCh)
 	}()
 
@@ -79,6 +149,7 @@ func rebuildCache(ctx context.Context) error {
 
 	var totalSecrets int64
 	totalKeys := int64(0)
+	deletedSecrets := int64(0)
 	atomic.StoreInt64(&c.fetchedSecrets, 0)
 
 	eg, egCtx := errgroup.WithContext(ctx)
@@ -96,36 +167,17 @@ func rebuildCache(ctx context.Context) error {
 				logEntry := logger.WithField("secret_path", secretPath)
 				logEntry.Debug("Fetching secret")
 
-				secret, err := vaultClient.Logical().ReadWithContext(egCtx, fmt.Sprintf("%s/data/%s", cfg.VaultMountPoint, secretPath))
-				if err != nil {
-					if isPermissionDenied(err) {
-						logEntry.WithError(err).Warn("Access denied for secret")
-						return nil
-					}
-					logEntry.WithError(err).Error("Failed to read secret")
+				keys := fetchSecretKeys(egCtx, secretPath, denied, logEntry)
+				if keys == nil {
 					return nil
 				}
 
-				if secret == nil || secret.Data == nil {
-					logEntry.Warn("Secret data is nil")
-					return nil
-				}
-
-				data, ok := secret.Data["data"].(map[string]interface{})
-				if !ok {
-					logEntry.Error("Invalid data format in secret")
-					return nil
-				}
-
-				allKeys := extractKeysFromValue(data, logEntry)
-				searchString := buildSearchString(secretPath, allKeys)
-
 				mu.Lock()
-				tempCache[secretPath] = &SecretKeys{
-					AllKeys:      allKeys,
-					SearchString: searchString,
+				tempCache[secretPath] = keys
+				totalKeys += int64(len(keys.AllKeys))
+				if keys.Deleted {
+					deletedSecrets++
 				}
-				totalKeys += int64(len(allKeys))
 				mu.Unlock()
 
 				fetched := atomic.AddInt64(&c.fetchedSecrets, 1)
@@ -159,18 +211,111 @@ func rebuildCache(ctx context.Context) error {
 
 	atomic.StoreInt64(&c.totalSecrets, atomic.LoadInt64(&totalSecrets))
 
+	indexStart := time.Now()
+	index := buildTrigramIndex(tempCache)
+	logger.WithFields(logrus.Fields{
+		"trigrams": len(index.postings),
+		"duration": time.Since(indexStart).String(),
+	}).Info("Trigram index built")
+
+	deniedSecrets, deniedFolders := denied.sorted()
+	if len(deniedSecrets) > 0 || len(deniedFolders) > 0 {
+		logger.WithFields(logrus.Fields{
+			"denied_secrets": len(deniedSecrets),
+			"denied_folders": len(deniedFolders),
+		}).Warn("Some paths were not readable, see /reports/denied")
+	}
+
 	c.Lock()
+	c.retireSnapshotLocked()
 	c.data = tempCache
+	c.index = index
+	c.deniedSecrets = deniedSecrets
+	c.deniedFolders = deniedFolders
+	c.generation++
 	c.buildEndTime = time.Now()
 	c.Unlock()
 	atomic.StoreInt64(&c.totalKeys, totalKeys)
-	atomic.StoreUint64(&c.cachedSizeBytes, estimateCacheSize(tempCache))
+	atomic.StoreInt64(&c.deletedSecrets, deletedSecrets)
+	atomic.StoreUint64(&c.cachedSizeBytes, estimateCacheSize(tempCache)+index.sizeBytes())
 
 	logger.WithField("total_keys", totalKeys).Info("Cache rebuild completed")
 	return nil
 }
 
-func listAllSecrets(ctx context.Context, currentPath string, pathsCh chan<- string, errCh chan<- error) {
+// fetchSecretKeys reads one secret for the cache. It returns nil, after
+// logging why, when the secret cannot be indexed; secrets the token may not
+// read are also added to denied.
+func fetchSecretKeys(ctx context.Context, secretPath string, denied *deniedPaths, logEntry *logrus.Entry) *SecretKeys {
+	if cfg.MetadataOnly {
+		return fetchSecretMetadataKeys(ctx, secretPath, denied, logEntry)
+	}
+
+	secret, err := vaultClient.Logical().ReadWithContext(ctx, fmt.Sprintf("%s/data/%s", cfg.VaultMountPoint, secretPath))
+	if err != nil {
+		if isPermissionDenied(err) {
+			logEntry.WithError(err).Warn("Access denied for secret")
+			denied.addSecret(secretPath)
+			return nil
+		}
+		logEntry.WithError(err).Error("Failed to read secret")
+		return nil
+	}
+
+	var read map[string]interface{}
+	if secret != nil {
+		read = secret.Data
+	}
+
+	policy := extraction.policyFor(secretPath)
+	var keys *SecretKeys
+	switch data := read["data"].(type) {
+	case map[string]interface{}:
+		keys = newSecretKeys(secretPath, data, policy, logEntry)
+		keys.Metadata = secretMetadata(ctx, secretPath, read, logEntry)
+	case nil:
+		// A deleted or destroyed current version reads as no data.
+		if keys = deletedSecretKeys(ctx, secretPath, read, logEntry); keys == nil {
+			logEntry.Warn("Secret data is nil")
+			return nil
+		}
+	default:
+		logEntry.Error("Invalid data format in secret")
+		return nil
+	}
+	keys.History = readSecretHistory(ctx, secretPath, keys.Metadata, policy, logEntry)
+	return keys
+}
+
+// fetchSecretMetadataKeys builds the cache entry of a secret from its metadata
+// alone, for tokens that may list and read metadata but not data. Only the
+// path is indexed; the key names stay unknown.
+func fetchSecretMetadataKeys(ctx context.Context, secretPath string, denied *deniedPaths, logEntry *logrus.Entry) *SecretKeys {
+	metadata, err := readSecretMetadata(ctx, secretPath)
+	if err != nil {
+		if isPermissionDenied(err) {
+			logEntry.WithError(err).Warn("Access denied for secret metadata")
+			denied.addSecret(secretPath)
+			return nil
+		}
+		logEntry.WithError(err).Error("Failed to read secret metadata")
+		return nil
+	}
+	if metadata == nil {
+		logEntry.Warn("Secret metadata is nil")
+		return nil
+	}
+	return &SecretKeys{
+		SearchString: buildSearchString(secretPath, nil),
+		Metadata:     metadata,
+		Deleted:      metadata.deleted(time.Now()),
+	}
+}
+
+// listAllSecrets sends every secret below currentPath to pathsCh. A folder
+// below the mount root that the token may not list is added to denied and
+// skipped; any other listing error fails the rebuild through errCh.
+func listAllSecrets(ctx context.Context, currentPath string, pathsCh chan<- string, errCh chan<- error, denied *deniedPaths) {
 	logEntry := logger.WithField("current_path", currentPath)
 	logEntry.Debug("Listing secrets")
 
@@ -182,6 +327,11 @@ func listAllSecrets(ctx context.Context, currentPath string, pathsCh chan<- stri
 
 	secretList, err := vaultClient.Logical().ListWithContext(ctx, fmt.Sprintf("%s/metadata/%s", cfg.VaultMountPoint, currentPath))
 	if err != nil {
+		if currentPath != "" && isPermissionDenied(err) {
+			logEntry.WithError(err).Warn("Access denied for folder")
+			denied.addFolder(currentPath)
+			return
+		}
 		logEntry.WithError(err).Error("Failed to list secrets at path")
 		select {
 		case errCh <- fmt.Errorf("failed to list secrets at path %s: %w", currentPath, err):
@@ -215,16 +365,16 @@ func listAllSecrets(ctx context.Context, currentPath string, pathsCh chan<- stri
 			logger.WithField("key", key).Warn("Key is not a string")
 			continue
 		}
+		// path.Join drops the folder's trailing slash and, at the mount root,
+		// does not add a leading one.
 		fullPath := path.Join(currentPath, keyStr)
 		if strings.HasSuffix(keyStr, "/") {
-			fullPath = currentPath + "/" + keyStr
-			fullPath = strings.TrimSuffix(fullPath, "/")
 			sem <- struct{}{}
 			wg.Add(1)
 			go func(p string) {
 				defer func() { <-sem }()
 				defer wg.Done()
-				listAllSecrets(ctx, p, pathsCh, errCh)
+				listAllSecrets(ctx, p, pathsCh, errCh, denied)
 			}(fullPath)
 		} else {
 			logger.WithField("secret_path", fullPath).Debug("Found secret")
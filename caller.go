@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// callerTokenHeader carries the caller's own Vault token. With
+// REQUIRE_CALLER_TOKEN every path in a response must be one the caller could
+// read or see listed with that token.
+const callerTokenHeader = "X-Vault-Token"
+
+// capabilitiesBatchSize is how many paths one sys/capabilities-self request
+// asks about.
+const capabilitiesBatchSize = 200
+
+var (
+	errCallerTokenMissing  = errors.New("this server answers only with your own Vault token in the X-Vault-Token header")
+	errCallerTokenRejected = errors.New("Vault rejected the token in the X-Vault-Token header")
+	errCapabilityCheck     = errors.New("failed to check the capabilities of the caller's token")
+)
+
+// visibility reports whether the caller may see a cached path. A nil
+// visibility allows everything, as when REQUIRE_CALLER_TOKEN is off.
+type visibility func(secretPath string) bool
+
+func (v visibility) allows(secretPath string) bool {
+	return v == nil || v(secretPath)
+}
+
+type callerContextKey struct{}
+
+// caller is the Vault identity a request is answered for.
+type caller struct {
+	token string
+	id    string // hash of the token, which keys the capability cache
+}
+
+func newCaller(token string) *caller {
+	sum := sha256.Sum256([]byte(token))
+	return &caller{token: token, id: hex.EncodeToString(sum[:])}
+}
+
+// callerFrom returns the caller of a request, or nil when results are not
+// filtered by the caller's token.
+func callerFrom(ctx context.Context) *caller {
+	c, _ := ctx.Value(callerContextKey{}).(*caller)
+	return c
+}
+
+// withCaller makes a handler answer for the token in X-Vault-Token when
+// REQUIRE_CALLER_TOKEN is set, and refuses requests without one.
+func withCaller(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.RequireCallerToken {
+			next(w, r)
+			return
+		}
+		token := strings.TrimSpace(r.Header.Get(callerTokenHeader))
+		if token == "" {
+			writeJSONError(w, http.StatusUnauthorized, errCallerTokenMissing.Error())
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), callerContextKey{}, newCaller(token))))
+	}
+}
+
+// writeCallerError answers a failed capability check and reports whether err
+// was one.
+func writeCallerError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errCallerTokenRejected):
+		writeJSONError(w, http.StatusUnauthorized, errCallerTokenRejected.Error())
+	case errors.Is(err, errCapabilityCheck):
+		logger.WithError(err).Error("Caller capability check failed")
+		writeJSONError(w, http.StatusBadGateway, errCapabilityCheck.Error())
+	default:
+		return false
+	}
+	return true
+}
+
+// visibility returns what c may see among paths: secrets it may read or see
+// in the listing of their folder, and folders, which end in '/', it may list
+// or see in the listing of their parent. A nil caller sees everything.
+func (c *caller) visibility(ctx context.Context, paths []string) (visibility, error) {
+	visible, _, err := c.access(ctx, paths)
+	return visible, err
+}
+
+// access is visibility, and also which of the secrets among paths c may read.
+// Only those show their key names: a secret c can merely see listed shows its
+// path and metadata, like the listing in Vault does.
+func (c *caller) access(ctx context.Context, paths []string) (visible, readable visibility, err error) {
+	if c == nil {
+		return nil, nil, nil
+	}
+	var vaultPaths []string
+	for _, p := range paths {
+		vaultPaths = append(vaultPaths, capabilityPaths(p)...)
+	}
+	caps, err := capabilities.lookup(ctx, c, vaultPaths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[string]bool, len(paths))
+	read := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		vp := capabilityPaths(p)
+		listed := hasCapability(caps[vp[1]], "list")
+		if strings.HasSuffix(p, "/") {
+			seen[p] = hasCapability(caps[vp[0]], "list") || listed
+			continue
+		}
+		read[p] = hasCapability(caps[vp[0]], "read")
+		seen[p] = read[p] || listed
+	}
+	return func(secretPath string) bool { return seen[secretPath] },
+		func(secretPath string) bool { return read[secretPath] }, nil
+}
+
+// readable returns which of the secrets among paths c may read, asking only
+// about their data paths. A nil caller reads everything.
+func (c *caller) readable(ctx context.Context, paths []string) (visibility, error) {
+	if c == nil {
+		return nil, nil
+	}
+	vaultPaths := make([]string, len(paths))
+	for i, p := range paths {
+		vaultPaths[i] = capabilityPaths(p)[0]
+	}
+	caps, err := capabilities.lookup(ctx, c, vaultPaths)
+	if err != nil {
+		return nil, err
+	}
+	read := make(map[string]bool, len(paths))
+	for i, p := range paths {
+		read[p] = hasCapability(caps[vaultPaths[i]], "read")
+	}
+	return func(secretPath string) bool { return read[secretPath] }, nil
+}
+
+// visiblePaths keeps the paths c may see, in order, until it has want of
+// them; want <= 0 means all. A path c may see but not read is kept only if
+// listed says so. Vault is asked about one batch of paths at a time, so the
+// first page of a large result does not check every match. exhausted reports
+// whether every path was checked.
+func (c *caller) visiblePaths(ctx context.Context, paths []string, want int, listed func(string) bool) (kept []string, exhausted bool, err error) {
+	if c == nil {
+		return paths, true, nil
+	}
+	kept = []string{}
+	for chunk := range slices.Chunk(paths, capabilitiesBatchSize) {
+		if want > 0 && len(kept) >= want {
+			return kept, false, nil
+		}
+		visible, readable, err := c.access(ctx, chunk)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, p := range chunk {
+			if readable(p) || visible(p) && listed(p) {
+				kept = append(kept, p)
+			}
+		}
+	}
+	return kept, true, nil
+}
+
+// listedOnly returns a secret as a caller who may list but not read it sees
+// it: its path and metadata, without key names or older versions.
+func (k *SecretKeys) listedOnly(secretPath string) *SecretKeys {
+	return &SecretKeys{
+		SearchString: buildSearchString(secretPath, nil),
+		Metadata:     k.metadata(),
+		Deleted:      k.isDeleted(),
+	}
+}
+
+// capabilityPaths returns the Vault paths whose capabilities decide whether a
+// cached path is visible: for a secret its data path, for a folder its own
+// metadata path, and then the metadata path of the folder listing it.
+func capabilityPaths(p string) []string {
+	parent := path.Dir(strings.TrimSuffix(p, "/"))
+	if parent == "." {
+		parent = ""
+	} else {
+		parent += "/"
+	}
+	own := fmt.Sprintf("%s/data/%s", cfg.VaultMountPoint, p)
+	if strings.HasSuffix(p, "/") {
+		own = fmt.Sprintf("%s/metadata/%s", cfg.VaultMountPoint, p)
+	}
+	return []string{own, fmt.Sprintf("%s/metadata/%s", cfg.VaultMountPoint, parent)}
+}
+
+func hasCapability(caps []string, want string) bool {
+	return slices.Contains(caps, want) || slices.Contains(caps, "root")
+}
+
+// capabilities remembers what sys/capabilities-self answered for each caller
+// for CALLER_CAPABILITIES_TTL, so paging through results or browsing a tree
+// does not ask Vault again for every request.
+var capabilities = &capabilityCache{callers: make(map[string]*callerCapabilities)}
+
+// capabilityCacheCallers caps how many callers' answers are kept; the least
+// recently seen caller is dropped to make room for a new one.
+const capabilityCacheCallers = 256
+
+// capabilityCacheEntries caps the answers kept for all callers together,
+// counting each Vault path and each vocabulary entry as one, so a few callers
+// asking about a large cache cannot grow it without bound.
+const capabilityCacheEntries = 100000
+
+type capabilityCache struct {
+	sync.Mutex
+	callers map[string]*callerCapabilities // by caller id
+	swept   time.Time
+}
+
+type callerCapabilities struct {
+	entries  map[string]capabilityEntry // by Vault path
+	lastSeen time.Time
+
+	// vocabulary is the key vocabulary of the secrets the caller may read in
+	// cache generation vocabularyGen, for /suggest?kind=key.
+	vocabulary        []keyUsage
+	vocabularyGen     uint64
+	vocabularyExpires time.Time
+}
+
+type capabilityEntry struct {
+	caps    []string
+	expires time.Time
+}
+
+// lookup returns the capabilities of c on each of vaultPaths, asking Vault in
+// batches for those that are not cached.
+func (cc *capabilityCache) lookup(ctx context.Context, c *caller, vaultPaths []string) (map[string][]string, error) {
+	now := time.Now()
+	caps := make(map[string][]string, len(vaultPaths))
+	var missing []string
+
+	cc.Lock()
+	cached := cc.callers[c.id]
+	if cached != nil {
+		cached.lastSeen = now
+	}
+	for _, p := range vaultPaths {
+		if _, seen := caps[p]; seen {
+			continue
+		}
+		if cached != nil {
+			if e, ok := cached.entries[p]; ok && now.Before(e.expires) {
+				caps[p] = e.caps
+				continue
+			}
+		}
+		caps[p] = nil
+		missing = append(missing, p)
+	}
+	cc.Unlock()
+	if len(missing) == 0 {
+		return caps, nil
+	}
+
+	client, err := vaultClient.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCapabilityCheck, err)
+	}
+	client.SetToken(c.token)
+
+	var mu sync.Mutex
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(cfg.MaxGoroutines)
+	for batch := range slices.Chunk(missing, capabilitiesBatchSize) {
+		eg.Go(func() error {
+			secret, err := client.Logical().WriteWithContext(egCtx, "sys/capabilities-self", map[string]interface{}{"paths": batch})
+			if err != nil {
+				if isPermissionDenied(err) {
+					return errCallerTokenRejected
+				}
+				return fmt.Errorf("%w: %v", errCapabilityCheck, err)
+			}
+			if secret == nil {
+				return fmt.Errorf("%w: empty response", errCapabilityCheck)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, p := range batch {
+				list, _ := secret.Data[p].([]interface{})
+				granted := make([]string, 0, len(list))
+				for _, v := range list {
+					if s, ok := v.(string); ok {
+						granted = append(granted, s)
+					}
+				}
+				caps[p] = granted
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(cfg.CapabilitiesTTL)
+	cc.Lock()
+	cc.sweepLocked(now)
+	cached = cc.callerLocked(c.id, now)
+	for _, p := range missing {
+		cached.entries[p] = capabilityEntry{caps: caps[p], expires: expires}
+	}
+	cc.trimLocked(c.id)
+	cc.Unlock()
+	return caps, nil
+}
+
+// callerLocked returns the cached answers for a caller, making room for a new
+// one by dropping the least recently seen.
+func (cc *capabilityCache) callerLocked(id string, now time.Time) *callerCapabilities {
+	if cached, ok := cc.callers[id]; ok {
+		cached.lastSeen = now
+		return cached
+	}
+	if len(cc.callers) >= capabilityCacheCallers {
+		delete(cc.callers, cc.oldestLocked(""))
+	}
+	cached := &callerCapabilities{entries: make(map[string]capabilityEntry), lastSeen: now}
+	cc.callers[id] = cached
+	return cached
+}
+
+// oldestLocked returns the least recently seen caller other than except.
+func (cc *capabilityCache) oldestLocked(except string) string {
+	var oldest string
+	for id, cached := range cc.callers {
+		if id != except && (oldest == "" || cached.lastSeen.Before(cc.callers[oldest].lastSeen)) {
+			oldest = id
+		}
+	}
+	return oldest
+}
+
+// trimLocked drops the least recently seen callers other than keep until at
+// most capabilityCacheEntries answers are cached. If keep alone has more, it
+// forgets the surplus, in no particular order, and asks Vault again later.
+func (cc *capabilityCache) trimLocked(keep string) {
+	size := 0
+	for _, cached := range cc.callers {
+		size += cached.size()
+	}
+	for size > capabilityCacheEntries && len(cc.callers) > 1 {
+		oldest := cc.oldestLocked(keep)
+		size -= cc.callers[oldest].size()
+		delete(cc.callers, oldest)
+	}
+	if cached, ok := cc.callers[keep]; ok {
+		for p := range cached.entries {
+			if size <= capabilityCacheEntries {
+				break
+			}
+			delete(cached.entries, p)
+			size--
+		}
+	}
+}
+
+func (cached *callerCapabilities) size() int {
+	return len(cached.entries) + len(cached.vocabulary)
+}
+
+// vocabulary returns the key vocabulary cached for c in generation.
+func (cc *capabilityCache) vocabulary(c *caller, generation uint64) ([]keyUsage, bool) {
+	cc.Lock()
+	defer cc.Unlock()
+	cached, ok := cc.callers[c.id]
+	if !ok || cached.vocabulary == nil || cached.vocabularyGen != generation || !time.Now().Before(cached.vocabularyExpires) {
+		return nil, false
+	}
+	cached.lastSeen = time.Now()
+	return cached.vocabulary, true
+}
+
+func (cc *capabilityCache) setVocabulary(c *caller, generation uint64, vocab []keyUsage) {
+	cc.Lock()
+	defer cc.Unlock()
+	now := time.Now()
+	cached := cc.callerLocked(c.id, now)
+	cached.vocabulary, cached.vocabularyGen, cached.vocabularyExpires = vocab, generation, now.Add(cfg.CapabilitiesTTL)
+	cc.trimLocked(c.id)
+}
+
+// sweepLocked drops expired entries, and callers left without any, at most
+// once per TTL.
+func (cc *capabilityCache) sweepLocked(now time.Time) {
+	if now.Sub(cc.swept) < cfg.CapabilitiesTTL {
+		return
+	}
+	cc.swept = now
+	for id, cached := range cc.callers {
+		for p, e := range cached.entries {
+			if !now.Before(e.expires) {
+				delete(cached.entries, p)
+			}
+		}
+		if len(cached.entries) == 0 {
+			delete(cc.callers, id)
+		}
+	}
+}
+
+// Capabilities says what a token may do with a secret: read, create, update
+// and delete act on its data path, list on the folder it is listed in.
+type Capabilities struct {
+	Read   bool `json:"read"`
+	Create bool `json:"create"`
+	Update bool `json:"update"`
+	Delete bool `json:"delete"`
+	List   bool `json:"list"`
+}
+
+// requestCaller returns whose capabilities annotate a request's results: the
+// caller filtered by REQUIRE_CALLER_TOKEN, else the token in X-Vault-Token,
+// else nil for the service token.
+func requestCaller(r *http.Request) *caller {
+	if c := callerFrom(r.Context()); c != nil {
+		return c
+	}
+	if token := strings.TrimSpace(r.Header.Get(callerTokenHeader)); token != "" {
+		return newCaller(token)
+	}
+	return nil
+}
+
+// pathCapabilities looks up the capabilities of c, or of the service token
+// when c is nil, on each secret path.
+func pathCapabilities(ctx context.Context, c *caller, paths []string) (map[string]Capabilities, error) {
+	service := c == nil
+	if service {
+		c = newCaller(vaultClient.Token())
+	}
+	var vaultPaths []string
+	for _, p := range paths {
+		vaultPaths = append(vaultPaths, capabilityPaths(p)...)
+	}
+	caps, err := capabilities.lookup(ctx, c, vaultPaths)
+	if err != nil {
+		if service && errors.Is(err, errCallerTokenRejected) {
+			return nil, fmt.Errorf("%w: Vault rejected the service token", errCapabilityCheck)
+		}
+		return nil, err
+	}
+
+	result := make(map[string]Capabilities, len(paths))
+	for _, p := range paths {
+		vp := capabilityPaths(p)
+		data := caps[vp[0]]
+		result[p] = Capabilities{
+			Read:   hasCapability(data, "read"),
+			Create: hasCapability(data, "create"),
+			Update: hasCapability(data, "update"),
+			Delete: hasCapability(data, "delete"),
+			List:   hasCapability(caps[vp[1]], "list"),
+		}
+	}
+	return result, nil
+}
+
+// cachedPaths returns the cached secret paths below prefix, sorted.
+func cachedPaths(prefix string) []string {
+	cache.RLock()
+	defer cache.RUnlock()
+	var paths []string
+	if cache.index != nil {
+		start, _ := slices.BinarySearch(cache.index.paths, prefix)
+		for _, p := range cache.index.paths[start:] {
+			if !strings.HasPrefix(p, prefix) {
+				break
+			}
+			paths = append(paths, p)
+		}
+		return paths
+	}
+	for p := range cache.data {
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
@@ -22,6 +22,16 @@ type Config struct {
 	LogFilePath        string
 	VaultTimeout       time.Duration
 	SearchTimeout      time.Duration
+	CursorTTL          time.Duration
+	FuzzyDistance      int
+	SynonymsFile       string
+	ExtractionFile     string
+	RotationFile       string
+	IndexMetadata      bool
+	HistoryVersions    int
+	MetadataOnly       bool
+	RequireCallerToken bool
+	CapabilitiesTTL    time.Duration
 }
 
 var (
@@ -37,6 +47,9 @@ func init() {
 	cfg = loadConfig()
 	logger = setupLogger()
 	vaultClient = setupVaultClient()
+	synonyms = setupSynonyms()
+	extraction = setupExtraction()
+	rotation = setupRotation()
 	cache = &Cache{data: make(map[string]*SecretKeys)}
 }
 
@@ -51,6 +64,24 @@ func loadConfig() *Config {
 
 	vaultTimeout := parseDurationEnv("VAULT_TIMEOUT", 30*time.Second)
 	searchTimeout := parseDurationEnv("SEARCH_TIMEOUT", 5*time.Second)
+	cursorTTL := parseDurationEnv("SEARCH_CURSOR_TTL", 10*time.Minute)
+	capabilitiesTTL := parseDurationEnv("CALLER_CAPABILITIES_TTL", time.Minute)
+	requireCallerToken, _ := strconv.ParseBool(getEnv("REQUIRE_CALLER_TOKEN", "false"))
+	indexMetadata, _ := strconv.ParseBool(getEnv("VAULT_READ_METADATA", "false"))
+	historyVersions, err := strconv.Atoi(getEnv("VAULT_HISTORY_VERSIONS", "0"))
+	if err != nil || historyVersions < 0 {
+		historyVersions = 0
+	}
+	// A metadata-only crawl never reads secret data, so there are no older
+	// versions to index and the metadata endpoint is the only source.
+	metadataOnly, _ := strconv.ParseBool(getEnv("VAULT_METADATA_ONLY", "false"))
+	if metadataOnly {
+		indexMetadata, historyVersions = true, 0
+	}
+	fuzzyDistance, err := strconv.Atoi(getEnv("SEARCH_FUZZY_DISTANCE", "2"))
+	if err != nil || fuzzyDistance <= 0 {
+		fuzzyDistance = 2
+	}
 
 	return &Config{
 		VaultAddress:       getEnv("VAULT_ADDR", "https://vault.offline.shelopes.com"),
@@ -62,6 +93,16 @@ func loadConfig() *Config {
 		LogFilePath:        logFilePath,
 		VaultTimeout:       vaultTimeout,
 		SearchTimeout:      searchTimeout,
+		CursorTTL:          cursorTTL,
+		FuzzyDistance:      fuzzyDistance,
+		SynonymsFile:       os.Getenv("SEARCH_SYNONYMS_FILE"),
+		ExtractionFile:     os.Getenv("EXTRACTION_CONFIG_FILE"),
+		RotationFile:       os.Getenv("ROTATION_RULES_FILE"),
+		IndexMetadata:      indexMetadata,
+		HistoryVersions:    historyVersions,
+		MetadataOnly:       metadataOnly,
+		RequireCallerToken: requireCallerToken,
+		CapabilitiesTTL:    capabilitiesTTL,
 	}
 }
 
@@ -74,6 +115,13 @@ func setupLogger() *logrus.Logger {
 	log.SetLevel(level)
 	log.SetFormatter(&logrus.JSONFormatter{})
 
+	// In MCP mode stdout carries the protocol, so logs go to stderr from the
+	// first line, including what init logs while loading config files.
+	console := io.Writer(os.Stdout)
+	if mcpMode() {
+		console = os.Stderr
+	}
+
 	if cfg.LogFilePath != "" {
 		if err := os.MkdirAll(path.Dir(cfg.LogFilePath), 0750); err != nil {
 			log.Fatalf("Failed to create log directory: %v", err)
@@ -83,13 +131,18 @@ func setupLogger() *logrus.Logger {
 			log.Fatalf("Failed to open log file: %v", err)
 		}
 		logFile = f
-		mw := io.MultiWriter(os.Stdout, f)
+		mw := io.MultiWriter(console, f)
 		log.SetOutput(mw)
 	}
 
 	return log
 }
 
+// mcpMode reports whether the binary was started as "vault-search mcp".
+func mcpMode() bool {
+	return len(os.Args) > 1 && os.Args[1] == "mcp"
+}
+
 func setupVaultClient() *api.Client {
 	config := api.DefaultConfig()
 	config.Address = cfg.VaultAddress
@@ -104,6 +157,42 @@ func setupVaultClient() *api.Client {
 	return client
 }
 
+func setupSynonyms() synonymSet {
+	if cfg.SynonymsFile == "" {
+		return nil
+	}
+	set, err := loadSynonyms(cfg.SynonymsFile)
+	if err != nil {
+		logger.Fatalf("Failed to load synonyms: %v", err)
+	}
+	logger.WithField("spellings", len(set)).Info("Synonyms loaded")
+	return set
+}
+
+func setupExtraction() *extractionConfig {
+	if cfg.ExtractionFile == "" {
+		return nil
+	}
+	ec, err := loadExtractionConfig(cfg.ExtractionFile)
+	if err != nil {
+		logger.Fatalf("Failed to load extraction config: %v", err)
+	}
+	logger.WithField("overrides", len(ec.Overrides)).Info("Extraction config loaded")
+	return ec
+}
+
+func setupRotation() *rotationConfig {
+	if cfg.RotationFile == "" {
+		return nil
+	}
+	rc, err := loadRotationConfig(cfg.RotationFile)
+	if err != nil {
+		logger.Fatalf("Failed to load rotation rules: %v", err)
+	}
+	logger.WithField("rules", len(rc.Rules)).Info("Rotation rules loaded")
+	return rc
+}
+
 func closeLogger() {
 	if logFile != nil {
 		if err := logFile.Close(); err != nil {
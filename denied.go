@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deniedPaths collects, during one rebuild, the secrets that were listed but
+// could not be read and the folders that could not be listed. Its methods are
+// safe on a nil receiver, which records nothing.
+type deniedPaths struct {
+	mu      sync.Mutex
+	secrets []string
+	folders []string
+}
+
+func (d *deniedPaths) addSecret(secretPath string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.secrets = append(d.secrets, secretPath)
+	d.mu.Unlock()
+}
+
+func (d *deniedPaths) addFolder(folder string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.folders = append(d.folders, normalizeTreePrefix(folder))
+	d.mu.Unlock()
+}
+
+// sorted returns both lists sorted, once the rebuild is done adding to them.
+func (d *deniedPaths) sorted() (secrets, folders []string) {
+	if d == nil {
+		return nil, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sort.Strings(d.secrets)
+	sort.Strings(d.folders)
+	return d.secrets, d.folders
+}
+
+// DeniedNode is a folder or secret on the way to a path the token was denied.
+// The counts cover the node itself and everything below it.
+type DeniedNode struct {
+	Name          string        `json:"name"`
+	Path          string        `json:"path"`
+	Type          string        `json:"type"`
+	ListDenied    bool          `json:"list_denied,omitempty"` // the folder itself could not be listed
+	DeniedSecrets int           `json:"denied_secrets"`
+	DeniedFolders int           `json:"denied_folders"`
+	Children      []*DeniedNode `json:"children,omitempty"`
+
+	children map[string]*DeniedNode
+}
+
+type DeniedReport struct {
+	GeneratedAt   time.Time   `json:"generated_at"`
+	Generation    uint64      `json:"generation"`
+	BuiltAt       time.Time   `json:"built_at,omitzero"`
+	DeniedSecrets int         `json:"denied_secrets"`
+	DeniedFolders int         `json:"denied_folders"`
+	Tree          *DeniedNode `json:"tree"`
+}
+
+// child returns the child of n with that name and type, adding it if needed.
+// A secret and a folder may share a name.
+func (n *DeniedNode) child(name, nodeType string) *DeniedNode {
+	id := nodeType + ":" + name
+	if c, ok := n.children[id]; ok {
+		return c
+	}
+	c := &DeniedNode{Name: name, Path: n.Path + name, Type: nodeType}
+	if nodeType == treeNodeFolder {
+		c.Path += "/"
+	}
+	if n.children == nil {
+		n.children = make(map[string]*DeniedNode)
+	}
+	n.children[id] = c
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// add walks from n down to rel, a path relative to n, and returns the nodes
+// along the way, n first and the node of rel last.
+func (n *DeniedNode) add(rel, nodeType string) []*DeniedNode {
+	nodes := []*DeniedNode{n}
+	segments := strings.Split(strings.TrimSuffix(rel, "/"), "/")
+	for i, name := range segments {
+		t := treeNodeFolder
+		if i == len(segments)-1 {
+			t = nodeType
+		}
+		n = n.child(name, t)
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func (n *DeniedNode) sortChildren() {
+	sort.Slice(n.Children, func(i, j int) bool {
+		if n.Children[i].Type != n.Children[j].Type {
+			return n.Children[i].Type == treeNodeFolder
+		}
+		return n.Children[i].Name < n.Children[j].Name
+	})
+	for _, c := range n.Children {
+		c.sortChildren()
+	}
+}
+
+func deniedReportHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := reportFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefix := normalizeTreePrefix(r.URL.Query().Get("path"))
+	secrets, folders := deniedUnder(prefix)
+	visible, err := callerFrom(r.Context()).visibility(r.Context(), append(slices.Clone(secrets), folders...))
+	if writeCallerError(w, err) {
+		return
+	}
+	secrets = slices.DeleteFunc(secrets, func(p string) bool { return !visible.allows(p) })
+	folders = slices.DeleteFunc(folders, func(p string) bool { return !visible.allows(p) })
+	logger.Infof("Denied report: %d secrets, %d folders", len(secrets), len(folders))
+
+	if format == reportFormatCSV {
+		var rows [][]string
+		for _, p := range folders {
+			if p != prefix {
+				rows = append(rows, []string{p, treeNodeFolder})
+			}
+		}
+		for _, p := range secrets {
+			rows = append(rows, []string{p, treeNodeSecret})
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+		writeCSV(w, "denied-paths.csv", []string{"path", "type"}, rows)
+		return
+	}
+	writeJSON(w, http.StatusOK, buildDeniedReport(prefix, secrets, folders, time.Now()))
+}
+
+// deniedUnder returns the paths the last rebuild was denied below prefix.
+func deniedUnder(prefix string) (secrets, folders []string) {
+	cache.RLock()
+	defer cache.RUnlock()
+	for _, p := range cache.deniedSecrets {
+		if strings.HasPrefix(p, prefix) {
+			secrets = append(secrets, p)
+		}
+	}
+	for _, p := range cache.deniedFolders {
+		if strings.HasPrefix(p, prefix) {
+			folders = append(folders, p)
+		}
+	}
+	return secrets, folders
+}
+
+// buildDeniedReport arranges denied secrets and folders below prefix into a
+// tree. Only folders with a denied path below them appear.
+func buildDeniedReport(prefix string, secrets, folders []string, now time.Time) *DeniedReport {
+	root := &DeniedNode{Name: strings.TrimSuffix(prefix, "/"), Path: prefix, Type: treeNodeFolder}
+	if i := strings.LastIndexByte(root.Name, '/'); i >= 0 {
+		root.Name = root.Name[i+1:]
+	}
+
+	cache.RLock()
+	report := &DeniedReport{GeneratedAt: now, Generation: cache.generation, BuiltAt: cache.buildEndTime, Tree: root}
+	cache.RUnlock()
+	for _, p := range folders {
+		// The prefix itself could not be listed: nothing below it is known.
+		if p == prefix {
+			root.ListDenied = true
+			root.DeniedFolders++
+			continue
+		}
+		nodes := root.add(p[len(prefix):], treeNodeFolder)
+		nodes[len(nodes)-1].ListDenied = true
+		for _, n := range nodes {
+			n.DeniedFolders++
+		}
+	}
+	for _, p := range secrets {
+		for _, n := range root.add(p[len(prefix):], treeNodeSecret) {
+			n.DeniedSecrets++
+		}
+	}
+
+	root.sortChildren()
+	report.DeniedSecrets, report.DeniedFolders = root.DeniedSecrets, root.DeniedFolders
+	return report
+}
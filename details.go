@@ -0,0 +1,288 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	matchSourcePath      = "path"
+	matchSourceKey       = "key"
+	matchSourceNestedKey = "nested_key"
+)
+
+// MatchDetail explains why a secret matched. Offsets are [start, end) byte
+// ranges into Path or Key. Values are never included.
+type MatchDetail struct {
+	Path         string          `json:"path"`
+	Mount        string          `json:"mount"`
+	URL          string          `json:"url,omitempty"`
+	Score        float64         `json:"score"`
+	MatchedIn    []string        `json:"matched_in"`
+	PathOffsets  [][2]int        `json:"path_offsets,omitempty"`
+	MatchedKeys  []KeyMatch      `json:"matched_keys"`
+	Metadata     *SecretMetadata `json:"metadata,omitempty"`
+	Versions     []int           `json:"versions,omitempty"`     // matching versions, newest first, with versions=all
+	Deleted      bool            `json:"deleted,omitempty"`      // the current version is deleted or destroyed
+	Capabilities *Capabilities   `json:"capabilities,omitempty"` // with capabilities=true
+}
+
+// KeyMatch is a matched key. KeyPath is the dotted path of a nested key, and
+// KeyPathOffsets are set when the search hit that path rather than, or as
+// well as, the key name.
+type KeyMatch struct {
+	Key            string   `json:"key"`
+	KeyPath        string   `json:"key_path,omitempty"`
+	Source         string   `json:"source"`
+	Offsets        [][2]int `json:"offsets"`
+	KeyPathOffsets [][2]int `json:"key_path_offsets,omitempty"`
+	Fuzzy          bool     `json:"fuzzy,omitempty"` // matched only within the edit distance
+	// Version is set for a key the current version no longer has: the newest
+	// older version that still had it.
+	Version int `json:"version,omitempty"`
+}
+
+// highlighter finds match offsets in a path or a key name. field limits it to
+// one of them; an empty field means both.
+type highlighter struct {
+	field string
+	regex *regexp.Regexp
+	lower bool // match against the lowercased string, like SearchString does
+
+	// fuzzyTerm is highlighted in whole key names and path segments within
+	// fuzzy edits of it.
+	fuzzyTerm string
+	fuzzy     int
+
+	tokens *tokenQuery // highlights the matched words of a key name
+}
+
+func (h highlighter) find(s string) [][2]int {
+	if h.lower {
+		s = strings.ToLower(s)
+	}
+	locs := h.regex.FindAllStringIndex(s, -1)
+	if len(locs) == 0 {
+		return nil
+	}
+	offsets := make([][2]int, 0, len(locs))
+	for _, loc := range locs {
+		if loc[0] == loc[1] {
+			continue
+		}
+		offsets = append(offsets, [2]int{loc[0], loc[1]})
+	}
+	return offsets
+}
+
+func (h highlighter) findFuzzy(s string) [][2]int {
+	return fuzzySegments(s, h.fuzzyTerm, h.fuzzy)
+}
+
+// searchHighlighters turns the content part of a search into highlighters.
+// For q= only terms that are not under a NOT can explain a match.
+func searchHighlighters(params *SearchParams, regex *regexp.Regexp) []highlighter {
+	scopeField := func(scope string) string {
+		switch scope {
+		case searchScopePath:
+			return queryFieldPath
+		case searchScopeKeys:
+			return queryFieldKey
+		}
+		return queryFieldAny
+	}
+
+	switch {
+	case params.QueryExpr != nil:
+		var hs []highlighter
+		for _, term := range positiveQueryTerms(params.QueryExpr) {
+			h := highlighter{field: term.field, regex: term.regex, fuzzyTerm: term.value, fuzzy: term.fuzzy, tokens: term.tokens}
+			if h.field == queryFieldAny {
+				h.field = scopeField(term.scope)
+			}
+			if h.regex == nil {
+				h.regex = regexp.MustCompile("(?i)" + regexp.QuoteMeta(term.value))
+			} else if term.field == queryFieldAny && term.scope == "" && !term.glob {
+				h.lower = true
+			}
+			hs = append(hs, h)
+		}
+		return hs
+	case params.Term != "":
+		term := strings.ToLower(params.Term)
+		return []highlighter{{
+			field:     scopeField(params.Scope),
+			regex:     regexp.MustCompile("(?i)" + regexp.QuoteMeta(params.Term)),
+			fuzzyTerm: term,
+			fuzzy:     fuzzyDistance(term, params.Fuzzy),
+			tokens:    params.termTokens,
+		}}
+	case regex != nil:
+		return []highlighter{{field: scopeField(params.Scope), regex: regex, lower: params.Scope == ""}}
+	}
+	return nil
+}
+
+func positiveQueryTerms(expr queryExpr) []*queryTerm {
+	var terms []*queryTerm
+	var walk func(e queryExpr)
+	walk = func(e queryExpr) {
+		switch q := e.(type) {
+		case *queryAnd:
+			walk(q.left)
+			walk(q.right)
+		case *queryOr:
+			walk(q.left)
+			walk(q.right)
+		case *queryTerm:
+			terms = append(terms, q)
+		}
+	}
+	walk(expr)
+	return terms
+}
+
+// inPathOffsets returns where the segment-aligned in_path filter hit.
+func inPathOffsets(secretPath, inPath string) [][2]int {
+	if inPath == "" {
+		return nil
+	}
+	for start := 0; start+len(inPath) <= len(secretPath); start++ {
+		end := start + len(inPath)
+		if secretPath[start:end] != inPath {
+			continue
+		}
+		if (start == 0 || secretPath[start-1] == '/') && (end == len(secretPath) || secretPath[end] == '/') {
+			return [][2]int{{start, end}}
+		}
+	}
+	return nil
+}
+
+// buildMatchDetail reads keys from a cache snapshot, which no rebuild changes.
+func buildMatchDetail(secretPath string, keys *SecretKeys, params *SearchParams, hs []highlighter) MatchDetail {
+	detail := MatchDetail{
+		Path:        secretPath,
+		Mount:       cfg.VaultMountPoint,
+		MatchedIn:   []string{},
+		MatchedKeys: []KeyMatch{},
+		Metadata:    keys.metadata(),
+		Deleted:     keys.isDeleted(),
+	}
+
+	for _, h := range hs {
+		if h.field != queryFieldKey {
+			detail.PathOffsets = append(detail.PathOffsets, h.find(secretPath)...)
+			detail.PathOffsets = append(detail.PathOffsets, h.findFuzzy(secretPath)...)
+		}
+	}
+	for _, inPath := range params.InPaths {
+		detail.PathOffsets = append(detail.PathOffsets, inPathOffsets(secretPath, inPath)...)
+	}
+	detail.PathOffsets = mergeOffsets(detail.PathOffsets)
+	if len(detail.PathOffsets) > 0 {
+		detail.MatchedIn = append(detail.MatchedIn, matchSourcePath)
+	}
+
+	if keys == nil {
+		return detail
+	}
+
+	seen := make(map[string]bool)
+	for i, key := range keys.AllKeys {
+		source := matchSourceKey
+		if keys.isNestedKey(i) {
+			source = matchSourceNestedKey
+		}
+		keyPath := keys.keyPath(i)
+		if keyPath == key {
+			keyPath = ""
+		}
+		id := source + "\x00" + key + "\x00" + keyPath
+		if seen[id] {
+			continue
+		}
+
+		var offsets, fuzzyOffsets, pathOffsets [][2]int
+		for _, h := range hs {
+			if h.field != queryFieldPath {
+				offsets = append(offsets, h.find(key)...)
+				if h.tokens != nil {
+					offsets = append(offsets, h.tokens.offsets(key)...)
+				}
+				fuzzyOffsets = append(fuzzyOffsets, h.findFuzzy(key)...)
+				if keyPath != "" {
+					pathOffsets = append(pathOffsets, h.find(keyPath)...)
+				}
+			}
+		}
+		fuzzy := len(offsets) == 0 && len(pathOffsets) == 0 && len(fuzzyOffsets) > 0
+		offsets = append(offsets, fuzzyOffsets...)
+		if len(offsets) == 0 && len(pathOffsets) == 0 {
+			continue
+		}
+		if offsets == nil {
+			offsets = [][2]int{}
+		}
+		seen[id] = true
+		detail.MatchedKeys = append(detail.MatchedKeys, KeyMatch{
+			Key:            key,
+			KeyPath:        keyPath,
+			Source:         source,
+			Offsets:        mergeOffsets(offsets),
+			KeyPathOffsets: mergeOffsets(pathOffsets),
+			Fuzzy:          fuzzy,
+		})
+		if !containsSource(detail.MatchedIn, source) {
+			detail.MatchedIn = append(detail.MatchedIn, source)
+		}
+	}
+
+	if params.AllVersions {
+		for _, old := range keys.History {
+			for _, km := range buildMatchDetail(secretPath, old, params, hs).MatchedKeys {
+				id := km.Source + "\x00" + km.Key + "\x00" + km.KeyPath
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				km.Version = old.version()
+				detail.MatchedKeys = append(detail.MatchedKeys, km)
+				if !containsSource(detail.MatchedIn, km.Source) {
+					detail.MatchedIn = append(detail.MatchedIn, km.Source)
+				}
+			}
+		}
+	}
+	return detail
+}
+
+// mergeOffsets sorts ranges and joins overlapping ones so highlights nest cleanly.
+func mergeOffsets(offsets [][2]int) [][2]int {
+	if len(offsets) < 2 {
+		return offsets
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i][0] < offsets[j][0] })
+	merged := offsets[:1]
+	for _, o := range offsets[1:] {
+		last := &merged[len(merged)-1]
+		if o[0] <= last[1] {
+			if o[1] > last[1] {
+				last[1] = o[1]
+			}
+			continue
+		}
+		merged = append(merged, o)
+	}
+	return merged
+}
+
+func containsSource(sources []string, source string) bool {
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
@@ -2,40 +2,102 @@ package main
 
 import (
 	"encoding/json"
+	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
-const maxNestedDepth = 10
+// keyCollector gathers key names together with the dotted path of each one,
+// e.g. "host" at "config.db.host" or "endpoint" at "clusters[0].endpoint".
+type keyCollector struct {
+	keys  []string
+	paths []string
+	// formats maps the path of a value that held a document to the format it
+	// was parsed as, e.g. "config" to "json".
+	formats map[string]string
+	// policy limits nested extraction; nil means the defaults.
+	policy *extractionPolicy
+}
+
+func (c *keyCollector) extractionPolicy() *extractionPolicy {
+	if c.policy == nil {
+		return &defaultExtractionPolicy
+	}
+	return c.policy
+}
+
+func (c *keyCollector) add(key, path string) {
+	c.keys = append(c.keys, key)
+	c.paths = append(c.paths, path)
+}
+
+func (c *keyCollector) setFormat(path, format string) {
+	if c.formats == nil {
+		c.formats = make(map[string]string)
+	}
+	c.formats[path] = format
+}
+
+func joinKeyPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func indexKeyPath(parent string, i int) string {
+	return parent + "[" + strconv.Itoa(i) + "]"
+}
 
-func extractKeysFromValue(data map[string]interface{}, logEntry *logrus.Entry) []string {
-	keys := make([]string, 0, len(data)*4)
+// extractKeys returns the top-level keys of a secret first, followed by every
+// key found in documents held in values, such as JSON or .env files. paths is
+// parallel to keys; a top-level key is its own path. formats maps the path of
+// each value that held a document to its format. A nil policy means the
+// defaults.
+func extractKeys(data map[string]interface{}, policy *extractionPolicy, logEntry *logrus.Entry) (keys, paths []string, formats map[string]string) {
+	c := &keyCollector{
+		keys:   make([]string, 0, len(data)*4),
+		paths:  make([]string, 0, len(data)*4),
+		policy: policy,
+	}
 	for key := range data {
-		keys = append(keys, key)
-		value := data[key]
-		extractNestedKeys(value, &keys, logEntry.WithField("parent_key", key), 0)
+		c.add(key, key)
+	}
+	if !c.extractionPolicy().enabled {
+		return c.keys, c.paths, nil
+	}
+	for key, value := range data {
+		extractNestedKeys(value, c, key, logEntry.WithField("parent_key", key), 0)
+	}
+	return c.keys, c.paths, c.formats
+}
+
+// dottedKeyPaths returns the paths of nested keys, which differ from the
+// bare key names and are indexed alongside them.
+func dottedKeyPaths(keys, paths []string) []string {
+	var dotted []string
+	for i, p := range paths {
+		if p != keys[i] {
+			dotted = append(dotted, p)
+		}
 	}
-	return keys
+	return dotted
 }
 
-func extractNestedKeys(value interface{}, keys *[]string, logEntry *logrus.Entry, depth int) {
-	if depth >= maxNestedDepth {
+func extractNestedKeys(value interface{}, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) {
+	if depth >= c.extractionPolicy().maxDepth {
 		return
 	}
 	switch v := value.(type) {
 	case string:
-		if looksLikeJSON(v) {
-			extractKeysFromJSON([]byte(v), keys, logEntry, depth+1)
-		} else if looksLikeYAML(v) {
-			extractKeysFromYAML([]byte(v), keys, logEntry, depth+1)
-		}
+		extractEmbeddedKeys(v, c, parent, logEntry, depth+1)
 	case map[string]interface{}:
-		collectKeysFromMap(v, keys, logEntry, depth+1)
+		collectKeysFromMap(v, c, parent, logEntry, depth+1)
 	case []interface{}:
 		for i, item := range v {
-			extractNestedKeys(item, keys, logEntry.WithField("array_index", i), depth+1)
+			extractNestedKeys(item, c, indexKeyPath(parent, i), logEntry.WithField("array_index", i), depth+1)
 		}
 	}
 }
@@ -62,51 +124,60 @@ func looksLikeYAML(s string) bool {
 	return hasColonSpace && strings.Contains(s, "\n")
 }
 
-func extractKeysFromJSON(data []byte, keys *[]string, logEntry *logrus.Entry, depth int) {
+// extractKeysFromJSON reports whether data parsed as a JSON object or array.
+func extractKeysFromJSON(data []byte, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
 	logEntry.Debug("Detected potential JSON in value, attempting to parse")
 
 	var parsed interface{}
 	if err := json.Unmarshal(data, &parsed); err != nil {
 		logEntry.WithError(err).Debug("Failed to parse JSON in value, skipping nested key extraction")
-		return
+		return false
 	}
 
 	switch v := parsed.(type) {
 	case map[string]interface{}:
-		collectKeysFromMap(v, keys, logEntry, depth)
+		collectKeysFromMap(v, c, parent, logEntry, depth)
 	case []interface{}:
 		for i, item := range v {
 			if m, ok := item.(map[string]interface{}); ok {
-				collectKeysFromMap(m, keys, logEntry.WithField("array_index", i), depth)
+				collectKeysFromMap(m, c, indexKeyPath(parent, i), logEntry.WithField("array_index", i), depth)
 			}
 		}
+	default:
+		return false
 	}
+	return true
 }
 
-func extractKeysFromYAML(data []byte, keys *[]string, logEntry *logrus.Entry, depth int) {
+// extractKeysFromYAML reports whether data parsed as a YAML object or array.
+func extractKeysFromYAML(data []byte, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
 	logEntry.Debug("Detected potential YAML in value, attempting to parse")
 
 	var parsed interface{}
 	if err := yaml.Unmarshal(data, &parsed); err != nil {
 		logEntry.WithError(err).Debug("Failed to parse YAML in value, skipping nested key extraction")
-		return
+		return false
 	}
 
 	switch v := parsed.(type) {
 	case map[string]interface{}:
-		collectKeysFromMap(v, keys, logEntry, depth)
+		collectKeysFromMap(v, c, parent, logEntry, depth)
 	case []interface{}:
 		for i, item := range v {
 			if m, ok := item.(map[string]interface{}); ok {
-				collectKeysFromMap(m, keys, logEntry.WithField("array_index", i), depth)
+				collectKeysFromMap(m, c, indexKeyPath(parent, i), logEntry.WithField("array_index", i), depth)
 			}
 		}
+	default:
+		return false
 	}
+	return true
 }
 
-func collectKeysFromMap(m map[string]interface{}, keys *[]string, logEntry *logrus.Entry, depth int) {
+func collectKeysFromMap(m map[string]interface{}, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) {
 	for key := range m {
-		*keys = append(*keys, key)
-		extractNestedKeys(m[key], keys, logEntry.WithField("nested_key", key), depth)
+		path := joinKeyPath(parent, key)
+		c.add(key, path)
+		extractNestedKeys(m[key], c, path, logEntry.WithField("nested_key", key), depth)
 	}
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultMaxNestedDepth = 10
+	defaultMaxValueSize   = 1 << 20
+)
+
+// extractionPolicy decides how far nested key extraction goes for one secret.
+type extractionPolicy struct {
+	enabled  bool
+	maxDepth int
+	// maxValueSize is the largest string value parsed for nested keys, in
+	// bytes; 0 means no limit.
+	maxValueSize uint64
+	disabled     map[string]bool
+}
+
+var defaultExtractionPolicy = extractionPolicy{
+	enabled:      true,
+	maxDepth:     defaultMaxNestedDepth,
+	maxValueSize: defaultMaxValueSize,
+}
+
+// extraction is loaded from cfg.ExtractionFile at startup; nil means the
+// defaults everywhere.
+var extraction *extractionConfig
+
+// extractionRules is one set of settings in the extraction config file. Unset
+// fields keep the value from the level above.
+type extractionRules struct {
+	Enabled      *bool           `yaml:"enabled"`
+	MaxDepth     *int            `yaml:"max_depth"`
+	MaxValueSize *byteSize       `yaml:"max_value_size"`
+	Formats      map[string]bool `yaml:"formats"`
+}
+
+type extractionOverride struct {
+	Path            string `yaml:"path"`
+	extractionRules `yaml:",inline"`
+
+	glob *regexp.Regexp
+}
+
+// extractionConfig is the file format:
+//
+//	max_depth: 10
+//	max_value_size: 1MiB
+//	formats:
+//	  xml: false
+//	overrides:
+//	  - path: pki/**
+//	    enabled: false
+//	  - path: apps/*/legacy/**
+//	    max_depth: 2
+//	    formats: {yaml: false}
+//
+// Overrides whose path glob matches a secret are applied in order, so a later
+// one wins.
+type extractionConfig struct {
+	extractionRules `yaml:",inline"`
+	Overrides       []extractionOverride `yaml:"overrides"`
+
+	base extractionPolicy
+}
+
+// byteSize accepts a plain number of bytes or a size such as 512KB or 1MiB.
+type byteSize uint64
+
+func (b *byteSize) UnmarshalYAML(node *yaml.Node) error {
+	n, err := humanize.ParseBytes(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid size %q", node.Line, node.Value)
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+func loadExtractionConfig(path string) (*extractionConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ec := &extractionConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(ec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := ec.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ec.base = ec.apply(defaultExtractionPolicy)
+	for i := range ec.Overrides {
+		o := &ec.Overrides[i]
+		if o.Path == "" {
+			return nil, fmt.Errorf("%s: override %d has no 'path'", path, i+1)
+		}
+		if o.glob, err = compilePathGlob(o.Path); err != nil {
+			return nil, fmt.Errorf("%s: invalid override path %q: %v", path, o.Path, err)
+		}
+		if err := o.validate(); err != nil {
+			return nil, fmt.Errorf("%s: override %q: %v", path, o.Path, err)
+		}
+	}
+	return ec, nil
+}
+
+func (r *extractionRules) validate() error {
+	if r.MaxDepth != nil && *r.MaxDepth < 0 {
+		return errors.New("'max_depth' cannot be negative")
+	}
+	for format := range r.Formats {
+		if !knownExtractionFormat(format) {
+			return fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(extractionFormats(), ", "))
+		}
+	}
+	return nil
+}
+
+func (r *extractionRules) apply(p extractionPolicy) extractionPolicy {
+	if r.Enabled != nil {
+		p.enabled = *r.Enabled
+	}
+	if r.MaxDepth != nil {
+		p.maxDepth = *r.MaxDepth
+	}
+	if r.MaxValueSize != nil {
+		p.maxValueSize = uint64(*r.MaxValueSize)
+	}
+	if len(r.Formats) > 0 {
+		disabled := make(map[string]bool, len(p.disabled)+len(r.Formats))
+		for format, off := range p.disabled {
+			disabled[format] = off
+		}
+		for format, on := range r.Formats {
+			disabled[format] = !on
+		}
+		p.disabled = disabled
+	}
+	return p
+}
+
+// policyFor returns the policy for secretPath.
+func (ec *extractionConfig) policyFor(secretPath string) *extractionPolicy {
+	if ec == nil {
+		p := defaultExtractionPolicy
+		return &p
+	}
+	p := ec.base
+	for i := range ec.Overrides {
+		if o := &ec.Overrides[i]; o.glob.MatchString(secretPath) {
+			p = o.apply(p)
+		}
+	}
+	return &p
+}
+
+func extractionFormats() []string {
+	formats := make([]string, len(keyExtractors))
+	for i, e := range keyExtractors {
+		formats[i] = e.format()
+	}
+	return formats
+}
+
+func knownExtractionFormat(format string) bool {
+	for _, e := range keyExtractors {
+		if e.format() == format {
+			return true
+		}
+	}
+	return false
+}
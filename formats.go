@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/hcl"
+	"github.com/sirupsen/logrus"
+)
+
+// keyExtractor finds key names in a secret value that holds a whole document,
+// such as a JSON blob or a .env file.
+type keyExtractor interface {
+	format() string
+	// sniff is a cheap check that s may be in this format. It must reject
+	// single-line values, so passwords and tokens are never parsed as files,
+	// unless the format marks itself unmistakably: JSON starts with { or [,
+	// base64 JSON only counts if it decodes to JSON, and one-line XML needs
+	// a declaration or a namespace.
+	sniff(s string) bool
+	// extract parses s and adds its keys under parent. It returns false when
+	// s turns out not to be in this format, so the next extractor can try.
+	extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool
+}
+
+// keyExtractors are tried in order and the first one that extracts wins. The
+// strict line-based formats come before YAML, which accepts almost any text,
+// and Java properties come last because YAML already covers key: value.
+var keyExtractors = []keyExtractor{
+	jsonExtractor{},
+	base64JSONExtractor{},
+	xmlExtractor{},
+	hclExtractor{},
+	tomlExtractor{},
+	iniExtractor{},
+	envExtractor{},
+	yamlExtractor{},
+	propertiesExtractor{},
+}
+
+// extractEmbeddedKeys returns the format the value was parsed as, or "" when
+// no extractor recognised it or the policy skipped it.
+func extractEmbeddedKeys(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) string {
+	policy := c.extractionPolicy()
+	if policy.maxValueSize > 0 && uint64(len(s)) > policy.maxValueSize {
+		logEntry.WithField("size", len(s)).Debug("Value is larger than max_value_size, skipping nested key extraction")
+		return ""
+	}
+	for _, e := range keyExtractors {
+		if policy.disabled[e.format()] {
+			continue
+		}
+		if e.sniff(s) && e.extract(s, c, parent, logEntry.WithField("format", e.format()), depth) {
+			c.setFormat(parent, e.format())
+			return e.format()
+		}
+	}
+	return ""
+}
+
+// docKey is a key found by one of the document parsers below; path is
+// relative to the value that held the document.
+type docKey struct {
+	key, path string
+	// value is the key's string value, searched for further documents.
+	value string
+}
+
+// addDocKeys parses s with parse and, on success, adds the keys under parent.
+func addDocKeys(format string, parse func(string) ([]docKey, error), s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	logEntry.Debugf("Detected potential %s in value, attempting to parse", format)
+
+	keys, err := parse(s)
+	if err != nil {
+		logEntry.WithError(err).Debugf("Failed to parse %s in value", format)
+		return false
+	}
+	for _, k := range keys {
+		path := joinKeyPath(parent, k.path)
+		c.add(k.key, path)
+		if k.value != "" {
+			extractNestedKeys(k.value, c, path, logEntry.WithField("nested_key", k.key), depth)
+		}
+	}
+	return true
+}
+
+// isMultiLine is the common guard of the line-based formats.
+func isMultiLine(s string) bool {
+	return strings.Contains(strings.TrimSpace(s), "\n")
+}
+
+// minLineEntries keeps two-line text with an = in it from being taken for a
+// .env or properties file.
+const minLineEntries = 2
+
+type jsonExtractor struct{}
+
+func (jsonExtractor) format() string      { return "json" }
+func (jsonExtractor) sniff(s string) bool { return looksLikeJSON(s) }
+func (jsonExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	return extractKeysFromJSON([]byte(s), c, parent, logEntry, depth)
+}
+
+type yamlExtractor struct{}
+
+func (yamlExtractor) format() string      { return "yaml" }
+func (yamlExtractor) sniff(s string) bool { return looksLikeYAML(s) }
+func (yamlExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	return extractKeysFromYAML([]byte(s), c, parent, logEntry, depth)
+}
+
+// base64JSONExtractor handles JSON stored base64-encoded, as Kubernetes does
+// with Secret data.
+type base64JSONExtractor struct{}
+
+// minBase64JSONLen is the encoded length of the shortest useful object,
+// {"a":1}.
+const minBase64JSONLen = 12
+
+var base64Pattern = regexp.MustCompile(`^[A-Za-z0-9+/_-]+={0,2}$`)
+
+func (base64JSONExtractor) format() string { return "base64-json" }
+
+func (base64JSONExtractor) sniff(s string) bool {
+	s = strings.TrimSpace(s)
+	return len(s) >= minBase64JSONLen && base64Pattern.MatchString(s)
+}
+
+func (base64JSONExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	decoded, ok := decodeBase64(strings.TrimSpace(s))
+	// Random passwords are valid base64 too; only decoded JSON counts.
+	if !ok || !utf8.Valid(decoded) || !looksLikeJSON(string(decoded)) {
+		return false
+	}
+	return extractKeysFromJSON(decoded, c, parent, logEntry, depth)
+}
+
+func decodeBase64(s string) ([]byte, bool) {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(s); err == nil {
+			return decoded, true
+		}
+	}
+	return nil, false
+}
+
+// xmlExtractor takes element and attribute names as keys, so
+// <db port="5432"><host>x</host></db> yields db, db.port and db.host.
+type xmlExtractor struct{}
+
+func (xmlExtractor) format() string { return "xml" }
+
+func (xmlExtractor) sniff(s string) bool {
+	s = strings.TrimSpace(s)
+	if len(s) <= 2 || s[0] != '<' || s[len(s)-1] != '>' {
+		return false
+	}
+	// Markup such as <b>bold</b> is a value, not a document.
+	return isMultiLine(s) || strings.HasPrefix(s, "<?xml") || strings.Contains(s, " xmlns")
+}
+
+func (xmlExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	return addDocKeys("XML", parseXMLKeys, s, c, parent, logEntry, depth)
+}
+
+func parseXMLKeys(s string) ([]docKey, error) {
+	dec := xml.NewDecoder(strings.NewReader(s))
+	var (
+		keys   []docKey
+		stack  []string
+		seen   = make(map[string]bool)
+		closed bool
+	)
+	add := func(key, path string) {
+		if !seen[path] {
+			seen[path] = true
+			keys = append(keys, docKey{key: key, path: path})
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if closed && len(stack) == 0 {
+				return nil, errors.New("more than one root element")
+			}
+			parent := ""
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			path := joinKeyPath(parent, t.Name.Local)
+			add(t.Name.Local, path)
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				add(attr.Name.Local, joinKeyPath(path, attr.Name.Local))
+			}
+			stack = append(stack, path)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			closed = true
+		case xml.CharData:
+			if len(stack) == 0 && len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("text outside the root element")
+			}
+		}
+	}
+	if !closed {
+		return nil, errors.New("no elements")
+	}
+	return keys, nil
+}
+
+// hclExtractor handles HashiCorp configuration such as Terraform or Vault
+// agent files. Block labels become keys too, so resource "aws_db" "main" {}
+// yields resource, resource.aws_db and resource.aws_db.main.
+type hclExtractor struct{}
+
+// hclBlockPattern matches the opening line of a block: a name, optional
+// labels and a brace.
+var hclBlockPattern = regexp.MustCompile(`(?m)^\s*[A-Za-z_][\w-]*(\s+("[^"]*"|[A-Za-z_][\w-]*))*\s*\{\s*$`)
+
+func (hclExtractor) format() string { return "hcl" }
+
+func (hclExtractor) sniff(s string) bool {
+	return isMultiLine(s) && hclBlockPattern.MatchString(s)
+}
+
+func (hclExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	return addDocKeys("HCL", parseHCLKeys, s, c, parent, logEntry, depth)
+}
+
+func parseHCLKeys(s string) ([]docKey, error) {
+	var parsed interface{}
+	if err := hcl.Unmarshal([]byte(s), &parsed); err != nil {
+		return nil, err
+	}
+	var keys []docKey
+	collectHCLKeys(parsed, "", &keys)
+	return keys, nil
+}
+
+// collectHCLKeys walks decoded HCL, where every block is a list of maps even
+// when it appears once; single blocks get no index in the path.
+func collectHCLKeys(v interface{}, path string, keys *[]docKey) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			k := docKey{key: key, path: joinKeyPath(path, key)}
+			if str, ok := val.(string); ok {
+				k.value = str
+			}
+			*keys = append(*keys, k)
+			collectHCLKeys(val, k.path, keys)
+		}
+	case []map[string]interface{}:
+		if len(v) == 1 {
+			collectHCLKeys(v[0], path, keys)
+			return
+		}
+		for i, m := range v {
+			collectHCLKeys(m, indexKeyPath(path, i), keys)
+		}
+	case []interface{}:
+		for i, item := range v {
+			collectHCLKeys(item, indexKeyPath(path, i), keys)
+		}
+	}
+}
+
+// sectionHeaderPattern matches an INI [section] or a TOML [table] or
+// [[array]] header line.
+var sectionHeaderPattern = regexp.MustCompile(`(?m)^\s*\[\[?[^\[\]\n]+\]\]?\s*([#;].*)?$`)
+
+// tomlExtractor needs at least one [table] header; a flat TOML file reads the
+// same as a .env or properties file. Unquoted string values are not valid
+// TOML, which is what tells TOML and INI apart.
+type tomlExtractor struct{}
+
+func (tomlExtractor) format() string { return "toml" }
+
+func (tomlExtractor) sniff(s string) bool {
+	return isMultiLine(s) && sectionHeaderPattern.MatchString(s)
+}
+
+func (tomlExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	return addDocKeys("TOML", parseTOMLKeys, s, c, parent, logEntry, depth)
+}
+
+func parseTOMLKeys(s string) ([]docKey, error) {
+	var parsed map[string]interface{}
+	if _, err := toml.Decode(s, &parsed); err != nil {
+		return nil, err
+	}
+	var keys []docKey
+	collectTOMLKeys(parsed, "", &keys)
+	return keys, nil
+}
+
+// collectTOMLKeys walks decoded TOML. Unlike HCL blocks, a [[name]] table is
+// indexed in the path even when it appears once.
+func collectTOMLKeys(v interface{}, path string, keys *[]docKey) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			k := docKey{key: key, path: joinKeyPath(path, key)}
+			if str, ok := val.(string); ok {
+				k.value = str
+			}
+			*keys = append(*keys, k)
+			collectTOMLKeys(val, k.path, keys)
+		}
+	case []map[string]interface{}:
+		for i, m := range v {
+			collectTOMLKeys(m, indexKeyPath(path, i), keys)
+		}
+	case []interface{}:
+		for i, item := range v {
+			collectTOMLKeys(item, indexKeyPath(path, i), keys)
+		}
+	}
+}
+
+// iniExtractor handles [section] files with key = value or key: value lines.
+type iniExtractor struct{}
+
+func (iniExtractor) format() string { return "ini" }
+
+func (iniExtractor) sniff(s string) bool {
+	return isMultiLine(s) && sectionHeaderPattern.MatchString(s)
+}
+
+func (iniExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	return addDocKeys("INI", parseINIKeys, s, c, parent, logEntry, depth)
+}
+
+func parseINIKeys(s string) ([]docKey, error) {
+	var (
+		keys    []docKey
+		section string
+		seen    = make(map[string]bool)
+		last    = -1
+		entries int
+	)
+	for i, raw := range strings.Split(s, "\n") {
+		line := strings.TrimSpace(raw)
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[':
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated section header", i+1)
+			}
+			section = strings.TrimSpace(line[1:end])
+			if !seen[section] {
+				seen[section] = true
+				keys = append(keys, docKey{key: section, path: section})
+			}
+			last = -1
+			continue
+		case raw[0] == ' ' || raw[0] == '\t':
+			// An indented line continues the previous value.
+			if last >= 0 {
+				keys[last].value += "\n" + line
+				continue
+			}
+		}
+		sep := strings.IndexAny(line, "=:")
+		if sep <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key := strings.TrimSpace(line[:sep])
+		keys = append(keys, docKey{key: key, path: joinKeyPath(section, key), value: unquote(strings.TrimSpace(line[sep+1:]))})
+		last = len(keys) - 1
+		entries++
+	}
+	if section == "" || entries == 0 {
+		return nil, errors.New("no sections with keys")
+	}
+	return keys, nil
+}
+
+// envExtractor handles .env files: NAME=value lines, optionally prefixed
+// with export, where a quoted value may span lines.
+type envExtractor struct{}
+
+var envLinePattern = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+func (envExtractor) format() string      { return "env" }
+func (envExtractor) sniff(s string) bool { return isMultiLine(s) && strings.Contains(s, "=") }
+func (envExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	return addDocKeys("env", parseEnvKeys, s, c, parent, logEntry, depth)
+}
+
+func parseEnvKeys(s string) ([]docKey, error) {
+	var keys []docKey
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		m := envLinePattern.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: expected NAME=value", i+1)
+		}
+		value := strings.TrimSpace(m[2])
+		if q := quoteChar(value); q != 0 && (len(value) == 1 || value[len(value)-1] != q) {
+			start := i
+			for i++; i < len(lines); i++ {
+				value += "\n" + lines[i]
+				if strings.HasSuffix(strings.TrimSpace(lines[i]), string(q)) {
+					break
+				}
+			}
+			if i == len(lines) {
+				return nil, fmt.Errorf("line %d: unterminated quoted value", start+1)
+			}
+			value = strings.TrimSpace(value)
+		} else if q == 0 {
+			if hash := strings.Index(value, " #"); hash >= 0 {
+				value = strings.TrimSpace(value[:hash])
+			}
+		}
+		keys = append(keys, docKey{key: m[1], path: m[1], value: unquote(value)})
+	}
+	if len(keys) < minLineEntries {
+		return nil, errors.New("too few variables")
+	}
+	return keys, nil
+}
+
+// propertiesExtractor handles Java .properties files. Unlike Java it insists
+// on = or : between key and value, so two lines of prose are not a file.
+type propertiesExtractor struct{}
+
+var propertiesKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+func (propertiesExtractor) format() string { return "properties" }
+
+func (propertiesExtractor) sniff(s string) bool {
+	return isMultiLine(s) && strings.ContainsAny(s, "=:")
+}
+
+func (propertiesExtractor) extract(s string, c *keyCollector, parent string, logEntry *logrus.Entry, depth int) bool {
+	return addDocKeys("properties", parsePropertiesKeys, s, c, parent, logEntry, depth)
+}
+
+func parsePropertiesKeys(s string) ([]docKey, error) {
+	var keys []docKey
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		start := i
+		// A trailing backslash continues the value on the next line.
+		for strings.HasSuffix(line, `\`) && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, `\`) + strings.TrimSpace(lines[i])
+		}
+		sep := strings.IndexAny(line, "=:")
+		if sep <= 0 {
+			return nil, fmt.Errorf("line %d: expected key=value", start+1)
+		}
+		key := strings.TrimSpace(line[:sep])
+		if !propertiesKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", start+1, key)
+		}
+		keys = append(keys, docKey{key: key, path: key, value: strings.TrimSpace(line[sep+1:])})
+	}
+	if len(keys) < minLineEntries {
+		return nil, errors.New("too few properties")
+	}
+	return keys, nil
+}
+
+func quoteChar(s string) byte {
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		return s[0]
+	}
+	return 0
+}
+
+func unquote(s string) string {
+	if q := quoteChar(s); q != 0 && len(s) >= 2 && s[len(s)-1] == q {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const maxSuggestions = 5
+
+// fuzzyDistance scales the configured edit distance down for short terms,
+// where a couple of edits would match almost anything.
+func fuzzyDistance(term string, max int) int {
+	n := len([]rune(term))
+	switch {
+	case n < 3:
+		return 0
+	case n < 6:
+		return min(max, 1)
+	}
+	return max
+}
+
+// editDistance is the optimal string alignment distance between a and b, so a
+// swap of two neighbouring characters counts as one edit. It stops early and
+// returns max+1 once the distance is known to exceed max.
+func editDistance(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return min(prev[len(rb)], max+1)
+}
+
+// fuzzySegments returns the '/'-separated segments of s that are within
+// distance edits of term. Key names have no '/', so for them it is the whole
+// name or nothing. term must be lowercased.
+func fuzzySegments(s, term string, distance int) [][2]int {
+	if distance <= 0 {
+		return nil
+	}
+	var offsets [][2]int
+	start := 0
+	for start <= len(s) {
+		end := strings.IndexByte(s[start:], '/')
+		if end < 0 {
+			end = len(s)
+		} else {
+			end += start
+		}
+		if end > start && editDistance(strings.ToLower(s[start:end]), term, distance) <= distance {
+			offsets = append(offsets, [2]int{start, end})
+		}
+		start = end + 1
+	}
+	return offsets
+}
+
+func fuzzyMatch(s, term string, distance int) bool {
+	return len(fuzzySegments(s, term, distance)) > 0
+}
+
+// keyUsage is one entry of the key vocabulary: a key name and the number of
+// secrets that have it.
+type keyUsage struct {
+	Key     string `json:"key"`
+	Secrets int    `json:"secrets"`
+}
+
+// buildKeyVocabulary lists every distinct key name, sorted case-insensitively
+// so /suggest can binary-search it for a prefix.
+func buildKeyVocabulary(data map[string]*SecretKeys) []keyUsage {
+	counts := make(map[string]int)
+	for _, keys := range data {
+		seen := make(map[string]bool, len(keys.AllKeys))
+		for _, key := range keys.AllKeys {
+			if !seen[key] {
+				seen[key] = true
+				counts[key]++
+			}
+		}
+	}
+	vocab := make([]keyUsage, 0, len(counts))
+	for key, n := range counts {
+		vocab = append(vocab, keyUsage{Key: key, Secrets: n})
+	}
+	sort.Slice(vocab, func(i, j int) bool {
+		a, b := strings.ToLower(vocab[i].Key), strings.ToLower(vocab[j].Key)
+		if a != b {
+			return a < b
+		}
+		return vocab[i].Key < vocab[j].Key
+	})
+	return vocab
+}
+
+// suggestionWords are the literal words of a search that could be misspelled
+// key names.
+func suggestionWords(params *SearchParams) []string {
+	switch {
+	case params.QueryExpr != nil:
+		var words []string
+		for _, term := range positiveQueryTerms(params.QueryExpr) {
+			if term.regex != nil || term.field == queryFieldPath || term.scope == searchScopePath {
+				continue
+			}
+			words = append(words, term.value)
+		}
+		return words
+	case params.Term != "" && params.Scope != searchScopePath:
+		return []string{strings.ToLower(params.Term)}
+	}
+	return nil
+}
+
+// suggestKeys returns "did you mean" key names for the words of a search,
+// closest first and, at the same distance, the most widely used first.
+func suggestKeys(vocab []keyUsage, params *SearchParams) []string {
+	type candidate struct {
+		key      string
+		distance int
+		secrets  int
+	}
+	best := make(map[string]candidate)
+	for _, word := range suggestionWords(params) {
+		distance := fuzzyDistance(word, cfg.FuzzyDistance)
+		if distance == 0 {
+			continue
+		}
+		for _, ku := range vocab {
+			lower := strings.ToLower(ku.Key)
+			if lower == word {
+				continue
+			}
+			d := editDistance(lower, word, distance)
+			if d > distance {
+				continue
+			}
+			if c, ok := best[ku.Key]; !ok || d < c.distance {
+				best[ku.Key] = candidate{key: ku.Key, distance: d, secrets: ku.Secrets}
+			}
+		}
+	}
+
+	candidates := make([]candidate, 0, len(best))
+	for _, c := range best {
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.distance != b.distance {
+			return a.distance < b.distance
+		}
+		if a.secrets != b.secrets {
+			return a.secrets > b.secrets
+		}
+		return a.key < b.key
+	})
+
+	suggestions := make([]string, 0, min(len(candidates), maxSuggestions))
+	for _, c := range candidates {
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+		suggestions = append(suggestions, c.key)
+	}
+	return suggestions
+}
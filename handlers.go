@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -33,6 +37,10 @@ func writeJSONError(w http.ResponseWriter, status int, message string) {
 	writeJSON(w, status, map[string]string{"error": message})
 }
 
+// errKeysNotIndexed rejects key name searches against a cache built with
+// VAULT_METADATA_ONLY, which would otherwise silently match paths only.
+var errKeysNotIndexed = errors.New("key names are not indexed: the cache is built from metadata only (VAULT_METADATA_ONLY), search paths with scope=path, path: terms or path filters")
+
 func searchHandler(w http.ResponseWriter, r *http.Request) {
 	params, err := parseSearchParams(r)
 	if err != nil {
@@ -40,7 +48,8 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logger.Infof("Search request received: term=%s, regexp=%s, in_path=%s", params.Term, params.Regexp, params.InPath)
+	logger.Infof("Search request received: term=%s, regexp=%s, q=%s, in_path=%v, path_glob=%v, exclude_path=%v, exclude_glob=%v, meta=%v, updated=%v, created=%v",
+		params.Term, params.Regexp, params.Query, params.InPaths, params.PathGlobs, params.ExcludePaths, params.ExcludeGlobs, params.Meta, params.Updated, params.Created)
 
 	var regex *regexp.Regexp
 	if params.Regexp != "" {
@@ -57,6 +66,13 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 	result, err := performSearch(params, regex, ctx)
 	if err != nil {
+		if errors.Is(err, errCursorExpired) {
+			writeJSONError(w, http.StatusGone, err.Error())
+			return
+		}
+		if writeCallerError(w, err) {
+			return
+		}
 		if ctx.Err() == context.DeadlineExceeded {
 			writeJSONError(w, http.StatusGatewayTimeout, "Search timeout exceeded")
 			logger.Errorf("Search timeout exceeded for term=%s, regexp=%s", params.Term, params.Regexp)
@@ -67,43 +83,236 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"matches": result.Matches,
-	})
+	writeJSON(w, http.StatusOK, searchResponse(params, result))
 
-	logger.Infof("Search completed. Found %d matches for term='%s', regexp='%s', in_path='%s'",
-		len(result.Matches), params.Term, params.Regexp, params.InPath)
+	logger.Infof("Search completed. Found %d matches for term='%s', regexp='%s', q='%s', in_path=%v, path_glob=%v",
+		result.Total, params.Term, params.Regexp, params.Query, params.InPaths, params.PathGlobs)
+}
+
+// searchResponse wraps a page of matches in the envelope shared by /search
+// and the MCP search tool.
+func searchResponse(params *SearchParams, result *SearchResult) map[string]interface{} {
+	var matches interface{} = result.Matches
+	if params.Details {
+		matches = result.Details
+	}
+
+	resp := map[string]interface{}{
+		"matches":    matches,
+		"total":      result.Total,
+		"offset":     result.Offset,
+		"took_ms":    result.Took.Milliseconds(),
+		"generation": result.Generation,
+		"cache_age":  humanReadableDuration(result.CacheAge),
+	}
+	if params.Limit > 0 {
+		resp["limit"] = params.Limit
+	}
+	if result.TotalPartial {
+		resp["total_partial"] = true
+	}
+	if result.NextCursor != "" {
+		resp["next_cursor"] = result.NextCursor
+	}
+	if len(result.Suggestions) > 0 {
+		resp["did_you_mean"] = result.Suggestions
+	}
+	if result.Versions != nil && !params.Details {
+		resp["versions"] = result.Versions
+	}
+	if result.Capabilities != nil && !params.Details {
+		resp["capabilities"] = result.Capabilities
+	}
+	return resp
 }
 
 func parseSearchParams(r *http.Request) (*SearchParams, error) {
-	term := r.URL.Query().Get("term")
-	regexpParam := r.URL.Query().Get("regexp")
-	inPath := r.URL.Query().Get("in_path")
-	sortOrder := r.URL.Query().Get("sort")
-	showUI := r.URL.Query().Get("show_ui") == "true"
+	params, err := parseSearchQuery(r.URL.Query())
+	if err == nil && params.Capabilities {
+		params.capabilitiesOf = requestCaller(r)
+	}
+	return params, err
+}
+
+func parseSearchQuery(query url.Values) (*SearchParams, error) {
+	term := query.Get("term")
+	regexpParam := query.Get("regexp")
+	q := query.Get("q")
+	scope := query.Get("scope")
+	sortOrder := query.Get("sort")
+	showUI := query.Get("show_ui") == "true"
+	details := query.Get("details") == "true"
+	fuzzy := query.Get("fuzzy") == "true"
+	includeDeleted := query.Get("include_deleted") == "true"
+	withCapabilities := query.Get("capabilities") == "true"
 
-	if term == "" && regexpParam == "" && inPath == "" {
-		return nil, fmt.Errorf("at least one of 'term', 'regexp', or 'in_path' query parameters is required")
+	if term == "" && regexpParam == "" && q == "" && query.Get("in_path") == "" && query.Get("path_glob") == "" &&
+		!hasMetaFilter(query) && !hasTimeFilter(query) {
+		return nil, fmt.Errorf("at least one of 'term', 'regexp', 'q', 'in_path', 'path_glob', 'meta.<key>' or a time filter query parameter is required")
 	}
 
 	if term != "" && regexpParam != "" {
 		return nil, fmt.Errorf("'term' and 'regexp' are mutually exclusive, use only one")
 	}
 
-	if sortOrder != "" && sortOrder != "asc" && sortOrder != "desc" {
-		return nil, fmt.Errorf("'sort' must be 'asc' or 'desc'")
+	if q != "" && (term != "" || regexpParam != "") {
+		return nil, fmt.Errorf("'q' cannot be combined with 'term' or 'regexp'")
+	}
+
+	if fuzzy && regexpParam != "" {
+		return nil, fmt.Errorf("'fuzzy' cannot be combined with 'regexp'")
+	}
+
+	if scope != "" && scope != searchScopePath && scope != searchScopeKeys && scope != searchScopeAll {
+		return nil, fmt.Errorf("'scope' must be 'path', 'keys' or 'all'")
+	}
+
+	var expr queryExpr
+	if q != "" {
+		var err error
+		expr, err = parseQuery(q, scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.MetadataOnly && ((term != "" || regexpParam != "") && scope != searchScopePath || expr != nil && searchesKeys(expr)) {
+		return nil, errKeysNotIndexed
+	}
+
+	var fuzzyDistance int
+	if fuzzy {
+		fuzzyDistance = cfg.FuzzyDistance
+		if expr != nil {
+			fuzzyQueryTerms(expr, fuzzyDistance)
+		}
+	}
+
+	if sortOrder != "" && sortOrder != "asc" && sortOrder != "desc" && sortOrder != sortRelevance && sortOrder != sortUpdated {
+		return nil, fmt.Errorf("'sort' must be 'asc', 'desc', 'relevance' or 'updated'")
+	}
+
+	params := &SearchParams{
+		Term:           term,
+		Regexp:         regexpParam,
+		Query:          q,
+		QueryExpr:      expr,
+		Scope:          scope,
+		Sort:           sortOrder,
+		ShowUI:         showUI,
+		Details:        details,
+		Fuzzy:          fuzzyDistance,
+		IncludeDeleted: includeDeleted,
+		Capabilities:   withCapabilities,
+	}
+	if term != "" {
+		params.termTokens = newTokenQuery(term, synonyms)
+	}
+
+	if err := parsePathFilters(query, params); err != nil {
+		return nil, err
+	}
+
+	if err := parseMetaFilters(query, params); err != nil {
+		return nil, err
+	}
+
+	if err := parseTimeFilters(query, params, time.Now()); err != nil {
+		return nil, err
 	}
 
-	return &SearchParams{
-		Term:   term,
-		Regexp: regexpParam,
-		InPath: inPath,
-		Sort:   sortOrder,
-		ShowUI: showUI,
-	}, nil
+	if err := parseVersions(query, params); err != nil {
+		return nil, err
+	}
+
+	if err := parsePaging(query, params); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = suggestKindPath
+	}
+	if kind != suggestKindPath && kind != suggestKindKey {
+		writeJSONError(w, http.StatusBadRequest, "'kind' must be 'path' or 'key'")
+		return
+	}
+	if kind == suggestKindKey && cfg.MetadataOnly {
+		writeJSONError(w, http.StatusBadRequest, errKeysNotIndexed.Error())
+		return
+	}
+
+	limit := defaultSuggestLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxSuggestLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("'limit' must be an integer between 1 and %d", maxSuggestLimit))
+			return
+		}
+		limit = n
+	}
+
+	suggestions, err := suggestCompletions(r.Context(), kind, prefix, limit)
+	if writeCallerError(w, err) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"prefix":      prefix,
+		"kind":        kind,
+		"suggestions": suggestions,
+	})
+}
+
+func treeHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := normalizeTreePrefix(r.URL.Query().Get("path"))
+	visible, err := callerFrom(r.Context()).visibility(r.Context(), cachedPaths(prefix))
+	if writeCallerError(w, err) {
+		return
+	}
+	tree := buildPathTree(prefix, visible)
+	if tree.Path != "" && tree.SecretCount == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no secrets under '%s' in cache", tree.Path))
+		return
+	}
+	writeJSON(w, http.StatusOK, tree)
+}
+
+// secretKeysHandler serves GET /secrets/{path}/keys. The secret path may
+// contain slashes, so it is everything between the prefix and /keys.
+func secretKeysHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/secrets/")
+	secretPath, ok := strings.CutSuffix(rest, "/keys")
+	if !ok || strings.Trim(secretPath, "/") == "" {
+		writeJSONError(w, http.StatusNotFound, "expected /secrets/{path}/keys")
+		return
+	}
+	// Key names need read on the secret; listing its folder is not enough.
+	readable, err := callerFrom(r.Context()).readable(r.Context(), []string{strings.Trim(secretPath, "/")})
+	if writeCallerError(w, err) {
+		return
+	}
+	tree, ok := buildSecretKeyTree(secretPath)
+	if !ok || !readable.allows(tree.Path) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("secret not found in cache: %s", strings.Trim(secretPath, "/")))
+		return
+	}
+	writeJSON(w, http.StatusOK, tree)
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cacheStatus())
+
+	logger.Info("Status requested")
+}
+
+func cacheStatus() map[string]interface{} {
 	cache.RLock()
 	defer cache.RUnlock()
 
@@ -133,8 +342,9 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		progress = int(fetchedSecrets * 100 / totalSecrets)
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
+	return map[string]interface{}{
 		"version":             version,
+		"generation":          cache.generation,
 		"cache_age":           cacheAgeStr,
 		"build_duration":      buildDurationStr,
 		"is_rebuilding":       isRebuilding,
@@ -142,10 +352,12 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		"fetched_secrets":     fetchedSecrets,
 		"total_secrets":       totalSecrets,
 		"total_keys_indexed":  totalKeys,
+		"deleted_secrets":     atomic.LoadInt64(&cache.deletedSecrets),
+		"metadata_only":       cfg.MetadataOnly,
+		"denied_secrets":      len(cache.deniedSecrets),
+		"denied_folders":      len(cache.deniedFolders),
 		"progress_percentage": progress,
-	})
-
-	logger.Info("Status requested")
+	}
 }
 
 func rebuildHandler(w http.ResponseWriter, r *http.Request) {
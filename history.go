@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	versionsCurrent = "current"
+	versionsAll     = "all"
+)
+
+// version returns the KV version k holds, or 0 if Vault did not say. For an
+// entry of History it is that older version.
+func (k *SecretKeys) version() int {
+	if k == nil || k.Metadata == nil {
+		return 0
+	}
+	return k.Metadata.CurrentVersion
+}
+
+// searchStrings returns the SearchString of the current and every indexed
+// older version, so the trigram index covers versions=all.
+func (k *SecretKeys) searchStrings() []string {
+	if len(k.History) == 0 {
+		return []string{k.SearchString}
+	}
+	s := make([]string, 0, len(k.History)+1)
+	s = append(s, k.SearchString)
+	for _, old := range k.History {
+		s = append(s, old.SearchString)
+	}
+	return s
+}
+
+// readSecretHistory reads up to cfg.HistoryVersions versions before the
+// current one, newest first. Versions past max_versions are gone from Vault
+// and are not asked for; deleted and destroyed versions have no data and are
+// skipped.
+func readSecretHistory(ctx context.Context, secretPath string, meta *SecretMetadata, policy *extractionPolicy, logEntry *logrus.Entry) []*SecretKeys {
+	if cfg.HistoryVersions <= 0 || meta == nil || meta.CurrentVersion <= 1 {
+		return nil
+	}
+	current := meta.CurrentVersion
+	oldest := max(1, current-cfg.HistoryVersions)
+	if meta.MaxVersions > 0 {
+		oldest = max(oldest, current-meta.MaxVersions+1)
+	}
+
+	var history []*SecretKeys
+	for v := current - 1; v >= oldest; v-- {
+		secret, err := vaultClient.Logical().ReadWithDataWithContext(ctx,
+			fmt.Sprintf("%s/data/%s", cfg.VaultMountPoint, secretPath),
+			map[string][]string{"version": {strconv.Itoa(v)}})
+		if err != nil {
+			if isPermissionDenied(err) {
+				logEntry.WithError(err).Warn("Access denied for secret version")
+				return history
+			}
+			logEntry.WithError(err).WithField("version", v).Error("Failed to read secret version")
+			continue
+		}
+		if secret == nil || secret.Data == nil {
+			continue
+		}
+		data, ok := secret.Data["data"].(map[string]interface{})
+		if !ok {
+			logEntry.WithField("version", v).Debug("Secret version is deleted or destroyed")
+			continue
+		}
+		old := newSecretKeys(secretPath, data, policy, logEntry)
+		old.Metadata = metadataFromRead(secret.Data)
+		if old.Metadata == nil {
+			old.Metadata = &SecretMetadata{CurrentVersion: v}
+		}
+		history = append(history, old)
+	}
+	return history
+}
+
+// parseVersions reads versions=current|all.
+func parseVersions(query url.Values, params *SearchParams) error {
+	switch v := query.Get("versions"); v {
+	case "", versionsCurrent:
+	case versionsAll:
+		if cfg.MetadataOnly {
+			return fmt.Errorf("'versions=all' needs older versions in the cache, which a metadata-only crawl does not read")
+		}
+		if cfg.HistoryVersions <= 0 {
+			return fmt.Errorf("'versions=all' needs older versions in the cache, set VAULT_HISTORY_VERSIONS")
+		}
+		params.AllVersions = true
+	default:
+		return fmt.Errorf("'versions' must be 'current' or 'all'")
+	}
+	return nil
+}
+
+// matchSecretVersions is matchSecret over the current version and, with
+// versions=all, every indexed older version.
+func matchSecretVersions(secretPath string, keys *SecretKeys, params *SearchParams, regex *regexp.Regexp) bool {
+	if matchSecret(secretPath, keys, params, regex) {
+		return true
+	}
+	if params.AllVersions && keys != nil {
+		for _, old := range keys.History {
+			if matchSecret(secretPath, old, params, regex) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchedVersions lists the versions of a secret that match the search,
+// newest first.
+func matchedVersions(secretPath string, keys *SecretKeys, params *SearchParams, regex *regexp.Regexp) []int {
+	if keys == nil {
+		return nil
+	}
+	var versions []int
+	if matchSecret(secretPath, keys, params, regex) {
+		versions = append(versions, keys.version())
+	}
+	for _, old := range keys.History {
+		if matchSecret(secretPath, old, params, regex) {
+			versions = append(versions, old.version())
+		}
+	}
+	return versions
+}
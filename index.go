@@ -0,0 +1,330 @@
+package main
+
+import (
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// trigramIndex maps every trigram of a secret's lowercased SearchString to the
+// sorted list of secrets containing it, in the style of Google Code Search.
+// Queries use it to narrow the candidate set; every candidate is still
+// verified by the real matcher, so the index only has to be a superset.
+type trigramIndex struct {
+	paths    []string
+	postings map[uint32][]uint32
+	keys     []keyUsage // key vocabulary for suggestions and /suggest
+}
+
+func trigramOf(s string, i int) uint32 {
+	return uint32(s[i])<<16 | uint32(s[i+1])<<8 | uint32(s[i+2])
+}
+
+// buildTrigramIndex runs at the end of rebuildCache; the result is read-only.
+func buildTrigramIndex(data map[string]*SecretKeys) *trigramIndex {
+	idx := &trigramIndex{
+		paths:    make([]string, 0, len(data)),
+		postings: make(map[uint32][]uint32),
+	}
+	for secretPath := range data {
+		idx.paths = append(idx.paths, secretPath)
+	}
+	sort.Strings(idx.paths)
+
+	for docID, secretPath := range idx.paths {
+		id := uint32(docID)
+		for _, s := range data[secretPath].searchStrings() {
+			for i := 0; i+3 <= len(s); i++ {
+				t := trigramOf(s, i)
+				list := idx.postings[t]
+				// Documents are visited in order, so a repeat can only be at the end.
+				if n := len(list); n > 0 && list[n-1] == id {
+					continue
+				}
+				idx.postings[t] = append(list, id)
+			}
+		}
+	}
+	idx.keys = buildKeyVocabulary(data)
+	return idx
+}
+
+func (idx *trigramIndex) keyVocabulary() []keyUsage {
+	if idx == nil {
+		return nil
+	}
+	return idx.keys
+}
+
+func (idx *trigramIndex) sizeBytes() uint64 {
+	if idx == nil {
+		return 0
+	}
+	size := uint64(sliceHeaderSize + len(idx.paths)*stringHeaderSize)
+	for _, list := range idx.postings {
+		size += mapEntryOverhead + sliceHeaderSize + uint64(cap(list))*4
+	}
+	for _, ku := range idx.keys {
+		size += uint64(stringHeaderSize + len(ku.Key) + 8)
+	}
+	return size
+}
+
+const (
+	trigramAll  = iota // no restriction, every secret is a candidate
+	trigramNone        // nothing can match
+	trigramAnd
+	trigramOr
+)
+
+// trigramQuery is a boolean expression over trigrams.
+type trigramQuery struct {
+	op       int
+	trigrams []uint32
+	sub      []*trigramQuery
+}
+
+var trigramQueryAll = &trigramQuery{op: trigramAll}
+
+// literalTrigramQuery requires every trigram of s. Literals shorter than three
+// bytes cannot narrow anything.
+func literalTrigramQuery(s string) *trigramQuery {
+	s = strings.ToLower(s)
+	if len(s) < 3 {
+		return trigramQueryAll
+	}
+	q := &trigramQuery{op: trigramAnd}
+	seen := make(map[uint32]bool)
+	for i := 0; i+3 <= len(s); i++ {
+		t := trigramOf(s, i)
+		if !seen[t] {
+			seen[t] = true
+			q.trigrams = append(q.trigrams, t)
+		}
+	}
+	return q
+}
+
+func andTrigramQueries(qs ...*trigramQuery) *trigramQuery {
+	out := &trigramQuery{op: trigramAnd}
+	for _, q := range qs {
+		switch q.op {
+		case trigramAll:
+			continue
+		case trigramNone:
+			return q
+		}
+		out.sub = append(out.sub, q)
+	}
+	if len(out.sub) == 0 {
+		return trigramQueryAll
+	}
+	if len(out.sub) == 1 {
+		return out.sub[0]
+	}
+	return out
+}
+
+func orTrigramQueries(qs ...*trigramQuery) *trigramQuery {
+	out := &trigramQuery{op: trigramOr}
+	for _, q := range qs {
+		switch q.op {
+		case trigramAll:
+			return q
+		case trigramNone:
+			continue
+		}
+		out.sub = append(out.sub, q)
+	}
+	if len(out.sub) == 0 {
+		return &trigramQuery{op: trigramNone}
+	}
+	if len(out.sub) == 1 {
+		return out.sub[0]
+	}
+	return out
+}
+
+// regexpTrigramQuery derives the literals any match of pattern must contain.
+// Anything it cannot reason about becomes trigramAll, which is always safe.
+func regexpTrigramQuery(pattern string) *trigramQuery {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return trigramQueryAll
+	}
+	return regexpNodeTrigramQuery(re.Simplify())
+}
+
+func regexpNodeTrigramQuery(re *syntax.Regexp) *trigramQuery {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalTrigramQuery(string(re.Rune))
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexpNodeTrigramQuery(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return regexpNodeTrigramQuery(re.Sub[0])
+		}
+		return trigramQueryAll
+	case syntax.OpConcat:
+		qs := make([]*trigramQuery, 0, len(re.Sub))
+		for _, sub := range re.Sub {
+			qs = append(qs, regexpNodeTrigramQuery(sub))
+		}
+		return andTrigramQueries(qs...)
+	case syntax.OpAlternate:
+		qs := make([]*trigramQuery, 0, len(re.Sub))
+		for _, sub := range re.Sub {
+			qs = append(qs, regexpNodeTrigramQuery(sub))
+		}
+		return orTrigramQueries(qs...)
+	case syntax.OpNoMatch:
+		return &trigramQuery{op: trigramNone}
+	default:
+		return trigramQueryAll
+	}
+}
+
+// globTrigramQuery requires the literal runs between wildcards.
+func globTrigramQuery(glob string) *trigramQuery {
+	parts := strings.FieldsFunc(glob, func(r rune) bool { return r == '*' || r == '?' })
+	qs := make([]*trigramQuery, 0, len(parts))
+	for _, part := range parts {
+		qs = append(qs, literalTrigramQuery(part))
+	}
+	return andTrigramQueries(qs...)
+}
+
+func queryExprTrigramQuery(expr queryExpr) *trigramQuery {
+	switch q := expr.(type) {
+	case *queryAnd:
+		return andTrigramQueries(queryExprTrigramQuery(q.left), queryExprTrigramQuery(q.right))
+	case *queryOr:
+		return orTrigramQueries(queryExprTrigramQuery(q.left), queryExprTrigramQuery(q.right))
+	case *queryTerm:
+		switch {
+		case q.fuzzy > 0:
+			// A misspelling shares no guaranteed trigrams with what it matches.
+			return trigramQueryAll
+		case q.glob:
+			return globTrigramQuery(q.value)
+		case q.regex != nil:
+			return regexpTrigramQuery(q.regex.String())
+		case q.tokens != nil:
+			return orTrigramQueries(literalTrigramQuery(q.value), q.tokens.trigramQuery())
+		default:
+			return literalTrigramQuery(q.value)
+		}
+	}
+	// NOT cannot narrow the candidate set.
+	return trigramQueryAll
+}
+
+// searchTrigramQuery plans the index lookup for the content part of a search.
+func searchTrigramQuery(params *SearchParams) *trigramQuery {
+	switch {
+	case params.QueryExpr != nil:
+		return queryExprTrigramQuery(params.QueryExpr)
+	case params.Term != "" && params.Fuzzy > 0:
+		return trigramQueryAll
+	case params.Term != "" && params.termTokens != nil:
+		return orTrigramQueries(literalTrigramQuery(params.Term), params.termTokens.trigramQuery())
+	case params.Term != "":
+		return literalTrigramQuery(params.Term)
+	case params.Regexp != "":
+		return regexpTrigramQuery(params.Regexp)
+	}
+	return trigramQueryAll
+}
+
+// candidates returns the sorted doc IDs that may satisfy q, or all=true when
+// the query cannot narrow the set.
+func (idx *trigramIndex) candidates(q *trigramQuery) (ids []uint32, all bool) {
+	switch q.op {
+	case trigramAll:
+		return nil, true
+	case trigramNone:
+		return []uint32{}, false
+	case trigramAnd:
+		var result []uint32
+		first := true
+		for _, t := range q.trigrams {
+			list := idx.postings[t]
+			if first {
+				result, first = list, false
+			} else {
+				result = intersectPostings(result, list)
+			}
+			if len(result) == 0 {
+				return []uint32{}, false
+			}
+		}
+		for _, sub := range q.sub {
+			ids, all := idx.candidates(sub)
+			if all {
+				continue
+			}
+			if first {
+				result, first = ids, false
+			} else {
+				result = intersectPostings(result, ids)
+			}
+			if len(result) == 0 {
+				return []uint32{}, false
+			}
+		}
+		if first {
+			return nil, true
+		}
+		return result, false
+	case trigramOr:
+		var result []uint32
+		for _, sub := range q.sub {
+			ids, all := idx.candidates(sub)
+			if all {
+				return nil, true
+			}
+			result = unionPostings(result, ids)
+		}
+		return result, false
+	}
+	return nil, true
+}
+
+func intersectPostings(a, b []uint32) []uint32 {
+	out := make([]uint32, 0, min(len(a), len(b)))
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func unionPostings(a, b []uint32) []uint32 {
+	out := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
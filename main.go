@@ -12,9 +12,20 @@ import (
 var version = "dev"
 
 func main() {
+	if mcpMode() {
+		runMCP()
+		return
+	}
+
 	logger.Infof("Starting the application version=%s", version)
 
-	http.HandleFunc("/search", searchHandler)
+	http.HandleFunc("/search", withCaller(searchHandler))
+	http.HandleFunc("/suggest", withCaller(suggestHandler))
+	http.HandleFunc("/tree", withCaller(treeHandler))
+	http.HandleFunc("/secrets/", withCaller(secretKeysHandler))
+	http.HandleFunc("/reports/stale", withCaller(staleReportHandler))
+	http.HandleFunc("/reports/deleted", withCaller(deletedReportHandler))
+	http.HandleFunc("/reports/denied", withCaller(deniedReportHandler))
 	http.HandleFunc("/status", statusHandler)
 	http.HandleFunc("/rebuild", rebuildHandler)
 
@@ -59,3 +70,29 @@ func main() {
 	logger.Info("Application has shut down gracefully")
 	closeLogger()
 }
+
+// runMCP serves the Model Context Protocol on stdin/stdout. Stdout carries the
+// protocol, so setupLogger already sent logs to stderr. The cache is built in
+// the background and swapped in only when the build finishes, so until then
+// tools find nothing.
+func runMCP() {
+	logger.Infof("Starting MCP server version=%s", version)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	rebuildWg.Add(1)
+	go func() {
+		defer rebuildWg.Done()
+		if err := rebuildCache(ctx); err != nil {
+			logger.Errorf("Initial cache build failed: %v", err)
+		}
+	}()
+
+	if err := serveMCP(ctx, os.Stdin, os.Stdout); err != nil && err != context.Canceled {
+		logger.Errorf("MCP server stopped: %v", err)
+	}
+
+	logger.Info("MCP server has shut down")
+	closeLogger()
+}
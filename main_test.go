@@ -1,20 +1,29 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/vault/api"
 	"github.com/sirupsen/logrus"
 )
 
@@ -29,6 +38,9 @@ func TestMain(m *testing.M) {
 func restoreCache() {
 	cache.Lock()
 	cache.data = originalCacheData
+	cache.index = nil
+	cache.previous = nil
+	cache.deniedSecrets, cache.deniedFolders = nil, nil
 	cache.Unlock()
 }
 
@@ -47,7 +59,7 @@ func waitForRebuildComplete(t *testing.T, timeout time.Duration) {
 	}
 }
 
-func TestExtractKeysFromValue(t *testing.T) {
+func TestExtractKeysTopLevel(t *testing.T) {
 	logEntry := logrus.NewEntry(logrus.New())
 
 	tests := []struct {
@@ -74,12 +86,23 @@ func TestExtractKeysFromValue(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			keys := extractKeysFromValue(tt.data, logEntry)
+			keys, _, _ := extractKeys(tt.data, nil, logEntry)
 			if !containsAllKeys(keys, tt.expected) {
-				t.Errorf("extractKeysFromValue() = %v, expected to contain %v", keys, tt.expected)
+				t.Errorf("extractKeys() = %v, expected to contain %v", keys, tt.expected)
 			}
 		})
 	}
+
+	t.Run("Top-level keys come first", func(t *testing.T) {
+		data := map[string]interface{}{
+			"config":   `{"host": "db", "port": 5432}`,
+			"password": "secret",
+		}
+		keys, _, _ := extractKeys(data, nil, logEntry)
+		if len(keys) != 4 || !containsAllKeys(keys[:2], []string{"config", "password"}) {
+			t.Errorf("extractKeys() = %v, expected top-level keys first", keys)
+		}
+	})
 }
 
 func TestExtractKeysFromJSON(t *testing.T) {
@@ -114,8 +137,9 @@ func TestExtractKeysFromJSON(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			var keys []string
-			extractKeysFromJSON([]byte(tt.jsonStr), &keys, logEntry, 0)
+			var c keyCollector
+			extractKeysFromJSON([]byte(tt.jsonStr), &c, "", logEntry, 0)
+			keys := c.keys
 			if !containsAllKeys(keys, tt.expected) {
 				t.Errorf("extractKeysFromJSON() = %v, expected to contain %v", keys, tt.expected)
 			}
@@ -153,8 +177,9 @@ func TestExtractKeysFromYAML(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			var keys []string
-			extractKeysFromYAML([]byte(tt.yamlStr), &keys, logEntry, 0)
+			var c keyCollector
+			extractKeysFromYAML([]byte(tt.yamlStr), &c, "", logEntry, 0)
+			keys := c.keys
 			if !containsAllKeys(keys, tt.expected) {
 				t.Errorf("extractKeysFromYAML() = %v, expected to contain %v", keys, tt.expected)
 			}
@@ -199,8 +224,9 @@ func TestExtractNestedKeys(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			var keys []string
-			extractNestedKeys(tt.value, &keys, logEntry, 0)
+			var c keyCollector
+			extractNestedKeys(tt.value, &c, "", logEntry, 0)
+			keys := c.keys
 			if !containsAllKeys(keys, tt.expected) {
 				t.Errorf("extractNestedKeys() = %v, expected to contain %v", keys, tt.expected)
 			}
@@ -208,6 +234,49 @@ func TestExtractNestedKeys(t *testing.T) {
 	}
 }
 
+func TestExtractKeyPaths(t *testing.T) {
+	logEntry := logrus.NewEntry(logrus.New())
+	data := map[string]interface{}{
+		"config":   `{"host": "db", "pool": {"size": 5}}`,
+		"clusters": `[{"endpoint": "a"}, {"endpoint": "b"}]`,
+		"redis":    "host: cache\nport: 6379\n",
+		"plain":    "value",
+		"inline":   map[string]interface{}{"tags": []interface{}{map[string]interface{}{"name": "x"}}},
+	}
+
+	keys, paths, _ := extractKeys(data, nil, logEntry)
+	if len(keys) != len(paths) {
+		t.Fatalf("extractKeys() returned %d keys and %d paths", len(keys), len(paths))
+	}
+	got := make(map[string]string)
+	for i, p := range paths {
+		got[p] = keys[i]
+	}
+	expected := map[string]string{
+		"config":               "config",
+		"config.host":          "host",
+		"config.pool":          "pool",
+		"config.pool.size":     "size",
+		"clusters[0].endpoint": "endpoint",
+		"clusters[1].endpoint": "endpoint",
+		"redis.host":           "host",
+		"redis.port":           "port",
+		"plain":                "plain",
+		"inline.tags":          "tags",
+		"inline.tags[0].name":  "name",
+	}
+	for p, key := range expected {
+		if got[p] != key {
+			t.Errorf("path %q = key %q, expected %q (all: %v)", p, got[p], key, paths)
+		}
+	}
+
+	dotted := dottedKeyPaths(keys, paths)
+	if containsString(dotted, "config") || !containsString(dotted, "config.host") {
+		t.Errorf("dottedKeyPaths() = %v, expected nested paths only", dotted)
+	}
+}
+
 func TestLooksLikeJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -247,6 +316,320 @@ func TestLooksLikeYAML(t *testing.T) {
 	}
 }
 
+func TestEmbeddedFormats(t *testing.T) {
+	logEntry := logrus.NewEntry(logrus.New())
+
+	tests := []struct {
+		name   string
+		format string
+		value  string
+		paths  map[string]string // path -> key
+	}{
+		{
+			name:   "JSON",
+			format: "json",
+			value:  `{"db": {"host": "x"}}`,
+			paths:  map[string]string{"cfg.db": "db", "cfg.db.host": "host"},
+		},
+		{
+			name:   "YAML",
+			format: "yaml",
+			value:  "db:\n  host: x\n  port: 5432\n",
+			paths:  map[string]string{"cfg.db.host": "host", "cfg.db.port": "port"},
+		},
+		{
+			name:   "base64 JSON",
+			format: "base64-json",
+			value:  base64.StdEncoding.EncodeToString([]byte(`{"username": "u", "password": "p"}`)),
+			paths:  map[string]string{"cfg.username": "username", "cfg.password": "password"},
+		},
+		{
+			name:   "unpadded base64 JSON",
+			format: "base64-json",
+			value:  base64.RawURLEncoding.EncodeToString([]byte(`{"api_key": "k"}`)),
+			paths:  map[string]string{"cfg.api_key": "api_key"},
+		},
+		{
+			name:   ".env",
+			format: "env",
+			value:  "# app\nDB_HOST=db\nexport DB_PASSWORD='p w'\nNOTE=\"line one\nline two\"\nEMPTY=\n",
+			paths:  map[string]string{"cfg.DB_HOST": "DB_HOST", "cfg.DB_PASSWORD": "DB_PASSWORD", "cfg.NOTE": "NOTE", "cfg.EMPTY": "EMPTY"},
+		},
+		{
+			name:   ".env with a JSON value",
+			format: "env",
+			value:  "MODE=prod\nCONFIG={\"token\": \"t\"}\n",
+			paths:  map[string]string{"cfg.CONFIG": "CONFIG", "cfg.CONFIG.token": "token"},
+		},
+		{
+			name:   "properties",
+			format: "properties",
+			value:  "# datasource\nspring.datasource.url = jdbc:postgresql://db/app\nspring.datasource.password=secret\nmail.body=Hello \\\n  world\n",
+			paths:  map[string]string{"cfg.spring.datasource.url": "spring.datasource.url", "cfg.spring.datasource.password": "spring.datasource.password", "cfg.mail.body": "mail.body"},
+		},
+		{
+			name:   "INI",
+			format: "ini",
+			value:  "; main\n[database]\nhost = db.local\nuser: admin\n\n[cache]\nurl = redis://cache\n  ?timeout=5\n",
+			paths:  map[string]string{"cfg.database": "database", "cfg.database.host": "host", "cfg.database.user": "user", "cfg.cache.url": "url"},
+		},
+		{
+			name:   "TOML",
+			format: "toml",
+			value: `title = "app"
+
+[database]
+host = "db" # primary
+ports = [ 5432,
+  5433 ]
+"conn timeout" = 5.5
+pool.size = 10
+auth = { user = "u", token.ttl = 1979-05-27T07:32:00Z }
+
+[[servers]]
+name = "a"
+
+[[servers]]
+name = "b"
+tags = [{ role = "x" }]
+note = """
+multi "line"
+"""
+`,
+			paths: map[string]string{
+				"cfg.title":                   "title",
+				"cfg.database":                "database",
+				"cfg.database.host":           "host",
+				"cfg.database.ports":          "ports",
+				"cfg.database.conn timeout":   "conn timeout",
+				"cfg.database.pool.size":      "size",
+				"cfg.database.auth.user":      "user",
+				"cfg.database.auth.token.ttl": "ttl",
+				"cfg.servers":                 "servers",
+				"cfg.servers[0].name":         "name",
+				"cfg.servers[1].name":         "name",
+				"cfg.servers[1].tags[0].role": "role",
+				"cfg.servers[1].note":         "note",
+			},
+		},
+		{
+			name:   "HCL",
+			format: "hcl",
+			value:  "region = \"eu\"\nresource \"aws_db\" \"main\" {\n  engine = \"postgres\"\n}\nlistener \"tcp\" {\n  address = \"0.0.0.0:8200\"\n}\nlistener \"unix\" {\n  path = \"/run/v.sock\"\n}\n",
+			paths: map[string]string{
+				"cfg.region":                      "region",
+				"cfg.resource.aws_db.main.engine": "engine",
+				"cfg.listener[0].tcp.address":     "address",
+				"cfg.listener[1].unix.path":       "path",
+			},
+		},
+		{
+			name:   "XML",
+			format: "xml",
+			value:  `<?xml version="1.0"?><config xmlns="urn:x"><db port="5432"><host>x</host></db><db><host>y</host></db></config>`,
+			paths:  map[string]string{"cfg.config": "config", "cfg.config.db": "db", "cfg.config.db.port": "port", "cfg.config.db.host": "host"},
+		},
+		{
+			name:   "multi-line XML",
+			format: "xml",
+			value:  "<db>\n  <host>x</host>\n</db>\n",
+			paths:  map[string]string{"cfg.db": "db", "cfg.db.host": "host"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c keyCollector
+			format := extractEmbeddedKeys(tt.value, &c, "cfg", logEntry, 1)
+			if format != tt.format {
+				t.Fatalf("extractEmbeddedKeys() format = %q, expected %q (keys: %v)", format, tt.format, c.paths)
+			}
+			got := make(map[string]string)
+			for i, p := range c.paths {
+				got[p] = c.keys[i]
+			}
+			for p, key := range tt.paths {
+				if got[p] != key {
+					t.Errorf("path %q = key %q, expected %q (all: %v)", p, got[p], key, c.paths)
+				}
+			}
+		})
+	}
+}
+
+func TestEmbeddedFormatsIgnoreSecrets(t *testing.T) {
+	logEntry := logrus.NewEntry(logrus.New())
+
+	values := []string{
+		"hunter2",
+		"P@ss=w0rd!",
+		"key=value",
+		"dGVzdA==",
+		"c2VjcmV0LXBhc3N3b3Jk",
+		"Xk9fQ2Lm8pR4sT7vW1yZ3aB6cD0eF5gH",
+		"eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln",
+		"<secret>",
+		"<b>bold</b> text",
+		"<b>bold</b>",
+		"<p><b>bold</b> and <i>italic</i></p>",
+		"[abc]",
+		"{not json",
+		"user:pass@host",
+		"first line\nsecond line",
+		"a=b\n",
+		"-----BEGIN CERTIFICATE-----\nMIIBszCCAVmgAwIBAgIUdGVzdA==\nYWJjZGVmZ2hpams=\n-----END CERTIFICATE-----\n",
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHx0 user@host",
+	}
+	for _, v := range values {
+		var c keyCollector
+		if format := extractEmbeddedKeys(v, &c, "", logEntry, 1); format != "" || len(c.keys) > 0 {
+			t.Errorf("extractEmbeddedKeys(%q) = %q with keys %v, expected no keys", v, format, c.keys)
+		}
+	}
+}
+
+func TestLoadExtractionConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "extraction.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`max_depth: 4
+max_value_size: 64KiB
+formats:
+  xml: false
+overrides:
+  - path: pki/**
+    enabled: false
+  - path: apps/*/legacy/**
+    max_depth: 1
+    max_value_size: 1000
+    formats: {yaml: false, xml: true}
+`)
+	ec, err := loadExtractionConfig(path)
+	if err != nil {
+		t.Fatalf("loadExtractionConfig() error = %v", err)
+	}
+
+	tests := []struct {
+		path         string
+		enabled      bool
+		maxDepth     int
+		maxValueSize uint64
+		disabled     []string
+	}{
+		{"apps/web/config", true, 4, 64 << 10, []string{"xml"}},
+		{"pki", false, 4, 64 << 10, []string{"xml"}},
+		{"pki/issuers/root", false, 4, 64 << 10, []string{"xml"}},
+		{"pkix/root", true, 4, 64 << 10, []string{"xml"}},
+		{"apps/web/legacy/db", true, 1, 1000, []string{"yaml"}},
+	}
+	for _, tt := range tests {
+		p := ec.policyFor(tt.path)
+		if p.enabled != tt.enabled || p.maxDepth != tt.maxDepth || p.maxValueSize != tt.maxValueSize {
+			t.Errorf("policyFor(%q) = %+v, expected enabled=%v depth=%d size=%d", tt.path, *p, tt.enabled, tt.maxDepth, tt.maxValueSize)
+		}
+		var disabled []string
+		for format, off := range p.disabled {
+			if off {
+				disabled = append(disabled, format)
+			}
+		}
+		if fmt.Sprint(disabled) != fmt.Sprint(tt.disabled) {
+			t.Errorf("policyFor(%q) disabled = %v, expected %v", tt.path, disabled, tt.disabled)
+		}
+	}
+
+	if p := (*extractionConfig)(nil).policyFor("any"); !reflect.DeepEqual(*p, defaultExtractionPolicy) {
+		t.Errorf("nil config policy = %+v, expected the defaults", *p)
+	}
+
+	write("")
+	if ec, err := loadExtractionConfig(path); err != nil || ec.policyFor("a").maxDepth != defaultMaxNestedDepth {
+		t.Errorf("empty config = %v, %v, expected the defaults", ec, err)
+	}
+
+	invalid := map[string]string{
+		"unknown field":   "max_dept: 3\n",
+		"unknown format":  "formats: {jsonc: true}\n",
+		"negative depth":  "max_depth: -1\n",
+		"bad size":        "max_value_size: lots\n",
+		"override path":   "overrides:\n  - enabled: false\n",
+		"override glob":   "overrides:\n  - path: 'pki/{a'\n",
+		"override format": "overrides:\n  - path: pki/**\n    formats: {pem: false}\n",
+	}
+	for name, content := range invalid {
+		write(content)
+		if _, err := loadExtractionConfig(path); err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: loadExtractionConfig() error = %v, expected an error naming the file", name, err)
+		}
+	}
+}
+
+func TestExtractionPolicyLimits(t *testing.T) {
+	logEntry := logrus.NewEntry(logrus.New())
+	data := map[string]interface{}{
+		"config": `{"db": {"host": "x"}}`,
+		"bundle": "a: " + strings.Repeat("x", 100) + "\nb: y\n",
+		"env":    "A=1\nB=2\n",
+	}
+
+	tests := []struct {
+		name     string
+		policy   extractionPolicy
+		expected []string
+		absent   []string
+	}{
+		{
+			name:     "Defaults",
+			policy:   defaultExtractionPolicy,
+			expected: []string{"config.db.host", "bundle.a", "env.A"},
+		},
+		{
+			name:     "Disabled",
+			policy:   extractionPolicy{enabled: false, maxDepth: 10},
+			expected: []string{"config", "bundle", "env"},
+			absent:   []string{"config.db", "bundle.a", "env.A"},
+		},
+		{
+			name:     "Depth",
+			policy:   extractionPolicy{enabled: true, maxDepth: 1},
+			expected: []string{"config.db", "env.A"},
+			absent:   []string{"config.db.host"},
+		},
+		{
+			name:     "Value size",
+			policy:   extractionPolicy{enabled: true, maxDepth: 10, maxValueSize: 50},
+			expected: []string{"config.db.host", "env.A"},
+			absent:   []string{"bundle.a"},
+		},
+		{
+			name:     "Formats",
+			policy:   extractionPolicy{enabled: true, maxDepth: 10, disabled: map[string]bool{"yaml": true, "env": true, "properties": true}},
+			expected: []string{"config.db.host"},
+			absent:   []string{"bundle.a", "env.A"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, paths, _ := extractKeys(data, &tt.policy, logEntry)
+			for _, p := range tt.expected {
+				if !containsString(paths, p) {
+					t.Errorf("extractKeys() paths = %v, expected %q", paths, p)
+				}
+			}
+			for _, p := range tt.absent {
+				if containsString(paths, p) {
+					t.Errorf("extractKeys() paths = %v, expected no %q", paths, p)
+				}
+			}
+		})
+	}
+}
+
 func TestParseSearchParams(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -271,13 +654,13 @@ func TestParseSearchParams(t *testing.T) {
 			name:        "Valid in_path search",
 			url:         "/search?in_path=prod",
 			expectError: false,
-			params:      &SearchParams{InPath: "prod"},
+			params:      &SearchParams{InPaths: []string{"prod"}},
 		},
 		{
 			name:        "Missing all params",
 			url:         "/search",
 			expectError: true,
-			errorMsg:    "at least one of 'term', 'regexp', or 'in_path'",
+			errorMsg:    "at least one of 'term', 'regexp', 'q', 'in_path', 'path_glob', 'meta.<key>' or a time filter",
 		},
 		{
 			name:        "Both term and regexp",
@@ -289,13 +672,43 @@ func TestParseSearchParams(t *testing.T) {
 			name:        "Invalid sort value",
 			url:         "/search?term=pass&sort=invalid",
 			expectError: true,
-			errorMsg:    "'sort' must be 'asc' or 'desc'",
+			errorMsg:    "'sort' must be 'asc', 'desc', 'relevance' or 'updated'",
+		},
+		{
+			name:        "Valid query search",
+			url:         "/search?q=key:password+AND+path:prod/*",
+			expectError: false,
+			params:      &SearchParams{Query: "key:password AND path:prod/*"},
+		},
+		{
+			name:        "Query with term",
+			url:         "/search?q=key:password&term=pass",
+			expectError: true,
+			errorMsg:    "'q' cannot be combined with 'term' or 'regexp'",
+		},
+		{
+			name:        "Query parse error",
+			url:         "/search?q=key:password+AND+(path:prod",
+			expectError: true,
+			errorMsg:    "query parse error at position 28",
+		},
+		{
+			name:        "Valid scope",
+			url:         "/search?regexp=^api_&scope=keys",
+			expectError: false,
+			params:      &SearchParams{Regexp: "^api_", Scope: searchScopeKeys},
+		},
+		{
+			name:        "Invalid scope",
+			url:         "/search?term=pass&scope=values",
+			expectError: true,
+			errorMsg:    "'scope' must be 'path', 'keys' or 'all'",
 		},
 		{
 			name:        "Valid with all options",
 			url:         "/search?term=pass&in_path=prod&sort=asc&show_ui=true",
 			expectError: false,
-			params:      &SearchParams{Term: "pass", InPath: "prod", Sort: "asc", ShowUI: true},
+			params:      &SearchParams{Term: "pass", InPaths: []string{"prod"}, Sort: "asc", ShowUI: true},
 		},
 	}
 
@@ -318,7 +731,8 @@ func TestParseSearchParams(t *testing.T) {
 					return
 				}
 				if params.Term != tt.params.Term || params.Regexp != tt.params.Regexp ||
-					params.InPath != tt.params.InPath || params.Sort != tt.params.Sort ||
+					params.Query != tt.params.Query || params.Scope != tt.params.Scope ||
+					fmt.Sprint(params.InPaths) != fmt.Sprint(tt.params.InPaths) || params.Sort != tt.params.Sort ||
 					params.ShowUI != tt.params.ShowUI {
 					t.Errorf("Params = %v, expected %v", params, tt.params)
 				}
@@ -363,6 +777,62 @@ func TestMatchSecret(t *testing.T) {
 			params:   &SearchParams{Regexp: "^PASS"},
 			expected: false,
 		},
+		{
+			name:     "Term across key boundary - legacy match",
+			path:     "prod/db/credentials",
+			keys:     &SecretKeys{AllKeys: []string{"username", "password"}, SearchString: "prod/db/credentials username password "},
+			params:   &SearchParams{Term: "name pass"},
+			expected: true,
+		},
+		{
+			name:     "Term across key boundary - scoped no match",
+			path:     "prod/db/credentials",
+			keys:     &SecretKeys{AllKeys: []string{"username", "password"}, SearchString: "prod/db/credentials username password "},
+			params:   &SearchParams{Term: "name pass", Scope: searchScopeAll},
+			expected: false,
+		},
+		{
+			name:     "Anchored regexp on key name",
+			path:     "prod/api/keys",
+			keys:     &SecretKeys{AllKeys: []string{"secret_key", "api_key"}, SearchString: "prod/api/keys secret_key api_key "},
+			params:   &SearchParams{Regexp: "^api_", Scope: searchScopeKeys},
+			expected: true,
+		},
+		{
+			name:     "Anchored regexp on key name - legacy no match",
+			path:     "prod/api/keys",
+			keys:     &SecretKeys{AllKeys: []string{"secret_key", "api_key"}, SearchString: "prod/api/keys secret_key api_key "},
+			params:   &SearchParams{Regexp: "^api_"},
+			expected: false,
+		},
+		{
+			name:     "Keys scope ignores path",
+			path:     "prod/password/store",
+			keys:     &SecretKeys{AllKeys: []string{"token"}, SearchString: "prod/password/store token "},
+			params:   &SearchParams{Term: "password", Scope: searchScopeKeys},
+			expected: false,
+		},
+		{
+			name:     "Path scope ignores keys",
+			path:     "prod/db/credentials",
+			keys:     &SecretKeys{AllKeys: []string{"password"}, SearchString: "prod/db/credentials password "},
+			params:   &SearchParams{Term: "password", Scope: searchScopePath},
+			expected: false,
+		},
+		{
+			name:     "Path scope matches path",
+			path:     "prod/DB/credentials",
+			keys:     &SecretKeys{AllKeys: []string{"password"}, SearchString: "prod/db/credentials password "},
+			params:   &SearchParams{Term: "db/cred", Scope: searchScopePath},
+			expected: true,
+		},
+		{
+			name:     "Scoped regexp keeps key case",
+			path:     "prod/aws",
+			keys:     &SecretKeys{AllKeys: []string{"AWS_SECRET"}, SearchString: "prod/aws aws_secret "},
+			params:   &SearchParams{Regexp: "^AWS_", Scope: searchScopeKeys},
+			expected: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -384,6 +854,139 @@ func TestMatchSecret(t *testing.T) {
 	}
 }
 
+func TestParseQuery(t *testing.T) {
+	secrets := map[string]*SecretKeys{
+		"prod/db/credentials": {
+			AllKeys:      []string{"username", "password", "host"},
+			SearchString: "prod/db/credentials username password host ",
+		},
+		"prod/legacy/db": {
+			AllKeys:      []string{"db_password"},
+			SearchString: "prod/legacy/db db_password ",
+		},
+		"prod/api/keys": {
+			AllKeys:      []string{"api_key", "secret_key"},
+			SearchString: "prod/api/keys api_key secret_key ",
+		},
+		"staging/db/config": {
+			AllKeys:      []string{"host", "port", "password"},
+			SearchString: "staging/db/config host port password ",
+		},
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"key:password", []string{"prod/db/credentials", "prod/legacy/db", "staging/db/config"}},
+		{"key:password AND path:prod/*", []string{"prod/db/credentials", "prod/legacy/db"}},
+		{"key:password path:prod/* NOT path:*/legacy/*", []string{"prod/db/credentials"}},
+		{"path:*/db/*", []string{"prod/db/credentials", "staging/db/config"}},
+		{"key:/^api_/ OR key:port", []string{"prod/api/keys", "staging/db/config"}},
+		{"key:/^PASS/i", []string{"prod/db/credentials", "staging/db/config"}},
+		{"(key:host OR key:api_key) AND NOT path:staging", []string{"prod/db/credentials", "prod/api/keys"}},
+		{"key:host OR key:api_key AND path:staging", []string{"prod/db/credentials", "staging/db/config"}},
+		{`"username password"`, []string{"prod/db/credentials"}},
+		{`key:"secret_key"`, []string{"prod/api/keys"}},
+		{"*_key", []string{"prod/api/keys"}},
+		{"KEY:HOST", []string{"prod/db/credentials", "staging/db/config"}},
+		{"NOT db", []string{"prod/api/keys"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := parseQuery(tt.query, "")
+			if err != nil {
+				t.Fatalf("parseQuery(%q) unexpected error: %v", tt.query, err)
+			}
+			var matches []string
+			for path, keys := range secrets {
+				if expr.eval(path, keys) {
+					matches = append(matches, path)
+				}
+			}
+			if len(matches) != len(tt.expected) || !containsAllKeys(matches, tt.expected) {
+				t.Errorf("parseQuery(%q) matched %v, expected %v", tt.query, matches, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseQueryScope(t *testing.T) {
+	keys := &SecretKeys{
+		AllKeys:      []string{"username", "password"},
+		SearchString: "prod/password/db username password ",
+	}
+
+	tests := []struct {
+		query    string
+		scope    string
+		path     string
+		expected bool
+	}{
+		{`"name pass"`, "", "prod/db", true},
+		{`"name pass"`, searchScopeAll, "prod/db", false},
+		{"/^pass/", searchScopeKeys, "prod/db", true},
+		{"/^pass/", "", "prod/db", false},
+		{"password", searchScopePath, "prod/db", false},
+		{"password", searchScopePath, "prod/password/db", true},
+		{"key:user*", searchScopePath, "prod/db", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query+"/"+tt.scope, func(t *testing.T) {
+			expr, err := parseQuery(tt.query, tt.scope)
+			if err != nil {
+				t.Fatalf("parseQuery(%q) unexpected error: %v", tt.query, err)
+			}
+			if got := expr.eval(tt.path, keys); got != tt.expected {
+				t.Errorf("eval(%q, scope=%q, path=%q) = %v, expected %v", tt.query, tt.scope, tt.path, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{"", 1, "empty query"},
+		{"key:password AND", 17, "unexpected end of query"},
+		{"(key:password", 14, "expected ')'"},
+		{"key:password)", 13, "unmatched ')'"},
+		{"owner:payments", 1, "unknown field 'owner'"},
+		{"key: password", 5, "missing value for field 'key'"},
+		{`key:"unterminated`, 5, "unterminated quote"},
+		{"key:/[a-/", 1, "invalid regular expression"},
+		{"key:/abc", 5, "unterminated regular expression"},
+		{"OR key:token", 1, "unexpected operator"},
+		{"NOT", 4, "unexpected end of query"},
+		{`key:"a"b`, 8, "unexpected character after term"},
+		{"~", 1, "'~' must follow a term"},
+		{"key:/pass/~", 11, "'~' cannot be used with a regular expression"},
+		{"key:pass*~", 1, "'~' cannot be used with a glob"},
+		{"pasword~x", 9, "unexpected character after term"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := parseQuery(tt.query, "")
+			if err == nil {
+				t.Fatalf("parseQuery(%q) expected error", tt.query)
+			}
+			qerr, ok := err.(*QueryError)
+			if !ok {
+				t.Fatalf("parseQuery(%q) error type = %T, expected *QueryError", tt.query, err)
+			}
+			if qerr.Pos != tt.pos || !strings.Contains(qerr.Msg, tt.msg) {
+				t.Errorf("parseQuery(%q) = %v, expected position %d and %q", tt.query, qerr, tt.pos, tt.msg)
+			}
+		})
+	}
+}
+
 func TestDetermineMatches(t *testing.T) {
 	contentMatches := []string{"prod/db/creds", "prod/api/keys", "staging/db/config"}
 	pathMatches := []string{"prod/db/creds", "prod/api/keys", "prod/cache"}
@@ -403,13 +1006,13 @@ func TestDetermineMatches(t *testing.T) {
 		},
 		{
 			name:          "Path search only",
-			params:        &SearchParams{InPath: "prod"},
+			params:        &SearchParams{InPaths: []string{"prod"}},
 			expectedCount: 3,
 			expectedIn:    pathMatches,
 		},
 		{
 			name:          "Combined - intersection",
-			params:        &SearchParams{Term: "pass", InPath: "prod"},
+			params:        &SearchParams{Term: "pass", InPaths: []string{"prod"}},
 			expectedCount: 2,
 			expectedIn:    []string{"prod/db/creds", "prod/api/keys"},
 			expectedNotIn: []string{"staging/db/config", "prod/cache"},
@@ -508,6 +1111,16 @@ func TestSearchHandler(t *testing.T) {
 			url:          "/search?regexp=[invalid(",
 			expectStatus: http.StatusBadRequest,
 		},
+		{
+			name:         "Valid query",
+			url:          "/search?q=key:password+NOT+path:staging/*",
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "Invalid query",
+			url:          "/search?q=key:password+AND",
+			expectStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
@@ -616,34 +1229,489 @@ func TestSearchHandlerShowUI(t *testing.T) {
 	}
 }
 
-func TestRebuildHandler(t *testing.T) {
+func TestSearchHandlerDetails(t *testing.T) {
 	testMutex.Lock()
 	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
 
-	tests := []struct {
-		name         string
-		method       string
-		body         string
-		expectStatus int
-		waitForAsync bool
-	}{
-		{
-			name:         "Wrong method",
-			method:       http.MethodGet,
-			body:         ``,
-			expectStatus: http.StatusMethodNotAllowed,
-			waitForAsync: false,
-		},
-		{
-			name:         "Invalid JSON",
-			method:       http.MethodPost,
-			body:         `{invalid}`,
-			expectStatus: http.StatusBadRequest,
-			waitForAsync: false,
-		},
-		{
-			name:         "Wrong rebuild value",
-			method:       http.MethodPost,
+	cache.Lock()
+	cache.data["prod/app/config"] = &SecretKeys{
+		AllKeys:      []string{"password", "config", "db_password"},
+		SearchString: "prod/app/config password config db_password ",
+		NestedKeys:   1,
+	}
+	cache.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, "/search?term=password&in_path=prod&details=true&show_ui=true", nil)
+	rec := httptest.NewRecorder()
+	searchHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Status = %d, expected %d", rec.Code, http.StatusOK)
+	}
+
+	var response struct {
+		Matches []MatchDetail `json:"matches"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(response.Matches) != 2 {
+		t.Fatalf("Expected 2 matches, got %+v", response.Matches)
+	}
+
+	detail := response.Matches[0]
+	if detail.Path != "prod/app/config" || detail.Mount != cfg.VaultMountPoint {
+		t.Errorf("Unexpected path/mount: %+v", detail)
+	}
+	if !strings.HasSuffix(detail.URL, "/ui/vault/secrets/"+cfg.VaultMountPoint+"/show/prod/app/config") {
+		t.Errorf("Unexpected url: %s", detail.URL)
+	}
+	if len(detail.MatchedKeys) != 2 {
+		t.Fatalf("Expected 2 matched keys, got %+v", detail.MatchedKeys)
+	}
+	if detail.MatchedKeys[0].Key != "password" || detail.MatchedKeys[0].Source != matchSourceKey ||
+		detail.MatchedKeys[0].Offsets[0] != [2]int{0, 8} {
+		t.Errorf("Unexpected top-level key match: %+v", detail.MatchedKeys[0])
+	}
+	if detail.MatchedKeys[1].Key != "db_password" || detail.MatchedKeys[1].Source != matchSourceNestedKey ||
+		detail.MatchedKeys[1].Offsets[0] != [2]int{3, 11} {
+		t.Errorf("Unexpected nested key match: %+v", detail.MatchedKeys[1])
+	}
+	if len(detail.PathOffsets) != 1 || detail.PathOffsets[0] != [2]int{0, 4} {
+		t.Errorf("Expected in_path highlight on prod, got %v", detail.PathOffsets)
+	}
+	for _, source := range []string{matchSourcePath, matchSourceKey, matchSourceNestedKey} {
+		if !containsString(detail.MatchedIn, source) {
+			t.Errorf("Expected %s in matched_in %v", source, detail.MatchedIn)
+		}
+	}
+	if strings.Contains(rec.Body.String(), "secret123") {
+		t.Error("Response must never contain values")
+	}
+}
+
+func TestSearchHighlighters(t *testing.T) {
+	keys := &SecretKeys{AllKeys: []string{"API_KEY", "token"}, SearchString: "prod/api/keys api_key token "}
+
+	tests := []struct {
+		name        string
+		url         string
+		pathOffsets [][2]int
+		keyMatches  []string
+	}{
+		{"term highlights path and keys", "/search?term=api", [][2]int{{5, 8}}, []string{"API_KEY"}},
+		{"keys scope skips path", "/search?term=api&scope=keys", nil, []string{"API_KEY"}},
+		{"legacy regexp matches lowercased", "/search?regexp=^api_", nil, []string{"API_KEY"}},
+		{"query ignores negated terms", "/search?q=key:token+NOT+path:api", nil, []string{"token"}},
+		{"query path field", "/search?q=path:keys+key:/^tok/", [][2]int{{9, 13}}, []string{"token"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := parseSearchParams(httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var regex *regexp.Regexp
+			if params.Regexp != "" {
+				regex = regexp.MustCompile(params.Regexp)
+			}
+			detail := buildMatchDetail("prod/api/keys", keys, params, searchHighlighters(params, regex))
+			if fmt.Sprint(detail.PathOffsets) != fmt.Sprint(tt.pathOffsets) {
+				t.Errorf("path offsets = %v, expected %v", detail.PathOffsets, tt.pathOffsets)
+			}
+			var matched []string
+			for _, km := range detail.MatchedKeys {
+				matched = append(matched, km.Key)
+			}
+			if fmt.Sprint(matched) != fmt.Sprint(tt.keyMatches) {
+				t.Errorf("matched keys = %v, expected %v", matched, tt.keyMatches)
+			}
+		})
+	}
+}
+
+func TestMergeOffsets(t *testing.T) {
+	got := mergeOffsets([][2]int{{6, 9}, {0, 3}, {2, 5}, {9, 10}})
+	expected := [][2]int{{0, 5}, {6, 10}}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("mergeOffsets() = %v, expected %v", got, expected)
+	}
+}
+
+func TestRelevanceRanking(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+
+	data := map[string]*SecretKeys{
+		"password":                 {AllKeys: []string{"user"}},
+		"apps/web/config":          {AllKeys: []string{"db_password"}},
+		"apps/api/config":          {AllKeys: []string{"password"}},
+		"apps/api/deep/nested/app": {AllKeys: []string{"password"}},
+		"apps/worker/config":       {AllKeys: []string{"settings", "password"}, NestedKeys: 1},
+		"apps/jobs/config":         {AllKeys: []string{"settings", "db_password"}, NestedKeys: 1},
+		"prod/password":            {AllKeys: []string{"user"}},
+	}
+	for secretPath, keys := range data {
+		keys.SearchString = buildSearchString(secretPath, keys.AllKeys)
+	}
+	cache.Lock()
+	cache.data = data
+	cache.Unlock()
+
+	status, response := searchJSON(t, "/search?term=password&sort=relevance&details=true")
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %v", status, response)
+	}
+	expected := []string{
+		"apps/api/config",          // exact top-level key, shallow
+		"apps/api/deep/nested/app", // exact top-level key, deep
+		"apps/worker/config",       // exact nested key
+		"apps/web/config",          // key substring
+		"apps/jobs/config",         // nested key substring
+		"password",                 // path only, shallow
+		"prod/password",            // path only, deep
+	}
+	matches := response["matches"].([]interface{})
+	var got []string
+	var prev float64
+	for i, m := range matches {
+		detail := m.(map[string]interface{})
+		got = append(got, detail["path"].(string))
+		score := detail["score"].(float64)
+		if i > 0 && score >= prev {
+			t.Errorf("score of %s = %v, expected less than %v", detail["path"], score, prev)
+		}
+		prev = score
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("relevance order = %v, expected %v", got, expected)
+	}
+}
+
+func TestRelevanceScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		detail   MatchDetail
+		expected float64
+	}{
+		{
+			name:     "exact key",
+			detail:   MatchDetail{Path: "a/b", MatchedKeys: []KeyMatch{{Key: "token", Source: matchSourceKey, Offsets: [][2]int{{0, 5}}}}},
+			expected: scoreKeyHit + scoreExactKey + 0.5,
+		},
+		{
+			name:     "nested substring key",
+			detail:   MatchDetail{Path: "a", MatchedKeys: []KeyMatch{{Key: "api_token", Source: matchSourceNestedKey, Offsets: [][2]int{{4, 9}}}}},
+			expected: scoreKeyHit + scoreSubstringKey - scoreNestedPenalty + 1,
+		},
+		{
+			name:     "path segment",
+			detail:   MatchDetail{Path: "prod/db", PathOffsets: [][2]int{{0, 4}}},
+			expected: scorePathSegment + 0.5,
+		},
+		{
+			name:     "partial path segment",
+			detail:   MatchDetail{Path: "production", PathOffsets: [][2]int{{0, 4}}},
+			expected: scorePathSubstring + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relevanceScore(&tt.detail); got != tt.expected {
+				t.Errorf("relevanceScore() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	t.Run("nested key beats path only", func(t *testing.T) {
+		path := MatchDetail{Path: "prod/password", PathOffsets: [][2]int{{5, 13}}}
+		nested := MatchDetail{Path: "a/b/c/d/e", MatchedKeys: []KeyMatch{{Key: "db_password", Source: matchSourceNestedKey, Offsets: [][2]int{{3, 11}}, Fuzzy: true}}}
+		if p, n := relevanceScore(&path), relevanceScore(&nested); n <= p {
+			t.Errorf("nested fuzzy key hit scored %v, path-only hit %v", n, p)
+		}
+	})
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		max      int
+		expected int
+	}{
+		{"password", "password", 2, 0},
+		{"pasword", "password", 2, 1},
+		{"secert_key", "secret_key", 2, 1}, // transposition
+		{"passwrod", "password", 1, 1},
+		{"pwd", "password", 2, 3},
+		{"token", "tokne", 2, 1},
+		{"host", "port", 2, 2},
+		{"host", "port", 1, 2},
+		{"ключ", "клюк", 1, 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b, tt.max); got != tt.expected {
+			t.Errorf("editDistance(%q, %q, %d) = %d, expected %d", tt.a, tt.b, tt.max, got, tt.expected)
+		}
+	}
+
+	if d := fuzzyDistance("ab", 2); d != 0 {
+		t.Errorf("fuzzyDistance for a 2-letter term = %d, expected 0", d)
+	}
+	if d := fuzzyDistance("host", 2); d != 1 {
+		t.Errorf("fuzzyDistance for a 4-letter term = %d, expected 1", d)
+	}
+	if got := fuzzySegments("prod/databse/creds", "database", 2); fmt.Sprint(got) != "[[5 12]]" {
+		t.Errorf("fuzzySegments() = %v, expected [[5 12]]", got)
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
+
+	tests := []struct {
+		name     string
+		url      string
+		expected []string
+	}{
+		{"no fuzzy", "/search?term=pasword", nil},
+		{"fuzzy term", "/search?term=pasword&fuzzy=true", []string{"prod/db/credentials", "staging/db/config"}},
+		{"fuzzy transposition", "/search?term=secert_key&fuzzy=true", []string{"prod/api/keys"}},
+		{"fuzzy path segment", "/search?term=stagign&fuzzy=true&scope=path", []string{"staging/db/config"}},
+		{"fuzzy keys scope ignores path", "/search?term=stagign&fuzzy=true&scope=keys", nil},
+		{"query operator", "/search?q=" + url.QueryEscape("key:pasword~ path:prod"), []string{"prod/db/credentials"}},
+		{"query explicit distance", "/search?q=" + url.QueryEscape("key:passwrd~1"), []string{"prod/db/credentials", "staging/db/config"}},
+		{"fuzzy applies to query terms", "/search?fuzzy=true&q=" + url.QueryEscape("key:pasword NOT path:prod"), []string{"staging/db/config"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := searchJSON(t, tt.url)
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %v", status, response)
+			}
+			var got []string
+			for _, m := range response["matches"].([]interface{}) {
+				got = append(got, m.(string))
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("matches = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	t.Run("did you mean", func(t *testing.T) {
+		_, response := searchJSON(t, "/search?term=pasword")
+		suggestions, ok := response["did_you_mean"].([]interface{})
+		if !ok || len(suggestions) == 0 || suggestions[0] != "password" {
+			t.Errorf("did_you_mean = %v, expected password first", response["did_you_mean"])
+		}
+
+		_, response = searchJSON(t, "/search?term=password")
+		if _, ok := response["did_you_mean"]; ok {
+			t.Errorf("did_you_mean should be omitted when there are matches")
+		}
+	})
+
+	t.Run("details mark fuzzy keys", func(t *testing.T) {
+		_, response := searchJSON(t, "/search?term=pasword&fuzzy=true&details=true&in_path=prod")
+		matches := response["matches"].([]interface{})
+		if len(matches) != 1 {
+			t.Fatalf("Expected 1 match, got %v", matches)
+		}
+		keys := matches[0].(map[string]interface{})["matched_keys"].([]interface{})
+		km := keys[0].(map[string]interface{})
+		if km["key"] != "password" || km["fuzzy"] != true {
+			t.Errorf("matched key = %v, expected fuzzy match on password", km)
+		}
+	})
+
+	t.Run("fuzzy with regexp", func(t *testing.T) {
+		status, _ := searchJSON(t, "/search?regexp=pass&fuzzy=true")
+		if status != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", status)
+		}
+	})
+}
+
+func searchJSON(t *testing.T, url string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	rec := httptest.NewRecorder()
+	searchHandler(rec, req)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	return rec.Code, response
+}
+
+// swapTestCache mimics the generation swap at the end of rebuildCache.
+func swapTestCache(data map[string]*SecretKeys) {
+	cache.Lock()
+	cache.retireSnapshotLocked()
+	cache.data = data
+	cache.generation++
+	cache.buildEndTime = time.Now()
+	cache.Unlock()
+}
+
+func TestSearchHandlerPagination(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
+
+	status, first := searchJSON(t, "/search?term=s&limit=2")
+	if status != http.StatusOK {
+		t.Fatalf("Status = %d, expected %d", status, http.StatusOK)
+	}
+	for _, field := range []string{"total", "took_ms", "generation", "cache_age", "offset", "limit"} {
+		if _, ok := first[field]; !ok {
+			t.Errorf("Missing envelope field %q in %v", field, first)
+		}
+	}
+	if first["total"].(float64) != 3 {
+		t.Errorf("total = %v, expected 3", first["total"])
+	}
+	page1 := first["matches"].([]interface{})
+	if len(page1) != 2 || page1[0] != "prod/api/keys" || page1[1] != "prod/db/credentials" {
+		t.Fatalf("First page = %v", page1)
+	}
+	cursor, ok := first["next_cursor"].(string)
+	if !ok || cursor == "" {
+		t.Fatalf("Expected next_cursor in %v", first)
+	}
+
+	// A rebuild between pages must not shift the second page.
+	swapTestCache(map[string]*SecretKeys{
+		"aaa/new": {AllKeys: []string{"secret"}, SearchString: "aaa/new secret "},
+	})
+
+	status, second := searchJSON(t, "/search?term=s&limit=2&cursor="+cursor)
+	if status != http.StatusOK {
+		t.Fatalf("Status = %d, expected %d: %v", status, http.StatusOK, second)
+	}
+	page2 := second["matches"].([]interface{})
+	if len(page2) != 1 || page2[0] != "staging/db/config" {
+		t.Errorf("Second page = %v, expected [staging/db/config]", page2)
+	}
+	if second["generation"] != first["generation"] {
+		t.Errorf("Second page generation = %v, expected pinned %v", second["generation"], first["generation"])
+	}
+	if _, ok := second["next_cursor"]; ok {
+		t.Error("Did not expect next_cursor on the last page")
+	}
+
+	// Fresh searches see the new generation.
+	if _, fresh := searchJSON(t, "/search?term=s"); fresh["total"].(float64) != 1 {
+		t.Errorf("Fresh search total = %v, expected 1", fresh["total"])
+	}
+
+	t.Run("cursor for another query", func(t *testing.T) {
+		status, resp := searchJSON(t, "/search?term=db&limit=2&cursor="+cursor)
+		if status != http.StatusBadRequest {
+			t.Errorf("Status = %d, expected %d: %v", status, http.StatusBadRequest, resp)
+		}
+	})
+
+	t.Run("cursor after two rebuilds", func(t *testing.T) {
+		swapTestCache(map[string]*SecretKeys{})
+		status, resp := searchJSON(t, "/search?term=s&limit=2&cursor="+cursor)
+		if status != http.StatusGone {
+			t.Errorf("Status = %d, expected %d: %v", status, http.StatusGone, resp)
+		}
+	})
+
+	t.Run("generation without cursors is not kept", func(t *testing.T) {
+		searchJSON(t, "/search?term=s")
+		searchJSON(t, "/search?term=s&limit=5")
+		swapTestCache(map[string]*SecretKeys{})
+		cache.RLock()
+		previous := cache.previous
+		cache.RUnlock()
+		if previous != nil {
+			t.Errorf("Generation %d was kept although no next_cursor was issued for it", previous.generation)
+		}
+	})
+}
+
+func TestParsePaging(t *testing.T) {
+	tests := []struct {
+		url      string
+		errorMsg string
+		offset   int
+		limit    int
+	}{
+		{url: "/search?term=a&limit=10&offset=20", offset: 20, limit: 10},
+		{url: "/search?term=a&limit=0", errorMsg: "'limit' must be a positive integer"},
+		{url: "/search?term=a&offset=-1", errorMsg: "'offset' must be a non-negative integer"},
+		{url: "/search?term=a&offset=1&cursor=abc", errorMsg: "mutually exclusive"},
+		{url: "/search?term=a&cursor=!!!", errorMsg: "invalid 'cursor'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			params, err := parseSearchParams(httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if tt.errorMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorMsg) {
+					t.Errorf("Error = %v, expected to contain %q", err, tt.errorMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if params.Offset != tt.offset || params.Limit != tt.limit {
+				t.Errorf("offset/limit = %d/%d, expected %d/%d", params.Offset, params.Limit, tt.offset, tt.limit)
+			}
+		})
+	}
+
+	t.Run("cursor round trip", func(t *testing.T) {
+		c := pageCursor{generation: 7, offset: 40, fingerprint: 0xdeadbeef}
+		decoded, err := decodeCursor(encodeCursor(c))
+		if err != nil || decoded != c {
+			t.Errorf("decodeCursor(encodeCursor(%v)) = %v, %v", c, decoded, err)
+		}
+	})
+}
+
+func TestRebuildHandler(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		expectStatus int
+		waitForAsync bool
+	}{
+		{
+			name:         "Wrong method",
+			method:       http.MethodGet,
+			body:         ``,
+			expectStatus: http.StatusMethodNotAllowed,
+			waitForAsync: false,
+		},
+		{
+			name:         "Invalid JSON",
+			method:       http.MethodPost,
+			body:         `{invalid}`,
+			expectStatus: http.StatusBadRequest,
+			waitForAsync: false,
+		},
+		{
+			name:         "Wrong rebuild value",
+			method:       http.MethodPost,
 			body:         `{"rebuild": "false"}`,
 			expectStatus: http.StatusBadRequest,
 			waitForAsync: false,
@@ -744,7 +1812,7 @@ func TestPerformSearchTimeout(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Millisecond)
 	defer cancel()
-	time.Sleep(2 * time.Millisecond) // ensure context expires before search starts
+	<-ctx.Done() // ensure context expires before search starts
 
 	params := &SearchParams{Term: "test"}
 	_, err := performSearch(params, nil, ctx)
@@ -772,12 +1840,12 @@ func TestPerformSearch(t *testing.T) {
 		},
 		{
 			name:          "Search by path",
-			params:        &SearchParams{InPath: "prod"},
+			params:        &SearchParams{InPaths: []string{"prod"}},
 			expectedCount: 2,
 		},
 		{
 			name:          "Combined search",
-			params:        &SearchParams{Term: "api", InPath: "prod"},
+			params:        &SearchParams{Term: "api", InPaths: []string{"prod"}},
 			expectedCount: 1,
 		},
 	}
@@ -940,24 +2008,1229 @@ func TestPerformSearchRegexp(t *testing.T) {
 	}
 }
 
-func setupTestCache() {
-	atomic.StoreInt32(&cache.isRebuilding, 0)
-	cache.Lock()
-	cache.data = map[string]*SecretKeys{
-		"prod/db/credentials": {
-			AllKeys:      []string{"username", "password", "host"},
-			SearchString: "prod/db/credentials username password host ",
-		},
-		"prod/api/keys": {
-			AllKeys:      []string{"api_key", "secret_key"},
-			SearchString: "prod/api/keys api_key secret_key ",
-		},
-		"staging/db/config": {
-			AllKeys:      []string{"host", "port", "password"},
-			SearchString: "staging/db/config host port password ",
-		},
+type mcpTestClient struct {
+	t      *testing.T
+	in     *io.PipeWriter
+	out    *bufio.Scanner
+	nextID int
+}
+
+func startMCPTestServer(t *testing.T) *mcpTestClient {
+	t.Helper()
+	clientToServerR, clientToServerW := io.Pipe()
+	serverToClientR, serverToClientW := io.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = serveMCP(context.Background(), clientToServerR, serverToClientW)
+		serverToClientW.Close()
+	}()
+	t.Cleanup(func() {
+		clientToServerW.Close()
+		<-done
+	})
+
+	return &mcpTestClient{t: t, in: clientToServerW, out: bufio.NewScanner(serverToClientR)}
+}
+
+func (c *mcpTestClient) send(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.in, line+"\n"); err != nil {
+		c.t.Fatalf("Failed to write MCP message: %v", err)
 	}
-	cache.Unlock()
+}
+
+func (c *mcpTestClient) call(method string, params interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.nextID++
+	msg, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": c.nextID, "method": method, "params": params})
+	if err != nil {
+		c.t.Fatalf("Failed to encode MCP request: %v", err)
+	}
+	c.send(string(msg))
+	return c.read()
+}
+
+func (c *mcpTestClient) read() map[string]interface{} {
+	c.t.Helper()
+	if !c.out.Scan() {
+		c.t.Fatalf("MCP server closed the stream: %v", c.out.Err())
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(c.out.Bytes(), &resp); err != nil {
+		c.t.Fatalf("Failed to parse MCP response %q: %v", c.out.Text(), err)
+	}
+	return resp
+}
+
+// toolText calls an MCP tool and decodes the JSON text payload of the result.
+func (c *mcpTestClient) toolText(name string, args map[string]interface{}) (map[string]interface{}, bool) {
+	c.t.Helper()
+	resp := c.call("tools/call", map[string]interface{}{"name": name, "arguments": args})
+	result, ok := resp["result"].(map[string]interface{})
+	if !ok {
+		c.t.Fatalf("tools/call %s returned no result: %v", name, resp)
+	}
+	isError, _ := result["isError"].(bool)
+	text := result["content"].([]interface{})[0].(map[string]interface{})["text"].(string)
+	if isError {
+		return map[string]interface{}{"error": text}, true
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &payload); err != nil {
+		c.t.Fatalf("Failed to parse tool payload %q: %v", text, err)
+	}
+	return payload, false
+}
+
+func TestSetupLoggerMCPMode(t *testing.T) {
+	prevArgs, prevStdout, prevPath, prevFile := os.Args, os.Stdout, cfg.LogFilePath, logFile
+	defer func() { os.Args, os.Stdout, cfg.LogFilePath, logFile = prevArgs, prevStdout, prevPath, prevFile }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	os.Args = []string{"vault-search", "mcp"}
+	cfg.LogFilePath = filepath.Join(t.TempDir(), "vault_search.log")
+
+	log := setupLogger()
+	log.Info("Synonyms loaded")
+	logFile.Close()
+	w.Close()
+
+	if out, _ := io.ReadAll(r); len(out) > 0 {
+		t.Errorf("MCP mode logged to stdout: %s", out)
+	}
+	if written, _ := os.ReadFile(cfg.LogFilePath); !bytes.Contains(written, []byte("Synonyms loaded")) {
+		t.Errorf("log file = %q, expected the log line", written)
+	}
+}
+
+func TestMCPInitializeAndListTools(t *testing.T) {
+	client := startMCPTestServer(t)
+
+	resp := client.call("initialize", map[string]interface{}{
+		"protocolVersion": "2024-11-05",
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]interface{}{"name": "test", "version": "1"},
+	})
+	result := resp["result"].(map[string]interface{})
+	if result["protocolVersion"] != "2024-11-05" {
+		t.Errorf("protocolVersion = %v, expected 2024-11-05", result["protocolVersion"])
+	}
+	if _, ok := result["capabilities"].(map[string]interface{})["tools"]; !ok {
+		t.Error("Expected tools capability")
+	}
+
+	// Notifications must not produce a response; the next read is for ping.
+	client.send(`{"jsonrpc":"2.0","method":"notifications/initialized"}`)
+	if resp := client.call("ping", nil); resp["error"] != nil {
+		t.Errorf("ping returned error: %v", resp["error"])
+	}
+
+	resp = client.call("tools/list", nil)
+	tools := resp["result"].(map[string]interface{})["tools"].([]interface{})
+	var names []string
+	for _, tool := range tools {
+		names = append(names, tool.(map[string]interface{})["name"].(string))
+	}
+	for _, expected := range []string{"search_secrets", "cache_status", "path_tree", "list_secret_keys"} {
+		if !containsString(names, expected) {
+			t.Errorf("Expected tool %s in %v", expected, names)
+		}
+	}
+}
+
+func TestMCPProtocolErrors(t *testing.T) {
+	client := startMCPTestServer(t)
+
+	client.send(`{not json`)
+	if resp := client.read(); resp["error"].(map[string]interface{})["code"].(float64) != rpcParseError {
+		t.Errorf("Expected parse error, got %v", resp)
+	}
+
+	if resp := client.call("resources/list", nil); resp["error"].(map[string]interface{})["code"].(float64) != rpcMethodNotFound {
+		t.Errorf("Expected method not found, got %v", resp)
+	}
+
+	resp := client.call("tools/call", map[string]interface{}{"name": "read_secret_value"})
+	if resp["error"].(map[string]interface{})["code"].(float64) != rpcInvalidParams {
+		t.Errorf("Expected invalid params for unknown tool, got %v", resp)
+	}
+}
+
+func TestMCPTools(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.IndexMetadata = true
+	setupTestCache()
+
+	client := startMCPTestServer(t)
+
+	t.Run("search_secrets", func(t *testing.T) {
+		payload, isError := client.toolText("search_secrets", map[string]interface{}{"term": "password", "in_path": "prod"})
+		if isError {
+			t.Fatalf("Unexpected tool error: %v", payload["error"])
+		}
+		matches := payload["matches"].([]interface{})
+		if len(matches) != 1 || matches[0] != "prod/db/credentials" {
+			t.Errorf("matches = %v, expected [prod/db/credentials]", matches)
+		}
+	})
+
+	t.Run("search_secrets path filter list", func(t *testing.T) {
+		payload, isError := client.toolText("search_secrets", map[string]interface{}{
+			"in_path":      []interface{}{"prod", "staging"},
+			"exclude_glob": "prod/api/**",
+		})
+		if isError {
+			t.Fatalf("Unexpected tool error: %v", payload["error"])
+		}
+		if total := payload["total"]; total != float64(2) {
+			t.Errorf("total = %v, expected 2", total)
+		}
+	})
+
+	t.Run("search_secrets meta filter", func(t *testing.T) {
+		cache.Lock()
+		cache.data["prod/api/keys"].Metadata = &SecretMetadata{CustomMetadata: map[string]string{"owner": "payments"}}
+		cache.Unlock()
+		payload, isError := client.toolText("search_secrets", map[string]interface{}{"meta": map[string]interface{}{"owner": "Payments"}})
+		if isError {
+			t.Fatalf("Unexpected tool error: %v", payload["error"])
+		}
+		matches := payload["matches"].([]interface{})
+		if len(matches) != 1 || matches[0] != "prod/api/keys" {
+			t.Errorf("matches = %v, expected [prod/api/keys]", matches)
+		}
+
+		if _, isError := client.toolText("search_secrets", map[string]interface{}{"meta": "owner=payments"}); !isError {
+			t.Error("Expected tool error for a non-object meta argument")
+		}
+	})
+
+	t.Run("search_secrets validation error", func(t *testing.T) {
+		payload, isError := client.toolText("search_secrets", map[string]interface{}{"term": "a", "regexp": "b"})
+		if !isError {
+			t.Fatalf("Expected tool error, got %v", payload)
+		}
+		if !strings.Contains(payload["error"].(string), "mutually exclusive") {
+			t.Errorf("Unexpected error text: %v", payload["error"])
+		}
+	})
+
+	t.Run("cache_status", func(t *testing.T) {
+		payload, isError := client.toolText("cache_status", nil)
+		if isError {
+			t.Fatalf("Unexpected tool error: %v", payload["error"])
+		}
+		if _, ok := payload["total_secrets"]; !ok {
+			t.Errorf("Missing total_secrets in %v", payload)
+		}
+	})
+
+	t.Run("path_tree", func(t *testing.T) {
+		payload, isError := client.toolText("path_tree", map[string]interface{}{"path": "prod"})
+		if isError {
+			t.Fatalf("Unexpected tool error: %v", payload["error"])
+		}
+		children := payload["children"].([]interface{})
+		if len(children) != 2 {
+			t.Fatalf("Expected 2 children under prod/, got %v", children)
+		}
+		first := children[0].(map[string]interface{})
+		if first["name"] != "api" || first["type"] != treeNodeFolder || first["secret_count"].(float64) != 1 {
+			t.Errorf("Unexpected first child: %v", first)
+		}
+	})
+
+	t.Run("list_secret_keys", func(t *testing.T) {
+		payload, isError := client.toolText("list_secret_keys", map[string]interface{}{"path": "prod/api/keys"})
+		if isError {
+			t.Fatalf("Unexpected tool error: %v", payload["error"])
+		}
+		keys := payload["keys"].([]interface{})
+		if len(keys) != 2 || keys[0] != "api_key" || keys[1] != "secret_key" {
+			t.Errorf("keys = %v, expected [api_key secret_key]", keys)
+		}
+
+		if _, isError := client.toolText("list_secret_keys", map[string]interface{}{"path": "missing/secret"}); !isError {
+			t.Error("Expected tool error for unknown secret")
+		}
+	})
+}
+
+func TestBuildPathTree(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
+
+	older := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	newer := older.Add(48 * time.Hour)
+	cache.Lock()
+	cache.data["prod/db/credentials"].Metadata = &SecretMetadata{UpdatedTime: older}
+	cache.data["prod/api/keys"].Metadata = &SecretMetadata{UpdatedTime: newer}
+	cache.Unlock()
+
+	root := buildPathTree("", nil)
+	if root.Path != "" || root.SecretCount != 3 || root.KeyCount != 8 || !root.LastUpdated.Equal(newer) {
+		t.Errorf("buildPathTree(\"\") totals = %+v", root.TreeNode)
+	}
+	children := root.Children
+	if len(children) != 2 || children[0].Name != "prod" || children[0].SecretCount != 2 || children[1].Name != "staging" {
+		t.Errorf("buildPathTree(\"\") = %+v", children)
+	}
+	if children[0].KeyCount != 5 || !children[0].LastUpdated.Equal(newer) {
+		t.Errorf("prod/ = %+v, expected 5 keys updated at %v", children[0], newer)
+	}
+	if children[1].KeyCount != 3 || children[1].LastUpdated != nil {
+		t.Errorf("staging/ = %+v, expected 3 keys and no update time", children[1])
+	}
+
+	leaf := buildPathTree("/prod/db/", nil)
+	if leaf.Name != "db" || leaf.Path != "prod/db/" || leaf.SecretCount != 1 {
+		t.Errorf("buildPathTree(\"/prod/db/\") totals = %+v", leaf.TreeNode)
+	}
+	if len(leaf.Children) != 1 || leaf.Children[0].Type != treeNodeSecret || leaf.Children[0].Path != "prod/db/credentials" ||
+		leaf.Children[0].KeyCount != 3 || !leaf.Children[0].LastUpdated.Equal(older) {
+		t.Errorf("buildPathTree(\"/prod/db/\") = %+v", leaf.Children)
+	}
+}
+
+func TestTreeHandler(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
+
+	tests := []struct {
+		url      string
+		status   int
+		path     string
+		children []string
+	}{
+		{"/tree", http.StatusOK, "", []string{"prod/", "staging/"}},
+		{"/tree?path=prod/", http.StatusOK, "prod/", []string{"prod/api/", "prod/db/"}},
+		{"/tree?path=/staging/db", http.StatusOK, "staging/db/", []string{"staging/db/config"}},
+		{"/tree?path=missing/", http.StatusNotFound, "", nil},
+		{"/tree?path=prod/db/credentials", http.StatusNotFound, "", nil},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		treeHandler(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, expected %d: %s", tt.url, rec.Code, tt.status, rec.Body.String())
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var tree PathTree
+		if err := json.Unmarshal(rec.Body.Bytes(), &tree); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", tt.url, err)
+		}
+		var paths []string
+		for _, child := range tree.Children {
+			paths = append(paths, child.Path)
+		}
+		if tree.Path != tt.path || fmt.Sprint(paths) != fmt.Sprint(tt.children) {
+			t.Errorf("%s: path = %q, children = %v, expected %q, %v", tt.url, tree.Path, paths, tt.path, tt.children)
+		}
+	}
+}
+
+func TestSecretKeysHandler(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
+
+	logEntry := logrus.NewEntry(logrus.New())
+	data := map[string]interface{}{
+		"password": "s3cr3t-value",
+		"config":   `{"db": {"host": "db.local"}, "clusters": [{"endpoint": "a"}, {"endpoint": "b", "tls": {"ca": "x"}}]}`,
+		"app_env":  "MODE=prod\nTOKEN=t0k3n-value\n",
+	}
+	keys, paths, formats := extractKeys(data, nil, logEntry)
+	updated := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache.Lock()
+	cache.data["prod/app/config"] = &SecretKeys{
+		AllKeys:    keys,
+		KeyPaths:   paths,
+		NestedKeys: len(keys) - len(data),
+		Formats:    formats,
+		Metadata:   &SecretMetadata{CurrentVersion: 4, UpdatedTime: updated},
+	}
+	cache.Unlock()
+
+	rec := httptest.NewRecorder()
+	secretKeysHandler(rec, httptest.NewRequest(http.MethodGet, "/secrets/prod/app/config/keys", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	for _, value := range []string{"s3cr3t-value", "t0k3n-value", "db.local"} {
+		if strings.Contains(body, value) {
+			t.Errorf("response contains the value %q: %s", value, body)
+		}
+	}
+
+	var tree SecretKeyTree
+	if err := json.Unmarshal(rec.Body.Bytes(), &tree); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if tree.Path != "prod/app/config" || tree.KeyCount != len(keys) || tree.NestedKeyCount != len(keys)-3 {
+		t.Errorf("tree = %+v", tree)
+	}
+	if tree.Metadata == nil || tree.Metadata.CurrentVersion != 4 || !tree.Metadata.UpdatedTime.Equal(updated) {
+		t.Errorf("metadata = %+v, expected version 4 updated at %v", tree.Metadata, updated)
+	}
+
+	var render func(nodes []*KeyNode) string
+	render = func(nodes []*KeyNode) string {
+		var parts []string
+		for _, n := range nodes {
+			part := n.Key
+			if n.Format != "" {
+				part += "(" + n.Format + ")"
+			}
+			if len(n.Children) > 0 {
+				part += render(n.Children)
+			}
+			parts = append(parts, part)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	expected := "[app_env(env)[MODE TOKEN] config(json)[clusters[endpoint tls[ca]] db[host]] password]"
+	if got := render(tree.Keys); got != expected {
+		t.Errorf("key tree = %s, expected %s", got, expected)
+	}
+	if ca := tree.Keys[1].Children[0].Children[1].Children[0]; ca.Path != "config.clusters[1].tls.ca" {
+		t.Errorf("ca path = %q", ca.Path)
+	}
+
+	for _, url := range []string{"/secrets/prod/missing/keys", "/secrets/prod/app/config", "/secrets//keys"} {
+		rec := httptest.NewRecorder()
+		secretKeysHandler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, expected 404", url, rec.Code)
+		}
+	}
+}
+
+func TestListAllSecretsPaths(t *testing.T) {
+	listings := map[string][]string{
+		"/v1/kv/metadata":         {"prod/", "top"},
+		"/v1/kv/metadata/prod":    {"db/", "app"},
+		"/v1/kv/metadata/prod/db": {"creds"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys, ok := listings[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	}))
+	defer server.Close()
+
+	prevClient := vaultClient
+	defer func() { vaultClient = prevClient }()
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaultClient = client
+
+	pathsCh := make(chan string, 10)
+	errCh := make(chan error, 1)
+	listAllSecrets(context.Background(), "", pathsCh, errCh, nil)
+	close(pathsCh)
+
+	var paths []string
+	for p := range pathsCh {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	if fmt.Sprint(paths) != "[prod/app prod/db/creds top]" {
+		t.Errorf("listAllSecrets() = %v, expected paths without a leading /", paths)
+	}
+}
+
+func TestSecretMetadata(t *testing.T) {
+	read := map[string]interface{}{
+		"data":     map[string]interface{}{"k": "v"},
+		"metadata": map[string]interface{}{"created_time": "2024-03-01T10:20:30.123456789Z", "version": json.Number("3")},
+	}
+	meta := metadataFromRead(read)
+	if meta == nil || meta.CurrentVersion != 3 || !meta.UpdatedTime.Equal(time.Date(2024, 3, 1, 10, 20, 30, 123456789, time.UTC)) {
+		t.Errorf("metadataFromRead() = %+v", meta)
+	}
+	if meta := metadataFromRead(map[string]interface{}{"data": map[string]interface{}{}}); meta != nil {
+		t.Errorf("metadataFromRead() without metadata = %+v, expected nil", meta)
+	}
+
+	meta = parseSecretMetadata(map[string]interface{}{
+		"current_version": json.Number("7"),
+		"max_versions":    json.Number("10"),
+		"cas_required":    true,
+		"created_time":    "2023-01-02T03:04:05Z",
+		"updated_time":    "2024-05-06T07:08:09.5Z",
+		"custom_metadata": map[string]interface{}{"owner": "payments", "env": "prod"},
+	})
+	expected := &SecretMetadata{
+		CurrentVersion: 7,
+		MaxVersions:    10,
+		CASRequired:    true,
+		CreatedTime:    time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		UpdatedTime:    time.Date(2024, 5, 6, 7, 8, 9, 500000000, time.UTC),
+		CustomMetadata: map[string]string{"owner": "payments", "env": "prod"},
+	}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Errorf("parseSecretMetadata() = %+v, expected %+v", meta, expected)
+	}
+	meta = parseSecretMetadata(map[string]interface{}{
+		"current_version": json.Number("3"),
+		"versions": map[string]interface{}{
+			"2": map[string]interface{}{"deletion_time": "", "destroyed": true},
+			"3": map[string]interface{}{"deletion_time": "2024-05-01T00:00:00Z", "destroyed": false},
+		},
+	})
+	if !meta.DeletionTime.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) || meta.Destroyed {
+		t.Errorf("parseSecretMetadata() deletion state = %v, %v, expected the current version's", meta.DeletionTime, meta.Destroyed)
+	}
+	read["metadata"].(map[string]interface{})["destroyed"] = true
+	if meta := metadataFromRead(read); !meta.Destroyed || !meta.DeletionTime.IsZero() {
+		t.Errorf("metadataFromRead() of a destroyed version = %+v", meta)
+	}
+
+	if meta := parseSecretMetadata(map[string]interface{}{"custom_metadata": nil}); meta.CustomMetadata != nil {
+		t.Errorf("parseSecretMetadata() with null custom_metadata = %v, expected nil", meta.CustomMetadata)
+	}
+}
+
+func TestTokenizeKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"db_password", "[db password]"},
+		{"dbPassword", "[db password]"},
+		{"DB-PASS", "[db pass]"},
+		{"config.redis.host", "[config redis host]"},
+		{"HTTPServer", "[http server]"},
+		{"db2Host", "[db2 host]"},
+		{"__x__", "[x]"},
+		{"", "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tokenTexts(tokenizeKey(tt.key))); got != tt.expected {
+			t.Errorf("tokenizeKey(%q) = %s, expected %s", tt.key, got, tt.expected)
+		}
+	}
+
+	tokens := tokenizeKey("dbPwd")
+	if tokens[1].start != 2 || tokens[1].end != 5 {
+		t.Errorf("tokenizeKey(\"dbPwd\") spans = %+v", tokens)
+	}
+}
+
+func TestLoadSynonyms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "synonyms.txt")
+	content := "# credentials\npwd, pass, password\n\ntoken, apikey, api_key\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	set, err := loadSynonyms(path)
+	if err != nil {
+		t.Fatalf("loadSynonyms() error = %v", err)
+	}
+	if got := fmt.Sprint(set.alternatives([]string{"pwd"})); got != "[[pwd] [pass] [password]]" {
+		t.Errorf("alternatives(pwd) = %s", got)
+	}
+	if got := fmt.Sprint(set.alternatives([]string{"api", "key"})); got != "[[api key] [token] [apikey]]" {
+		t.Errorf("alternatives(api key) = %s", got)
+	}
+
+	if err := os.WriteFile(path, []byte("pwd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSynonyms(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("loadSynonyms() error = %v, expected a line number", err)
+	}
+}
+
+func TestTokenAndSynonymSearch(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(prev synonymSet) { synonyms = prev }(synonyms)
+	synonyms = synonymSet{
+		"pwd":      {{"pwd"}, {"pass"}, {"password"}},
+		"pass":     {{"pwd"}, {"pass"}, {"password"}},
+		"password": {{"pwd"}, {"pass"}, {"password"}},
+	}
+
+	data := map[string]*SecretKeys{
+		"a/camel":  {AllKeys: []string{"dbPwd"}},
+		"a/kebab":  {AllKeys: []string{"DB-PASS"}},
+		"a/snake":  {AllKeys: []string{"db_password"}},
+		"a/bypass": {AllKeys: []string{"bypass"}},
+		"a/other":  {AllKeys: []string{"passport_no"}},
+	}
+	for secretPath, keys := range data {
+		keys.SearchString = buildSearchString(secretPath, keys.AllKeys)
+		keys.KeyTokens = tokenizeKeys(keys.AllKeys)
+	}
+	cache.Lock()
+	cache.data = data
+	cache.Unlock()
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{"/search?term=password", []string{"a/camel", "a/kebab", "a/snake"}},
+		{"/search?term=dbPassword", []string{"a/camel", "a/kebab", "a/snake"}},
+		{"/search?term=db_pwd&scope=keys", []string{"a/camel", "a/kebab", "a/snake"}},
+		{"/search?term=pass", []string{"a/bypass", "a/camel", "a/kebab", "a/other", "a/snake"}},
+		{"/search?term=password&scope=path", nil},
+		{"/search?q=key:password+NOT+path:camel", []string{"a/kebab", "a/snake"}},
+		{"/search?q=key:password+NOT+key:dbPwd", nil}, // synonyms apply under NOT too
+		{"/search?q=path:password", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			status, response := searchJSON(t, tt.url)
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %v", status, response)
+			}
+			var got []string
+			for _, m := range response["matches"].([]interface{}) {
+				got = append(got, m.(string))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("matches = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	_, response := searchJSON(t, "/search?term=password&details=true&in_path=camel")
+	matches := response["matches"].([]interface{})
+	if len(matches) != 1 {
+		t.Fatalf("Expected 1 match, got %v", matches)
+	}
+	km := matches[0].(map[string]interface{})["matched_keys"].([]interface{})[0].(map[string]interface{})
+	if km["key"] != "dbPwd" || fmt.Sprint(km["offsets"]) != "[[2 5]]" {
+		t.Errorf("matched key = %v, expected dbPwd highlighted at [2 5]", km)
+	}
+}
+
+func TestCompilePathGlob(t *testing.T) {
+	tests := []struct {
+		glob    string
+		path    string
+		matches bool
+	}{
+		{"prod/*/db/**", "prod/api/db", true},
+		{"prod/*/db/**", "prod/api/db/users/admin", true},
+		{"prod/*/db/**", "prod/api/cache/db", false},
+		{"prod/*/db/**", "prod/a/b/db/x", false},
+		{"**/archive/**", "archive", true},
+		{"**/archive/**", "team/x/archive/old", true},
+		{"**/archive/**", "team/archived/old", false},
+		{"*/archive/*", "team/archive/old", true},
+		{"*/archive/*", "a/team/archive/old", false},
+		{"**", "anything/at/all", true},
+		{"prod/db-??", "prod/db-01", true},
+		{"prod/db-??", "prod/db-1/x", false},
+		{"{prod,staging}/db/*", "staging/db/config", true},
+		{"{prod,staging}/db/*", "dev/db/config", false},
+		{"prod/[!a]*", "prod/api", false},
+		{"prod/[a-c]*", "prod/api", true},
+		{"Prod/**", "prod/api", false},
+		{"prod/a**b", "prod/axxb", true},
+		{"prod/a**b", "prod/ax/xb", false},
+		{"a[!x]b", "a/b", false},
+		{"a[^x]b", "a/b", false},
+		{"прод/**", "прод/db", true},
+		{"прод/**", "прод", true},
+		{"prod/ключ", "prod/ключ", true},
+		{"prod/к?юч", "prod/ключ", true},
+		{"prod/к*", "prod/ключ/x", false},
+		{"prod/\\ключ", "prod/ключ", true},
+		{"prod/[кл]люч", "prod/ключ", true},
+		{"prod/[!л]люч", "prod/ключ", true},
+		{"prod/[!л]люч", "prod//люч", false},
+		{"{прод,тест}/*", "тест/db", true},
+	}
+	for _, tt := range tests {
+		re, err := compilePathGlob(tt.glob)
+		if err != nil {
+			t.Fatalf("compilePathGlob(%q) error = %v", tt.glob, err)
+		}
+		if got := re.MatchString(tt.path); got != tt.matches {
+			t.Errorf("glob %q on %q = %v, expected %v", tt.glob, tt.path, got, tt.matches)
+		}
+	}
+
+	for _, glob := range []string{"prod/[a", "{prod", "prod}"} {
+		if _, err := compilePathGlob(glob); err == nil {
+			t.Errorf("compilePathGlob(%q) expected error", glob)
+		}
+	}
+}
+
+func TestSearchPathFilters(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
+	cache.Lock()
+	cache.data["prod/archive/db"] = &SecretKeys{AllKeys: []string{"password"}, SearchString: "prod/archive/db password "}
+	cache.Unlock()
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{"/search?in_path=api&in_path=staging", []string{"prod/api/keys", "staging/db/config"}},
+		{"/search?path_glob=*/db/*", []string{"prod/db/credentials", "staging/db/config"}},
+		{"/search?path_glob=prod/**&in_path=db", []string{"prod/archive/db", "prod/db/credentials"}},
+		{"/search?term=password&exclude_path=archive", []string{"prod/db/credentials", "staging/db/config"}},
+		{"/search?term=password&exclude_glob=**/archive/**&exclude_path=staging", []string{"prod/db/credentials"}},
+		{"/search?in_path=prod&exclude_glob=prod/a*/**", []string{"prod/db/credentials"}},
+		{"/search?term=password&path_glob=staging/**", []string{"staging/db/config"}},
+		{"/search?in_path=prod&in_path=", []string{"prod/api/keys", "prod/archive/db", "prod/db/credentials"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			status, response := searchJSON(t, tt.url)
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %v", status, response)
+			}
+			var got []string
+			for _, m := range response["matches"].([]interface{}) {
+				got = append(got, m.(string))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("matches = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	for _, url := range []string{"/search?exclude_path=archive", "/search?path_glob={prod", "/search?term=a&exclude_glob=[x"} {
+		if status, _ := searchJSON(t, url); status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", url, status)
+		}
+	}
+}
+
+func TestSearchMetaFilters(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.IndexMetadata = true
+	setupTestCache()
+	cache.Lock()
+	cache.data["prod/db/credentials"].Metadata = &SecretMetadata{
+		CurrentVersion: 2,
+		CustomMetadata: map[string]string{"Owner": "Payments", "tier": "critical"},
+	}
+	cache.data["prod/api/keys"].Metadata = &SecretMetadata{CustomMetadata: map[string]string{"owner": "search"}}
+	cache.data["staging/db/config"].Metadata = &SecretMetadata{CustomMetadata: map[string]string{"owner": "payments", "tier": "low"}}
+	cache.Unlock()
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{"/search?meta.owner=payments", []string{"prod/db/credentials", "staging/db/config"}},
+		{"/search?meta.OWNER=PAYMENTS&meta.tier=critical", []string{"prod/db/credentials"}},
+		{"/search?meta.owner=search&meta.owner=payments&in_path=prod", []string{"prod/api/keys", "prod/db/credentials"}},
+		{"/search?meta.tier=*", []string{"prod/db/credentials", "staging/db/config"}},
+		{"/search?term=password&meta.tier=low", []string{"staging/db/config"}},
+		{"/search?term=api_key&meta.owner=payments", nil},
+		{"/search?meta.team=payments", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			status, response := searchJSON(t, tt.url)
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %v", status, response)
+			}
+			var got []string
+			for _, m := range response["matches"].([]interface{}) {
+				got = append(got, m.(string))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("matches = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	if status, _ := searchJSON(t, "/search?meta.=payments"); status != http.StatusBadRequest {
+		t.Errorf("meta.=payments: expected status 400, got %d", status)
+	}
+	if status, _ := searchJSON(t, "/search?meta.owner="); status != http.StatusBadRequest {
+		t.Errorf("meta.owner= alone: expected status 400, got %d", status)
+	}
+
+	status, response := searchJSON(t, "/search?meta.tier=critical&details=true")
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %v", status, response)
+	}
+	detail := response["matches"].([]interface{})[0].(map[string]interface{})
+	meta, _ := detail["metadata"].(map[string]interface{})
+	if meta["current_version"] != float64(2) || meta["custom_metadata"].(map[string]interface{})["tier"] != "critical" {
+		t.Errorf("details metadata = %v", detail["metadata"])
+	}
+}
+
+func TestParseTimeBound(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2024-01-02T03:04:05Z", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"2024-01-02T03:04:05+02:00", time.Date(2024, 1, 2, 1, 4, 5, 0, time.UTC)},
+		{"2024-01-02", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"30d", time.Date(2024, 5, 16, 12, 0, 0, 0, time.UTC)},
+		{"2w", time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{"1y", time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)},
+		{"36h", time.Date(2024, 6, 14, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeBound(tt.value, now)
+		if err != nil || !got.Equal(tt.expected) {
+			t.Errorf("parseTimeBound(%q) = %v, %v, expected %v", tt.value, got, err, tt.expected)
+		}
+	}
+	for _, v := range []string{"yesterday", "-5d", "-1h", "30x", "2024-13-01"} {
+		if _, err := parseTimeBound(v, now); err == nil {
+			t.Errorf("parseTimeBound(%q) expected an error", v)
+		}
+	}
+}
+
+func TestSearchTimeFilters(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.IndexMetadata = true
+	setupTestCache()
+	cache.Lock()
+	cache.data["prod/db/credentials"].Metadata = &SecretMetadata{
+		CreatedTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		UpdatedTime: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+	cache.data["prod/api/keys"].Metadata = &SecretMetadata{UpdatedTime: time.Now().Add(-time.Hour)}
+	cache.data["staging/db/config"].Metadata = &SecretMetadata{
+		CreatedTime: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+		UpdatedTime: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	cache.data["staging/legacy"] = &SecretKeys{AllKeys: []string{"password"}, SearchString: "staging/legacy password "}
+	cache.Unlock()
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{"/search?term=password&updated_before=365d", []string{"prod/db/credentials", "staging/db/config"}},
+		{"/search?updated_after=30d", []string{"prod/api/keys"}},
+		{"/search?updated_after=2021-01-01&updated_before=2023-06-01T00:00:00Z", []string{"prod/db/credentials"}},
+		{"/search?created_before=2022-01-01", []string{"prod/db/credentials"}},
+		{"/search?created_after=2019-01-01&in_path=staging", []string{"staging/db/config"}},
+		{"/search?in_path=prod&in_path=staging&sort=updated", []string{"prod/api/keys", "staging/db/config", "prod/db/credentials", "staging/legacy"}},
+		{"/search?term=password&sort=updated", []string{"staging/db/config", "prod/db/credentials", "staging/legacy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			status, response := searchJSON(t, tt.url)
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %v", status, response)
+			}
+			var got []string
+			for _, m := range response["matches"].([]interface{}) {
+				got = append(got, m.(string))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("matches = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	for _, url := range []string{"/search?updated_before=last-year", "/search?updated_after=2024-01-01&updated_before=2023-01-01"} {
+		if status, _ := searchJSON(t, url); status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", url, status)
+		}
+	}
+
+	cfg.IndexMetadata = false
+	if status, response := searchJSON(t, "/search?created_before=2022-01-01"); status != http.StatusBadRequest {
+		t.Errorf("created_before without VAULT_READ_METADATA: status %d, expected 400: %v", status, response)
+	}
+	if status, response := searchJSON(t, "/search?updated_after=30d"); status != http.StatusOK || fmt.Sprint(response["matches"]) != "[prod/api/keys]" {
+		t.Errorf("updated_after without VAULT_READ_METADATA: status %d: %v", status, response)
+	}
+}
+
+func TestSearchDottedKeyPaths(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+
+	logEntry := logrus.NewEntry(logrus.New())
+	secrets := map[string]map[string]interface{}{
+		"prod/app":   {"config": `{"host": "db", "port": 5432}`, "redis": "host: cache\nport: 6379\n"},
+		"prod/k8s":   {"clusters": `[{"endpoint": "a"}]`},
+		"prod/plain": {"host": "x"},
+	}
+	data := make(map[string]*SecretKeys)
+	for secretPath, secret := range secrets {
+		keys, paths, _ := extractKeys(secret, nil, logEntry)
+		data[secretPath] = &SecretKeys{
+			AllKeys:      keys,
+			KeyPaths:     paths,
+			NestedKeys:   len(keys) - len(secret),
+			SearchString: buildSearchString(secretPath, append(keys, dottedKeyPaths(keys, paths)...)),
+		}
+	}
+	cache.Lock()
+	cache.data = data
+	cache.index = buildTrigramIndex(data)
+	cache.Unlock()
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{"/search?term=config.host", []string{"prod/app"}},
+		{"/search?term=redis.host&scope=keys", []string{"prod/app"}},
+		{"/search?q=" + url.QueryEscape("key:clusters[0].endpoint"), []string{"prod/k8s"}},
+		{"/search?q=" + url.QueryEscape("key:/^config\\.[a-z]+$/"), []string{"prod/app"}},
+		{"/search?term=host&scope=keys", []string{"prod/app", "prod/plain"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			status, response := searchJSON(t, tt.url)
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %v", status, response)
+			}
+			var got []string
+			for _, m := range response["matches"].([]interface{}) {
+				got = append(got, m.(string))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("matches = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	_, response := searchJSON(t, "/search?term=config.host&details=true")
+	detail := response["matches"].([]interface{})[0].(map[string]interface{})
+	var found bool
+	for _, m := range detail["matched_keys"].([]interface{}) {
+		km := m.(map[string]interface{})
+		if km["key"] == "host" && km["key_path"] == "config.host" && fmt.Sprint(km["key_path_offsets"]) == "[[0 11]]" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("matched_keys = %v, expected host at config.host highlighted", detail["matched_keys"])
+	}
+
+	_, response = searchJSON(t, "/search?term=host&in_path=app&details=true")
+	detail = response["matches"].([]interface{})[0].(map[string]interface{})
+	var paths []string
+	for _, m := range detail["matched_keys"].([]interface{}) {
+		paths = append(paths, m.(map[string]interface{})["key_path"].(string))
+	}
+	sort.Strings(paths)
+	if fmt.Sprint(paths) != "[config.host redis.host]" {
+		t.Errorf("key paths = %v, expected both nested host keys", paths)
+	}
+}
+
+func TestSuggestHandler(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
+	cache.Lock()
+	cache.data["prod/dns"] = &SecretKeys{AllKeys: []string{"Password", "zone"}}
+	cache.Unlock()
+
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{"root segments", "/suggest?prefix=", "[{prod/ folder 3} {staging/ folder 1}]"},
+		{"default kind is path", "/suggest?prefix=pr", "[{prod/ folder 3}]"},
+		{"next segment", "/suggest?prefix=prod/d&kind=path", "[{prod/db/ folder 1} {prod/dns secret 1}]"},
+		{"secret leaf", "/suggest?prefix=/prod/db/", "[{prod/db/credentials secret 1}]"},
+		{"path limit", "/suggest?prefix=prod/&limit=1", "[{prod/api/ folder 1}]"},
+		{"path is case-sensitive", "/suggest?prefix=PROD", "[]"},
+		{"keys by usage", "/suggest?prefix=p&kind=key", "[{password  2} {Password  1} {port  1}]"},
+		{"key limit", "/suggest?prefix=P&kind=key&limit=1", "[{password  2}]"},
+		{"no key", "/suggest?prefix=x&kind=key", "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			suggestHandler(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var response struct {
+				Suggestions []Completion `json:"suggestions"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := fmt.Sprint(response.Suggestions); got != tt.expected {
+				t.Errorf("suggestions = %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+
+	for _, url := range []string{"/suggest?kind=value", "/suggest?limit=0", "/suggest?limit=1000"} {
+		rec := httptest.NewRecorder()
+		suggestHandler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", url, rec.Code)
+		}
+	}
+
+	// The index built on rebuild must give the same answers.
+	cache.Lock()
+	cache.index = buildTrigramIndex(cache.data)
+	cache.Unlock()
+	if got, _ := suggestCompletions(context.Background(), suggestKindPath, "prod/d", 10); fmt.Sprint(got) != "[{prod/db/ folder 1} {prod/dns secret 1}]" {
+		t.Errorf("indexed path suggestions = %v", got)
+	}
+	if got, _ := suggestCompletions(context.Background(), suggestKindKey, "p", 10); fmt.Sprint(got) != "[{password  2} {Password  1} {port  1}]" {
+		t.Errorf("indexed key suggestions = %v", got)
+	}
+}
+
+func TestTrigramIndexMatchesScan(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+
+	data := syntheticSecrets(2000)
+	index := buildTrigramIndex(data)
+
+	urls := []string{
+		"/search?term=password",
+		"/search?term=DB_PASS",
+		"/search?term=ab",
+		"/search?term=service17/",
+		"/search?term=no-such-key",
+		"/search?term=token&scope=keys",
+		"/search?regexp=^team3",
+		"/search?regexp=(?i)API_(KEY|TOKEN)",
+		"/search?regexp=redis|mongo",
+		"/search?regexp=[a-z]+_url&scope=keys",
+		"/search?q=key:password+AND+path:team1*+NOT+path:*/legacy/*",
+		"/search?q=(key:/^tls_/+OR+key:cert)+staging",
+		"/search?in_path=staging",
+		"/search?term=password&in_path=legacy",
+		"/search?in_path=team1&in_path=legacy&exclude_path=staging",
+		"/search?term=token&path_glob=team2*/**/prod/*",
+		"/search?path_glob={dev,prod}/**&path_glob=team3/**",
+		"/search?term=pasword&fuzzy=true",
+		"/search?q=key:tokne~+AND+path:team1*",
+		"/search?term=dbPassword",
+		"/search?term=pwd",
+		"/search?term=apikey&scope=keys",
+		"/search?q=key:pass+AND+NOT+key:DB-PASSWORD",
+	}
+
+	defer func(prev synonymSet) { synonyms = prev }(synonyms)
+	synonyms = synonymSet{
+		"pwd":      {{"pwd"}, {"pass"}, {"password"}},
+		"pass":     {{"pwd"}, {"pass"}, {"password"}},
+		"password": {{"pwd"}, {"pass"}, {"password"}},
+		"apikey":   {{"apikey"}, {"api", "key"}},
+		"api key":  {{"apikey"}, {"api", "key"}},
+	}
+
+	for _, url := range urls {
+		t.Run(url, func(t *testing.T) {
+			params, err := parseSearchParams(httptest.NewRequest(http.MethodGet, url, nil))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var regex *regexp.Regexp
+			if params.Regexp != "" {
+				regex = regexp.MustCompile(params.Regexp)
+			}
+
+			cache.Lock()
+			cache.data, cache.index = data, nil
+			cache.Unlock()
+			scanned, err := performSearch(params, regex, context.Background())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			cache.Lock()
+			cache.index = index
+			cache.Unlock()
+			indexed, err := performSearch(params, regex, context.Background())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if strings.Join(scanned.Matches, ",") != strings.Join(indexed.Matches, ",") {
+				t.Errorf("Indexed search returned %d matches, full scan %d", len(indexed.Matches), len(scanned.Matches))
+			}
+		})
+	}
+}
+
+func TestTrigramQueryPlanning(t *testing.T) {
+	index := buildTrigramIndex(map[string]*SecretKeys{
+		"a": {SearchString: "prod/db password "},
+		"b": {SearchString: "prod/api api_key "},
+		"c": {SearchString: "staging/db password host "},
+	})
+
+	tests := []struct {
+		name     string
+		query    *trigramQuery
+		all      bool
+		expected []string
+	}{
+		{"literal", literalTrigramQuery("PASSWORD"), false, []string{"a", "c"}},
+		{"short literal", literalTrigramQuery("db"), true, nil},
+		{"concat", regexpTrigramQuery("prod.*pass"), false, []string{"a"}},
+		{"alternate", regexpTrigramQuery("api|host"), false, []string{"b", "c"}},
+		{"alternate with short branch", regexpTrigramQuery("api|db"), true, nil},
+		{"optional literal", regexpTrigramQuery("(password)?x"), true, nil},
+		{"plus", regexpTrigramQuery("(stag)+ing"), false, []string{"c"}},
+		{"char class", regexpTrigramQuery("[ps]taging"), false, []string{"c"}},
+		{"no candidates", literalTrigramQuery("mongo"), false, nil},
+		{"glob", globTrigramQuery("prod/*/api_*"), false, []string{"b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, all := index.candidates(tt.query)
+			if all != tt.all {
+				t.Fatalf("all = %v, expected %v", all, tt.all)
+			}
+			var paths []string
+			for _, id := range ids {
+				paths = append(paths, index.paths[id])
+			}
+			if fmt.Sprint(paths) != fmt.Sprint(tt.expected) {
+				t.Errorf("candidates = %v, expected %v", paths, tt.expected)
+			}
+		})
+	}
+}
+
+func BenchmarkPerformSearch(b *testing.B) {
+	data := syntheticSecrets(100000)
+	index := buildTrigramIndex(data)
+
+	cases := []struct {
+		name  string
+		url   string
+		regex bool
+	}{
+		{"term", "/search?term=legacy_api_token", false},
+		{"regexp", "/search?regexp=service4[0-9]+/.*redis_url", true},
+		{"query", "/search?q=key:tls_cert+AND+path:team7*", false},
+	}
+
+	for _, mode := range []string{"scan", "index"} {
+		for _, bc := range cases {
+			b.Run(mode+"/"+bc.name, func(b *testing.B) {
+				params, err := parseSearchParams(httptest.NewRequest(http.MethodGet, bc.url, nil))
+				if err != nil {
+					b.Fatalf("Unexpected error: %v", err)
+				}
+				var regex *regexp.Regexp
+				if bc.regex {
+					regex = regexp.MustCompile(params.Regexp)
+				}
+
+				cache.Lock()
+				cache.data, cache.index = data, nil
+				if mode == "index" {
+					cache.index = index
+				}
+				cache.Unlock()
+				defer restoreCache()
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := performSearch(params, regex, context.Background()); err != nil {
+						b.Fatalf("Unexpected error: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// syntheticSecrets builds a deterministic cache shaped like a large mount.
+func syntheticSecrets(n int) map[string]*SecretKeys {
+	envs := []string{"prod", "staging", "dev", "legacy"}
+	keySets := [][]string{
+		{"username", "password", "host", "port"},
+		{"api_key", "api_secret"},
+		{"tls_cert", "tls_key", "ca_bundle"},
+		{"db_password", "db_user", "redis_url", "mongo_uri"},
+		{"token", "client_id", "client_secret"},
+	}
+
+	data := make(map[string]*SecretKeys, n)
+	for i := 0; i < n; i++ {
+		p := fmt.Sprintf("team%d/service%d/%s/secret%d", i%50, i%997, envs[i%len(envs)], i)
+		keys := append([]string{}, keySets[i%len(keySets)]...)
+		if i%1000 == 0 {
+			keys = append(keys, "legacy_api_token")
+		}
+		data[p] = &SecretKeys{AllKeys: keys, SearchString: buildSearchString(p, keys)}
+	}
+	return data
+}
+
+func setupTestCache() {
+	atomic.StoreInt32(&cache.isRebuilding, 0)
+	cache.Lock()
+	cache.data = map[string]*SecretKeys{
+		"prod/db/credentials": {
+			AllKeys:      []string{"username", "password", "host"},
+			SearchString: "prod/db/credentials username password host ",
+		},
+		"prod/api/keys": {
+			AllKeys:      []string{"api_key", "secret_key"},
+			SearchString: "prod/api/keys api_key secret_key ",
+		},
+		"staging/db/config": {
+			AllKeys:      []string{"host", "port", "password"},
+			SearchString: "staging/db/config host port password ",
+		},
+	}
+	cache.Unlock()
 }
 
 func setupLargeTestCache() {
@@ -970,40 +3243,1172 @@ func setupLargeTestCache() {
 		}
 	}
 	cache.Lock()
-	cache.data = data
+	cache.data = data
+	cache.Unlock()
+}
+
+func containsAllKeys(keys []string, expected []string) bool {
+	keySet := make(map[string]bool)
+	for _, k := range keys {
+		keySet[k] = true
+	}
+	for _, e := range expected {
+		if !keySet[e] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type testError struct {
+	msg string
+}
+
+func (e *testError) Error() string {
+	return e.msg
+}
+
+func createError(msg string) error {
+	return &testError{msg: msg}
+}
+
+func TestLoadRotationConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rotation.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`max_age: 1y
+rules:
+  - path: prod/**
+    max_age: 90d
+  - path: prod/legacy/**
+    max_age: 2w
+  - path: прод/**
+    max_age: 30d
+`)
+	rc, err := loadRotationConfig(path)
+	if err != nil {
+		t.Fatalf("loadRotationConfig() error = %v", err)
+	}
+	tests := []struct {
+		path   string
+		maxAge string
+		rule   string
+	}{
+		{"prod/db/credentials", "90d", "prod/**"},
+		{"prod/legacy/ftp", "2w", "prod/legacy/**"},
+		{"staging/db/config", "1y", ""},
+		{"прод/база", "30d", "прод/**"},
+	}
+	for _, tt := range tests {
+		maxAge, rule, ok := rc.maxAgeFor(tt.path)
+		if !ok || maxAge.String() != tt.maxAge || rule != tt.rule {
+			t.Errorf("maxAgeFor(%q) = %v, %q, %v, expected %s, %q", tt.path, maxAge, rule, ok, tt.maxAge, tt.rule)
+		}
+	}
+	if _, _, ok := (*rotationConfig)(nil).maxAgeFor("prod/db"); ok {
+		t.Error("nil config should have no max age")
+	}
+
+	write("rules:\n  - path: prod/**\n    max_age: 90d\n")
+	if rc, err := loadRotationConfig(path); err != nil {
+		t.Fatalf("loadRotationConfig() error = %v", err)
+	} else if _, _, ok := rc.maxAgeFor("staging/db"); ok {
+		t.Error("secret outside every rule without a top-level max_age should not be checked")
+	}
+
+	invalid := map[string]string{
+		"unknown field": "max_ages: 90d\n",
+		"bad age":       "max_age: quarterly\n",
+		"rule path":     "rules:\n  - max_age: 90d\n",
+		"rule max_age":  "rules:\n  - path: prod/**\n",
+		"rule glob":     "rules:\n  - path: 'prod/{a'\n    max_age: 90d\n",
+	}
+	for name, content := range invalid {
+		write(content)
+		if _, err := loadRotationConfig(path); err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: loadRotationConfig() error = %v, expected an error naming the file", name, err)
+		}
+	}
+}
+
+func TestMetadataNotIndexed(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.IndexMetadata = false
+	setupTestCache()
+
+	for _, url := range []string{
+		"/search?meta.owner=payments",
+		"/search?term=password&meta.tier=*",
+		"/reports/stale?older_than=90d&group_by=owner",
+		"/reports/stale?older_than=90d&group_by=meta.team",
+		"/reports/deleted?meta.owner=payments",
+	} {
+		rec := httptest.NewRecorder()
+		handler := searchHandler
+		if strings.HasPrefix(url, "/reports/stale") {
+			handler = staleReportHandler
+		} else if strings.HasPrefix(url, "/reports/deleted") {
+			handler = deletedReportHandler
+		}
+		handler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "VAULT_READ_METADATA") {
+			t.Errorf("%s: status %d %s, expected 400 naming VAULT_READ_METADATA", url, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	staleReportHandler(rec, httptest.NewRequest(http.MethodGet, "/reports/stale?older_than=90d&group_by=path", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("group_by=path without metadata: status %d", rec.Code)
+	}
+}
+
+func TestStaleReport(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.IndexMetadata = true
+	defer func(rc *rotationConfig) { rotation = rc }(rotation)
+	setupTestCache()
+
+	now := time.Now()
+	cache.Lock()
+	cache.data["prod/db/credentials"].Metadata = &SecretMetadata{
+		CurrentVersion: 3,
+		UpdatedTime:    now.Add(-200 * 24 * time.Hour),
+		CustomMetadata: map[string]string{"owner": "payments"},
+	}
+	cache.data["prod/api/keys"].Metadata = &SecretMetadata{UpdatedTime: now.Add(-100 * 24 * time.Hour)}
+	cache.data["staging/db/config"].Metadata = &SecretMetadata{
+		UpdatedTime:    now.Add(-10 * 24 * time.Hour),
+		CustomMetadata: map[string]string{"owner": "payments"},
+	}
+	cache.data["staging/unknown"] = &SecretKeys{AllKeys: []string{"token"}}
+	cache.Unlock()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		staleReportHandler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) StaleReport {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var report StaleReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	count := func(n *int) int {
+		if n == nil {
+			return -1
+		}
+		return *n
+	}
+	stalePaths := func(group StaleGroup) []string {
+		var paths []string
+		for _, s := range group.Secrets {
+			paths = append(paths, s.Path)
+		}
+		return paths
+	}
+
+	rotation = nil
+	report := decode(get("/reports/stale?older_than=180d"))
+	if count(report.SecretCount) != 4 || report.StaleCount != 1 || report.UnknownCount != 1 || report.GroupBy != groupByPath || len(report.Groups) != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	prod, staging := report.Groups[0], report.Groups[1]
+	if prod.Group != "prod" || count(prod.SecretCount) != 2 || prod.StaleCount != 1 || fmt.Sprint(stalePaths(prod)) != "[prod/db/credentials]" {
+		t.Errorf("prod group = %+v", prod)
+	}
+	if s := prod.Secrets[0]; s.AgeDays == nil || *s.AgeDays != 200 || s.MaxAge != "180d" || s.Owner != "payments" || s.Version != 3 {
+		t.Errorf("stale secret = %+v", s)
+	}
+	if staging.Group != "staging" || count(staging.SecretCount) != 2 || staging.StaleCount != 0 || len(staging.Secrets) != 0 ||
+		staging.UnknownCount != 1 || len(staging.Unknown) != 1 || staging.Unknown[0].Path != "staging/unknown" || staging.Unknown[0].UpdatedTime != nil {
+		t.Errorf("staging group = %+v, expected the secret without an update time as unknown, not stale", staging)
+	}
+
+	report = decode(get("/reports/stale?older_than=90d&in_path=prod&group_by=owner"))
+	if len(report.Groups) != 2 || report.Groups[0].Group != noGroup || report.Groups[1].Group != "payments" || report.StaleCount != 2 {
+		t.Errorf("owner groups = %+v", report.Groups)
+	}
+
+	rotation = &rotationConfig{Rules: []rotationRule{{Path: "prod/**", MaxAge: &age{days: 90, text: "90d"}}}}
+	rotation.Rules[0].glob, _ = compilePathGlob("prod/**")
+	report = decode(get("/reports/stale"))
+	if count(report.SecretCount) != 2 || count(report.UncheckedCount) != 2 || report.StaleCount != 2 {
+		t.Errorf("rule report = %+v, expected both prod secrets stale and staging unchecked", report)
+	}
+	if s := report.Groups[0].Secrets[0]; s.Path != "prod/db/credentials" || s.Rule != "prod/**" || s.MaxAge != "90d" {
+		t.Errorf("oldest stale secret = %+v", s)
+	}
+
+	rec := get("/reports/stale?older_than=180d&format=csv")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("CSV report: status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "group" || rows[1][1] != "prod/db/credentials" || rows[1][2] != "stale" || rows[1][4] != "200" ||
+		rows[2][1] != "staging/unknown" || rows[2][2] != "unknown" || rows[2][3] != "" {
+		t.Errorf("CSV rows = %v", rows)
+	}
+
+	rotation = nil
+	for _, url := range []string{
+		"/reports/stale",
+		"/reports/stale?older_than=soon",
+		"/reports/stale?older_than=90d&group_by=team",
+		"/reports/stale?older_than=90d&format=xlsx",
+		"/reports/stale?older_than=90d&path_glob={prod",
+	} {
+		if rec := get(url); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", url, rec.Code)
+		}
+	}
+}
+
+func TestReadSecretHistory(t *testing.T) {
+	versions := map[string]map[string]interface{}{
+		"4": {"data": map[string]interface{}{"password": "x", "old_token": "y"}, "metadata": map[string]interface{}{"version": 4, "created_time": "2024-04-01T00:00:00Z"}},
+		"3": {"data": nil, "metadata": map[string]interface{}{"version": 3, "deletion_time": "2024-03-05T00:00:00Z"}},
+		"2": {"data": map[string]interface{}{"legacy_api_key": `{"id": 1}`}, "metadata": map[string]interface{}{"version": 2}},
+		"1": {"data": map[string]interface{}{"first": "x"}, "metadata": map[string]interface{}{"version": 1}},
+	}
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query().Get("version")
+		requested = append(requested, v)
+		data, ok := versions[v]
+		if r.URL.Path != "/v1/kv/data/prod/app" || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		status := http.StatusOK
+		if data["data"] == nil {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]interface{}{"data": data})
+	}))
+	defer server.Close()
+
+	prevClient, prevVersions := vaultClient, cfg.HistoryVersions
+	defer func() { vaultClient, cfg.HistoryVersions = prevClient, prevVersions }()
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaultClient = client
+	logEntry := logger.WithField("test", "history")
+
+	cfg.HistoryVersions = 3
+	history := readSecretHistory(context.Background(), "prod/app", &SecretMetadata{CurrentVersion: 5}, nil, logEntry)
+	if fmt.Sprint(requested) != "[4 3 2]" {
+		t.Errorf("requested versions %v, expected [4 3 2]", requested)
+	}
+	if len(history) != 2 || history[0].version() != 4 || history[1].version() != 2 {
+		t.Fatalf("history = %+v, expected versions 4 and 2", history)
+	}
+	if !history[0].Metadata.UpdatedTime.Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("version 4 metadata = %+v", history[0].Metadata)
+	}
+	if fmt.Sprint(history[1].KeyPaths) != "[legacy_api_key legacy_api_key.id]" {
+		t.Errorf("version 2 key paths = %v", history[1].KeyPaths)
+	}
+
+	requested = nil
+	readSecretHistory(context.Background(), "prod/app", &SecretMetadata{CurrentVersion: 5, MaxVersions: 2}, nil, logEntry)
+	if fmt.Sprint(requested) != "[4]" {
+		t.Errorf("requested versions %v with max_versions 2, expected [4]", requested)
+	}
+
+	requested = nil
+	cfg.HistoryVersions = 0
+	if history := readSecretHistory(context.Background(), "prod/app", &SecretMetadata{CurrentVersion: 5}, nil, logEntry); history != nil || requested != nil {
+		t.Errorf("history without VAULT_HISTORY_VERSIONS = %v, requested %v", history, requested)
+	}
+}
+
+func TestSearchAllVersions(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(n int) { cfg.HistoryVersions = n }(cfg.HistoryVersions)
+	cfg.HistoryVersions = 5
+	setupTestCache()
+
+	logEntry := logger.WithField("test", "versions")
+	version := func(v int, data map[string]interface{}) *SecretKeys {
+		keys := newSecretKeys("prod/app", data, nil, logEntry)
+		keys.Metadata = &SecretMetadata{CurrentVersion: v}
+		return keys
+	}
+	app := version(5, map[string]interface{}{"password": "x"})
+	app.History = []*SecretKeys{
+		version(4, map[string]interface{}{"password": "x", "old_token": "y"}),
+		version(2, map[string]interface{}{"legacy_api_key": "z"}),
+	}
+	cache.Lock()
+	cache.data["prod/app"] = app
+	cache.Unlock()
+
+	status, response := searchJSON(t, "/search?term=legacy_api_key")
+	if status != http.StatusOK || response["total"] != float64(0) {
+		t.Errorf("current-only search = %d %v, expected no matches", status, response)
+	}
+
+	status, response = searchJSON(t, "/search?term=legacy_api_key&versions=all")
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %v", status, response)
+	}
+	if fmt.Sprint(response["matches"]) != "[prod/app]" || fmt.Sprint(response["versions"]) != "map[prod/app:[2]]" {
+		t.Errorf("versions=all response = %v", response)
+	}
+
+	status, response = searchJSON(t, "/search?term=password&in_path=prod&versions=all")
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %v", status, response)
+	}
+	if fmt.Sprint(response["versions"]) != "map[prod/app:[5 4] prod/db/credentials:[0]]" {
+		t.Errorf("versions = %v", response["versions"])
+	}
+
+	status, response = searchJSON(t, "/search?q=key:old_token+OR+key:legacy_api_key&versions=all&details=true")
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %v", status, response)
+	}
+	detail := response["matches"].([]interface{})[0].(map[string]interface{})
+	if fmt.Sprint(detail["versions"]) != "[4 2]" {
+		t.Errorf("detail versions = %v, expected [4 2]", detail["versions"])
+	}
+	var got []string
+	for _, km := range detail["matched_keys"].([]interface{}) {
+		km := km.(map[string]interface{})
+		got = append(got, fmt.Sprintf("%s@%v", km["key"], km["version"]))
+	}
+	if fmt.Sprint(got) != "[old_token@4 legacy_api_key@2]" {
+		t.Errorf("matched keys = %v", got)
+	}
+
+	cache.Lock()
+	cache.index = buildTrigramIndex(cache.data)
+	cache.Unlock()
+	if _, response := searchJSON(t, "/search?regexp=legacy_.*_key&versions=all"); fmt.Sprint(response["matches"]) != "[prod/app]" {
+		t.Errorf("indexed versions=all search = %v, expected the older version to be indexed", response["matches"])
+	}
+
+	if status, _ := searchJSON(t, "/search?term=a&versions=some"); status != http.StatusBadRequest {
+		t.Errorf("versions=some: expected status 400, got %d", status)
+	}
+	cfg.HistoryVersions = 0
+	if status, _ := searchJSON(t, "/search?term=a&versions=all"); status != http.StatusBadRequest {
+		t.Errorf("versions=all without history: expected status 400, got %d", status)
+	}
+}
+
+// useVaultServer points vaultClient at a test server until the test ends,
+// once rebuilds started by earlier tests are done with the previous client.
+func useVaultServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	rebuildWg.Wait()
+	server := httptest.NewServer(handler)
+	prevClient := vaultClient
+	t.Cleanup(func() {
+		vaultClient = prevClient
+		server.Close()
+	})
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaultClient = client
+}
+
+func TestRebuildCacheDeletedSecrets(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.IndexMetadata, cfg.HistoryVersions = false, 0
+
+	reads := map[string]map[string]interface{}{
+		"live":  {"data": map[string]interface{}{"password": "x"}, "metadata": map[string]interface{}{"version": 2, "created_time": "2024-01-01T00:00:00Z"}},
+		"gone":  {"data": nil, "metadata": map[string]interface{}{"version": 3, "deletion_time": "2024-05-01T00:00:00Z", "destroyed": false}},
+		"burnt": {"data": nil, "metadata": map[string]interface{}{"version": 1, "deletion_time": "", "destroyed": true}},
+	}
+	useVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/kv/metadata" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": []string{"live", "gone", "burnt", "empty"}}})
+			return
+		}
+		read, ok := reads[strings.TrimPrefix(r.URL.Path, "/v1/kv/data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		status := http.StatusOK
+		if read["data"] == nil {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]interface{}{"data": read})
+	})
+
+	if err := rebuildCache(context.Background()); err != nil {
+		t.Fatalf("rebuildCache() error = %v", err)
+	}
+
+	cache.RLock()
+	live, gone, burnt, empty := cache.data["live"], cache.data["gone"], cache.data["burnt"], cache.data["empty"]
+	cache.RUnlock()
+	if live.isDeleted() || len(live.AllKeys) != 1 {
+		t.Errorf("live = %+v", live)
+	}
+	if !gone.isDeleted() || gone.Metadata.CurrentVersion != 3 || !gone.Metadata.DeletionTime.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("gone = %+v, metadata %+v", gone, gone.metadata())
+	}
+	if !burnt.isDeleted() || !burnt.Metadata.Destroyed {
+		t.Errorf("burnt = %+v, metadata %+v", burnt, burnt.metadata())
+	}
+	if empty != nil {
+		t.Errorf("a secret read as nothing without deletion metadata should be skipped, got %+v", empty)
+	}
+	if n := cacheStatus()["deleted_secrets"]; n != int64(2) {
+		t.Errorf("deleted_secrets = %v, expected 2", n)
+	}
+}
+
+func TestSearchIncludeDeleted(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	setupTestCache()
+	cache.Lock()
+	cache.data["prod/db/old"] = &SecretKeys{
+		SearchString: buildSearchString("prod/db/old", nil),
+		Metadata:     &SecretMetadata{CurrentVersion: 3, DeletionTime: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		Deleted:      true,
+	}
+	cache.Unlock()
+
+	if _, response := searchJSON(t, "/search?in_path=db"); fmt.Sprint(response["matches"]) != "[prod/db/credentials staging/db/config]" {
+		t.Errorf("default search = %v, expected no deleted secrets", response["matches"])
+	}
+	if _, response := searchJSON(t, "/search?in_path=db&include_deleted=true"); fmt.Sprint(response["matches"]) != "[prod/db/credentials prod/db/old staging/db/config]" {
+		t.Errorf("include_deleted search = %v", response["matches"])
+	}
+
+	cache.Lock()
+	cache.index = buildTrigramIndex(cache.data)
+	cache.Unlock()
+	_, response := searchJSON(t, "/search?term=db/old&include_deleted=true&details=true")
+	matches := response["matches"].([]interface{})
+	if len(matches) != 1 {
+		t.Fatalf("matches = %v, expected prod/db/old", matches)
+	}
+	detail := matches[0].(map[string]interface{})
+	if detail["deleted"] != true || detail["metadata"].(map[string]interface{})["deletion_time"] != "2024-05-01T00:00:00Z" {
+		t.Errorf("detail = %v", detail)
+	}
+
+	if tree := buildPathTree("prod/db", nil); tree.SecretCount != 1 {
+		t.Errorf("tree secret count = %d, expected deleted secrets left out", tree.SecretCount)
+	}
+}
+
+func TestDeletedReport(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.IndexMetadata = true
+	setupTestCache()
+	deleted := func(version int, deletion time.Time, destroyed bool, owner string) *SecretKeys {
+		meta := &SecretMetadata{CurrentVersion: version, DeletionTime: deletion, Destroyed: destroyed}
+		if owner != "" {
+			meta.CustomMetadata = map[string]string{"owner": owner}
+		}
+		return &SecretKeys{Metadata: meta, Deleted: true}
+	}
+	cache.Lock()
+	cache.data["prod/db/old"] = deleted(3, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), false, "payments")
+	cache.data["prod/api/older"] = deleted(7, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), false, "")
+	cache.data["staging/burnt"] = deleted(1, time.Time{}, true, "")
 	cache.Unlock()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		deletedReportHandler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	paths := func(url string) string {
+		t.Helper()
+		rec := get(url)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", url, rec.Code, rec.Body.String())
+		}
+		var report DeletedReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range report.Secrets {
+			got = append(got, fmt.Sprintf("%s@%d", s.Path, s.Version))
+		}
+		if report.Count != len(got) {
+			t.Errorf("count = %d, expected %d", report.Count, len(got))
+		}
+		return fmt.Sprint(got)
+	}
+
+	if got := paths("/reports/deleted"); got != "[prod/api/older@7 prod/db/old@3]" {
+		t.Errorf("deleted report = %s, expected the undeletable secrets, oldest deletion first", got)
+	}
+	if got := paths("/reports/deleted?include_destroyed=true"); got != "[prod/api/older@7 prod/db/old@3 staging/burnt@1]" {
+		t.Errorf("deleted report with destroyed = %s", got)
+	}
+	if got := paths("/reports/deleted?meta.owner=payments"); got != "[prod/db/old@3]" {
+		t.Errorf("deleted report for payments = %s", got)
+	}
+
+	rec := get("/reports/deleted?in_path=db&format=csv")
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || fmt.Sprint(rows[1]) != "[prod/db/old 3 2024-05-01T00:00:00Z false payments]" {
+		t.Errorf("CSV rows = %v", rows)
+	}
+	if rec := get("/reports/deleted?path_glob={x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid glob: expected status 400, got %d", rec.Code)
+	}
 }
 
-func containsAllKeys(keys []string, expected []string) bool {
-	keySet := make(map[string]bool)
-	for _, k := range keys {
-		keySet[k] = true
+func TestMetadataOnlyCrawl(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.MetadataOnly, cfg.IndexMetadata, cfg.HistoryVersions = true, true, 0
+
+	metadata := map[string]map[string]interface{}{
+		"prod/app": {"current_version": 2, "updated_time": "2024-06-01T12:00:00Z", "custom_metadata": map[string]interface{}{"owner": "payments"}},
+		"prod/gone": {"current_version": 4, "versions": map[string]interface{}{
+			"4": map[string]interface{}{"deletion_time": "2024-05-01T00:00:00Z", "destroyed": false},
+		}},
+		"prod/later": {"current_version": 1, "versions": map[string]interface{}{
+			"1": map[string]interface{}{"deletion_time": "2999-01-01T00:00:00Z", "destroyed": false},
+		}},
 	}
-	for _, e := range expected {
-		if !keySet[e] {
-			return false
+	useVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/kv/data/"):
+			t.Errorf("metadata-only crawl read secret data at %s", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path == "/v1/kv/metadata":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": []string{"prod/"}}})
+		case r.URL.Path == "/v1/kv/metadata/prod" || r.URL.Query().Get("list") == "true":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": []string{"app", "gone", "later", "locked"}}})
+		default:
+			data, ok := metadata[strings.TrimPrefix(r.URL.Path, "/v1/kv/metadata/")]
+			if !ok {
+				writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
 		}
+	})
+
+	if err := rebuildCache(context.Background()); err != nil {
+		t.Fatalf("rebuildCache() error = %v", err)
+	}
+	cache.RLock()
+	app, gone, later, locked := cache.data["prod/app"], cache.data["prod/gone"], cache.data["prod/later"], cache.data["prod/locked"]
+	cache.RUnlock()
+	if app == nil || app.isDeleted() || len(app.AllKeys) != 0 || app.Metadata.CustomMetadata["owner"] != "payments" {
+		t.Errorf("prod/app = %+v", app)
+	}
+	if !gone.isDeleted() {
+		t.Errorf("prod/gone should be deleted: %+v", gone)
+	}
+	if later.isDeleted() {
+		t.Errorf("prod/later is only scheduled for deletion: %+v", later)
+	}
+	if locked != nil {
+		t.Errorf("prod/locked has unreadable metadata and should be skipped, got %+v", locked)
+	}
+
+	for url, expected := range map[string]string{
+		"/search?in_path=prod":        "[prod/app prod/later]",
+		"/search?meta.owner=payments": "[prod/app]",
+		"/search?term=app&scope=path": "[prod/app]",
+		"/search?q=path:prod/app":     "[prod/app]",
+	} {
+		if code, response := searchJSON(t, url); code != http.StatusOK || fmt.Sprint(response["matches"]) != expected {
+			t.Errorf("%s: status %d, matches %v, expected %s", url, code, response["matches"], expected)
+		}
+	}
+	for _, url := range []string{
+		"/search?term=password",
+		"/search?regexp=^api_&scope=keys",
+		"/search?q=key:password",
+		"/search?q=path:prod+AND+token",
+	} {
+		if code, response := searchJSON(t, url); code != http.StatusBadRequest || response["error"] != errKeysNotIndexed.Error() {
+			t.Errorf("%s: status %d, response %v, expected key search to be rejected", url, code, response)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	suggestHandler(rec, httptest.NewRequest(http.MethodGet, "/suggest?kind=key&prefix=pa", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("key suggestions: expected status 400, got %d", rec.Code)
+	}
+	if tree, ok := buildSecretKeyTree("prod/app"); !ok || !tree.MetadataOnly || tree.Metadata == nil {
+		t.Errorf("key tree = %+v", tree)
+	}
+	if status := cacheStatus(); status["metadata_only"] != true {
+		t.Errorf("status metadata_only = %v", status["metadata_only"])
 	}
-	return true
 }
 
-func containsString(slice []string, s string) bool {
-	for _, item := range slice {
-		if item == s {
-			return true
+func TestDeniedReport(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.IndexMetadata, cfg.HistoryVersions, cfg.MetadataOnly = false, 0, false
+
+	lists := map[string][]string{
+		"":     {"prod/", "team/", "open"},
+		"prod": {"app", "db/", "secret-a"},
+		"team": {"x", "y"},
+	}
+	readable := map[string]bool{"open": true, "prod/app": true}
+	denyRoot := false
+	useVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		forbidden := func() {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		}
+		if folder, ok := strings.CutPrefix(r.URL.Path, "/v1/kv/metadata"); ok {
+			keys, ok := lists[strings.Trim(folder, "/")]
+			if !ok || denyRoot {
+				forbidden()
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+			return
+		}
+		if !readable[strings.TrimPrefix(r.URL.Path, "/v1/kv/data/")] {
+			forbidden()
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"data": map[string]interface{}{"k": "v"}}})
+	})
+
+	if err := rebuildCache(context.Background()); err != nil {
+		t.Fatalf("rebuildCache() error = %v, expected a folder that cannot be listed to be skipped", err)
+	}
+	cache.RLock()
+	indexed := len(cache.data)
+	cache.RUnlock()
+	if indexed != 2 {
+		t.Errorf("indexed %d secrets, expected open and prod/app", indexed)
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		deniedReportHandler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	var report DeniedReport
+	if err := json.Unmarshal(get("/reports/denied").Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.DeniedSecrets != 3 || report.DeniedFolders != 1 {
+		t.Errorf("denied = %d secrets, %d folders, expected 3 and 1", report.DeniedSecrets, report.DeniedFolders)
+	}
+	var describe func(n *DeniedNode) string
+	describe = func(n *DeniedNode) string {
+		s := fmt.Sprintf("%s(%d,%d", n.Path, n.DeniedSecrets, n.DeniedFolders)
+		if n.ListDenied {
+			s += ",list_denied"
 		}
+		for _, c := range n.Children {
+			s += " " + describe(c)
+		}
+		return s + ")"
+	}
+	expected := "(3,1 prod/(1,1 prod/db/(0,1,list_denied) prod/secret-a(1,0)) team/(2,0 team/x(1,0) team/y(1,0)))"
+	if got := describe(report.Tree); got != expected {
+		t.Errorf("tree = %s\nexpected %s", got, expected)
+	}
+
+	report = DeniedReport{}
+	if err := json.Unmarshal(get("/reports/denied?path=team/").Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if got := describe(report.Tree); got != "team/(2,0 team/x(1,0) team/y(1,0))" || report.Tree.Name != "team" {
+		t.Errorf("tree under team/ = %s, name %q", got, report.Tree.Name)
+	}
+
+	rows, err := csv.NewReader(get("/reports/denied?format=csv").Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rows) != "[[path type] [prod/db/ folder] [prod/secret-a secret] [team/x secret] [team/y secret]]" {
+		t.Errorf("CSV rows = %v", rows)
+	}
+	if status := cacheStatus(); status["denied_secrets"] != 3 || status["denied_folders"] != 1 {
+		t.Errorf("status denied = %v, %v", status["denied_secrets"], status["denied_folders"])
+	}
+
+	denyRoot = true
+	if err := rebuildCache(context.Background()); err == nil {
+		t.Error("rebuildCache() should fail when the mount root cannot be listed")
 	}
-	return false
 }
 
-type testError struct {
-	msg string
+func TestCallerToken(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.RequireCallerToken, cfg.CapabilitiesTTL = true, time.Minute
+	capabilities.Lock()
+	capabilities.callers = make(map[string]*callerCapabilities)
+	capabilities.Unlock()
+	setupTestCache()
+
+	// alice may read prod/db/credentials and list staging/db/, so she sees
+	// those two secrets but not prod/api/keys, and only the keys of the first.
+	grants := map[string][]string{
+		"kv/data/prod/db/credentials": {"read"},
+		"kv/metadata/staging/db/":     {"list"},
+	}
+	var requests, largestBatch, asked int
+	useVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/sys/capabilities-self" {
+			t.Errorf("unexpected Vault request %s %s", r.Method, r.URL.Path)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "alice" {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		var body struct{ Paths []string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		requests++
+		asked += len(body.Paths)
+		largestBatch = max(largestBatch, len(body.Paths))
+		data := map[string]interface{}{}
+		for _, p := range body.Paths {
+			caps, ok := grants[p]
+			if !ok {
+				caps = []string{"deny"}
+			}
+			data[p] = caps
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+	})
+
+	call := func(handler http.HandlerFunc, url, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if token != "" {
+			req.Header.Set(callerTokenHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		withCaller(handler)(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) map[string]interface{} {
+		t.Helper()
+		var response map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+		}
+		return response
+	}
+
+	if rec := call(searchHandler, "/search?term=password", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("search without a token: status %d, expected 401", rec.Code)
+	}
+	if rec := call(searchHandler, "/search?term=password", "mallory"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("search with a rejected token: status %d, expected 401", rec.Code)
+	}
+
+	rec := call(searchHandler, "/search?term=key", "alice")
+	if response := decode(rec); rec.Code != http.StatusOK || response["total"] != float64(0) || response["did_you_mean"] != nil {
+		t.Errorf("search for prod/api/keys' keys = %d %v, expected nothing", rec.Code, response)
+	}
+	rec = call(searchHandler, "/search?in_path=db&details=true&term=o", "alice")
+	if response := decode(rec); fmt.Sprint(response["total"]) != "2" {
+		t.Errorf("search in db = %v", response)
+	} else {
+		for _, d := range response["matches"].([]interface{}) {
+			detail := d.(map[string]interface{})
+			keys := len(detail["matched_keys"].([]interface{})) > 0
+			if listed := detail["path"] == "staging/db/config"; listed == keys {
+				t.Errorf("%v matched keys %v, expected key names only where alice may read", detail["path"], detail["matched_keys"])
+			}
+		}
+	}
+	requestsBefore := requests
+	rec = call(searchHandler, "/search?term=password", "alice")
+	if response := decode(rec); fmt.Sprint(response["matches"]) != "[prod/db/credentials]" {
+		t.Errorf("search for password = %v, expected no key hits in the listed-only secret", response["matches"])
+	}
+	rec = call(searchHandler, "/search?q=key:port", "alice")
+	if response := decode(rec); response["total"] != float64(0) {
+		t.Errorf("search for key:port = %v, expected no key hits in the listed-only secret", response["matches"])
+	}
+	rec = call(searchHandler, "/search?term=config", "alice")
+	if response := decode(rec); fmt.Sprint(response["matches"]) != "[staging/db/config]" {
+		t.Errorf("search for config = %v, expected the listed-only secret by its path", response["matches"])
+	}
+	if requests != requestsBefore {
+		t.Errorf("repeated searches asked Vault %d more times, expected cached capabilities", requests-requestsBefore)
+	}
+
+	rec = call(treeHandler, "/tree", "alice")
+	if response := decode(rec); response["secret_count"] != float64(2) {
+		t.Errorf("tree = %v, expected the two visible secrets", response)
+	}
+	if rec := call(treeHandler, "/tree?path=prod/api/", "alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("tree of an invisible folder: status %d, expected 404", rec.Code)
+	}
+	if rec := call(secretKeysHandler, "/secrets/prod/api/keys/keys", "alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("keys of an invisible secret: status %d, expected 404", rec.Code)
+	}
+	if rec := call(secretKeysHandler, "/secrets/prod/db/credentials/keys", "alice"); rec.Code != http.StatusOK {
+		t.Errorf("keys of a readable secret: status %d", rec.Code)
+	}
+	if rec := call(secretKeysHandler, "/secrets/staging/db/config/keys", "alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("keys of a listed-only secret: status %d, expected 404", rec.Code)
+	}
+
+	rec = call(suggestHandler, "/suggest?kind=key&prefix=api", "alice")
+	if response := decode(rec); fmt.Sprint(response["suggestions"]) != "[]" {
+		t.Errorf("key suggestions = %v, expected none from invisible secrets", response["suggestions"])
+	}
+	// The caller's vocabulary is kept until the next rebuild, so later
+	// keystrokes check no paths, even with the capabilities forgotten.
+	capabilities.Lock()
+	capabilities.callers[newCaller("alice").id].entries = make(map[string]capabilityEntry)
+	capabilities.Unlock()
+	requestsBefore = requests
+	rec = call(suggestHandler, "/suggest?kind=key&prefix=pass", "alice")
+	if response := decode(rec); fmt.Sprint(response["suggestions"]) != "[map[secrets:1 value:password]]" || requests != requestsBefore {
+		t.Errorf("key suggestions = %v after %d Vault requests, expected the cached vocabulary", response["suggestions"], requests-requestsBefore)
+	}
+	cache.RLock()
+	data := cache.data
+	cache.RUnlock()
+	swapTestCache(data)
+	call(suggestHandler, "/suggest?kind=key&prefix=pass", "alice")
+	if requests == requestsBefore {
+		t.Error("key suggestions after a rebuild should check the paths again")
+	}
+	rec = call(suggestHandler, "/suggest?prefix=prod/", "alice")
+	if response := decode(rec); fmt.Sprint(response["suggestions"]) != "[map[secrets:1 type:folder value:prod/db/]]" {
+		t.Errorf("path suggestions = %v", response["suggestions"])
+	}
+
+	// None of the secrets has an update time, so all are unknown; only those
+	// are checked, and the count of every checked secret is left out.
+	rec = call(staleReportHandler, "/reports/stale?older_than=1d", "alice")
+	if response := decode(rec); response["unknown_count"] != float64(2) || response["secret_count"] != nil {
+		t.Errorf("stale report = %v, expected the two visible secrets", response)
+	}
+	capabilities.Lock()
+	capabilities.callers = make(map[string]*callerCapabilities)
+	capabilities.Unlock()
+	asked = 0
+	rec = call(deletedReportHandler, "/reports/deleted", "alice")
+	if response := decode(rec); response["count"] != float64(0) || asked != 0 {
+		t.Errorf("deleted report = %v after asking about %d paths, expected no deleted secrets to check", response, asked)
+	}
+	call(staleReportHandler, "/reports/stale?older_than=1d&in_path=staging", "alice")
+	if asked != 2 {
+		t.Errorf("stale report in staging asked about %d Vault paths, expected only the data and folder paths of staging/db/config", asked)
+	}
+
+	if largestBatch > capabilitiesBatchSize {
+		t.Errorf("a capabilities request asked about %d paths, more than %d", largestBatch, capabilitiesBatchSize)
+	}
+
+	cfg.RequireCallerToken = false
+	if rec := call(searchHandler, "/search?term=key", ""); decode(rec)["total"] != float64(1) {
+		t.Errorf("without REQUIRE_CALLER_TOKEN results should not be filtered: %s", rec.Body.String())
+	}
 }
 
-func (e *testError) Error() string {
-	return e.msg
+func TestCapabilityCacheEviction(t *testing.T) {
+	cc := &capabilityCache{callers: make(map[string]*callerCapabilities)}
+	start := time.Now()
+	for i := 0; i < capabilityCacheCallers; i++ {
+		cc.callerLocked(fmt.Sprint("caller", i), start.Add(time.Duration(i)*time.Second))
+	}
+	// caller0 was seen last, so caller1 is now the least recently seen.
+	cc.callerLocked("caller0", start.Add(time.Hour))
+	cc.callerLocked("newcomer", start.Add(2*time.Hour))
+
+	if len(cc.callers) != capabilityCacheCallers {
+		t.Errorf("cached callers = %d, expected the cap of %d", len(cc.callers), capabilityCacheCallers)
+	}
+	for id, kept := range map[string]bool{"caller0": true, "caller1": false, "caller2": true, "newcomer": true} {
+		if _, ok := cc.callers[id]; ok != kept {
+			t.Errorf("%s cached = %v, expected %v", id, ok, kept)
+		}
+	}
 }
 
-func createError(msg string) error {
-	return &testError{msg: msg}
+func TestCapabilityCacheEntries(t *testing.T) {
+	cc := &capabilityCache{callers: make(map[string]*callerCapabilities)}
+	start := time.Now()
+	fill := func(id string, n int, seen time.Time) {
+		cached := cc.callerLocked(id, seen)
+		for i := 0; i < n; i++ {
+			cached.entries[fmt.Sprint("kv/data/", id, i)] = capabilityEntry{}
+		}
+	}
+	fill("old", capabilityCacheEntries/2, start)
+	fill("recent", capabilityCacheEntries/2, start.Add(time.Second))
+	fill("new", 10, start.Add(2*time.Second))
+	cc.trimLocked("new")
+	for id, kept := range map[string]bool{"old": false, "recent": true, "new": true} {
+		if _, ok := cc.callers[id]; ok != kept {
+			t.Errorf("%s cached = %v, expected %v", id, ok, kept)
+		}
+	}
+
+	// A caller that alone asked about more paths than the cap keeps only as
+	// many answers as fit.
+	fill("large", capabilityCacheEntries+10, start.Add(3*time.Second))
+	cc.trimLocked("large")
+	if len(cc.callers) != 1 || len(cc.callers["large"].entries) != capabilityCacheEntries {
+		t.Errorf("callers = %d, entries = %d, expected only the large caller at the cap of %d",
+			len(cc.callers), len(cc.callers["large"].entries), capabilityCacheEntries)
+	}
+}
+
+func TestCallerTokenPaging(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.RequireCallerToken, cfg.CapabilitiesTTL = true, time.Minute
+	capabilities.Lock()
+	capabilities.callers = make(map[string]*callerCapabilities)
+	capabilities.Unlock()
+
+	// The caller may read every other one of 1000 matching secrets.
+	data := make(map[string]*SecretKeys)
+	for i := 0; i < 1000; i++ {
+		p := fmt.Sprintf("app/s%04d", i)
+		data[p] = &SecretKeys{AllKeys: []string{"password"}, SearchString: p + " password "}
+	}
+	cache.Lock()
+	cache.data, cache.index = data, nil
+	cache.Unlock()
+
+	// Batches are checked concurrently.
+	var mu sync.Mutex
+	var requests, lockedDuringCheck int
+	useVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		locked := !cache.TryLock()
+		if !locked {
+			cache.Unlock()
+		}
+		var body struct{ Paths []string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		requests++
+		if locked {
+			lockedDuringCheck++
+		}
+		mu.Unlock()
+		caps := map[string]interface{}{}
+		for _, p := range body.Paths {
+			var n int
+			if _, err := fmt.Sscanf(p, "kv/data/app/s%04d", &n); err == nil && n%2 == 0 {
+				caps[p] = []string{"read"}
+			} else {
+				caps[p] = []string{"deny"}
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": caps})
+	})
+
+	search := func(url string) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set(callerTokenHeader, "alice")
+		rec := httptest.NewRecorder()
+		withCaller(searchHandler)(rec, req)
+		var response map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", url, rec.Code, rec.Body.String())
+		}
+		return response
+	}
+
+	response := search("/search?term=password&limit=5")
+	if fmt.Sprint(response["matches"]) != "[app/s0000 app/s0002 app/s0004 app/s0006 app/s0008]" {
+		t.Errorf("first page = %v", response["matches"])
+	}
+	if response["total_partial"] != true || response["next_cursor"] == nil || response["total"].(float64) < 6 {
+		t.Errorf("first page: total %v, total_partial %v, next_cursor %v", response["total"], response["total_partial"], response["next_cursor"])
+	}
+	// One chunk of capabilitiesBatchSize secrets, with two Vault paths each.
+	if requests != 2 {
+		t.Errorf("first page asked Vault %d times, expected only the first chunk checked", requests)
+	}
+
+	response = search("/search?term=password")
+	if response["total"] != float64(500) || response["total_partial"] != nil {
+		t.Errorf("unlimited search: total %v, total_partial %v", response["total"], response["total_partial"])
+	}
+	if lockedDuringCheck > 0 {
+		t.Errorf("the cache lock was held during %d capability checks", lockedDuringCheck)
+	}
+}
+
+func TestSearchCapabilities(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	defer restoreCache()
+	defer func(c Config) { *cfg = c }(*cfg)
+	cfg.RequireCallerToken, cfg.CapabilitiesTTL = false, time.Minute
+	capabilities.Lock()
+	capabilities.callers = make(map[string]*callerCapabilities)
+	capabilities.Unlock()
+	setupTestCache()
+
+	grants := map[string]map[string][]string{
+		"service": {"kv/data/prod/db/credentials": {"root"}, "kv/data/staging/db/config": {"read"}},
+		"alice":   {"kv/data/prod/db/credentials": {"read", "update"}, "kv/metadata/prod/db/": {"list"}},
+	}
+	requests, lockedDuringCheck := 0, 0
+	useVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if cache.TryLock() {
+			cache.Unlock()
+		} else {
+			lockedDuringCheck++
+		}
+		policy, ok := grants[r.Header.Get("X-Vault-Token")]
+		if !ok || r.URL.Path != "/v1/sys/capabilities-self" {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		requests++
+		var body struct{ Paths []string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		data := map[string]interface{}{}
+		for _, p := range body.Paths {
+			caps, ok := policy[p]
+			if !ok {
+				caps = []string{"deny"}
+			}
+			data[p] = caps
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+	})
+	vaultClient.SetToken("service")
+
+	search := func(url, token string) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if token != "" {
+			req.Header.Set(callerTokenHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		searchHandler(rec, req)
+		var response map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %v", url, rec.Code, response)
+		}
+		return response
+	}
+
+	if response := search("/search?in_path=db", ""); response["capabilities"] != nil {
+		t.Errorf("capabilities without capabilities=true: %v", response["capabilities"])
+	}
+
+	response := search("/search?in_path=db&capabilities=true", "")
+	expected := "map[prod/db/credentials:map[create:true delete:true list:false read:true update:true] " +
+		"staging/db/config:map[create:false delete:false list:false read:true update:false]]"
+	if got := fmt.Sprint(response["capabilities"]); got != expected {
+		t.Errorf("service token capabilities = %s\nexpected %s", got, expected)
+	}
+
+	response = search("/search?in_path=db&capabilities=true&details=true", "alice")
+	matches := response["matches"].([]interface{})
+	var got []string
+	for _, m := range matches {
+		detail := m.(map[string]interface{})
+		got = append(got, fmt.Sprint(detail["path"], " ", detail["capabilities"]))
+	}
+	expectedDetails := "[prod/db/credentials map[create:false delete:false list:true read:true update:true] " +
+		"staging/db/config map[create:false delete:false list:false read:false update:false]]"
+	if fmt.Sprint(got) != expectedDetails {
+		t.Errorf("caller capabilities = %v\nexpected %s", got, expectedDetails)
+	}
+	if response["capabilities"] != nil {
+		t.Error("details=true should carry capabilities in each match only")
+	}
+	if lockedDuringCheck > 0 {
+		t.Errorf("the cache lock was held during %d capability checks", lockedDuringCheck)
+	}
+
+	before := requests
+	search("/search?term=password&capabilities=true", "alice")
+	if requests != before {
+		t.Errorf("cached capabilities were asked for again (%d requests)", requests-before)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/search?in_path=db&capabilities=true", nil)
+	req.Header.Set(callerTokenHeader, "mallory")
+	rec := httptest.NewRecorder()
+	searchHandler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("rejected caller token: status %d, expected 401", rec.Code)
+	}
 }
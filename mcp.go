@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// The MCP server speaks JSON-RPC 2.0 over newline-delimited stdio, as described
+// by the Model Context Protocol. Only the tools capability is implemented.
+
+const mcpLatestProtocolVersion = "2025-06-18"
+
+var mcpSupportedProtocolVersions = map[string]bool{
+	"2024-11-05": true,
+	"2025-03-26": true,
+	"2025-06-18": true,
+}
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+const mcpMaxMessageSize = 4 * 1024 * 1024
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+	handler     func(ctx context.Context, args map[string]interface{}) (interface{}, error)
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError"`
+}
+
+type mcpServer struct {
+	out   io.Writer
+	outMu sync.Mutex
+	tools []mcpTool
+}
+
+func newMCPServer(out io.Writer) *mcpServer {
+	return &mcpServer{out: out, tools: mcpTools()}
+}
+
+// serveMCP reads requests from in until EOF or ctx is cancelled and writes
+// responses to out. Requests are handled one at a time in arrival order.
+func serveMCP(ctx context.Context, in io.Reader, out io.Writer) error {
+	s := newMCPServer(out)
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), mcpMaxMessageSize)
+
+	for scanner.Scan() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		s.handleMessage(ctx, line)
+	}
+	return scanner.Err()
+}
+
+func (s *mcpServer) handleMessage(ctx context.Context, line []byte) {
+	var req rpcRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		logger.WithError(err).Warn("Failed to parse MCP message")
+		s.writeError(json.RawMessage("null"), rpcParseError, "parse error")
+		return
+	}
+
+	// Notifications carry no id and never get a response.
+	isNotification := len(req.ID) == 0
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		if !isNotification {
+			s.writeError(req.ID, rpcInvalidRequest, "invalid request")
+		}
+		return
+	}
+
+	logEntry := logger.WithField("mcp_method", req.Method)
+	logEntry.Debug("MCP request received")
+
+	result, rpcErr := s.dispatch(ctx, &req)
+	if isNotification {
+		return
+	}
+	if rpcErr != nil {
+		logEntry.WithField("error_code", rpcErr.Code).Warn(rpcErr.Message)
+		s.writeError(req.ID, rpcErr.Code, rpcErr.Message)
+		return
+	}
+	s.write(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result})
+}
+
+func (s *mcpServer) dispatch(ctx context.Context, req *rpcRequest) (interface{}, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		return s.initialize(req.Params)
+	case "notifications/initialized", "notifications/cancelled":
+		return nil, nil
+	case "ping":
+		return map[string]interface{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": s.tools}, nil
+	case "tools/call":
+		return s.callTool(ctx, req.Params)
+	default:
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method not found: %s", req.Method)}
+	}
+}
+
+func (s *mcpServer) initialize(raw json.RawMessage) (interface{}, *rpcError) {
+	var params struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "invalid initialize params"}
+		}
+	}
+
+	protocolVersion := mcpLatestProtocolVersion
+	if mcpSupportedProtocolVersions[params.ProtocolVersion] {
+		protocolVersion = params.ProtocolVersion
+	}
+
+	return map[string]interface{}{
+		"protocolVersion": protocolVersion,
+		"capabilities": map[string]interface{}{
+			"tools": map[string]interface{}{},
+		},
+		"serverInfo": map[string]interface{}{
+			"name":    "vault-search",
+			"version": version,
+		},
+		"instructions": "Searches HashiCorp Vault secret paths and key names from an in-memory index. Secret values are never indexed or returned.",
+	}, nil
+}
+
+func (s *mcpServer) callTool(ctx context.Context, raw json.RawMessage) (interface{}, *rpcError) {
+	var params struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "invalid tools/call params"}
+	}
+
+	var tool *mcpTool
+	for i := range s.tools {
+		if s.tools[i].Name == params.Name {
+			tool = &s.tools[i]
+			break
+		}
+	}
+	if tool == nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("unknown tool: %s", params.Name)}
+	}
+
+	logger.WithField("mcp_tool", tool.Name).Info("MCP tool called")
+
+	// Tool failures are reported in the result so the model can see them.
+	out, err := tool.handler(ctx, params.Arguments)
+	if err != nil {
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true}, nil
+	}
+
+	text, err := json.Marshal(out)
+	if err != nil {
+		logger.Errorf("Failed to encode MCP tool result: %v", err)
+		return nil, &rpcError{Code: rpcInternalError, Message: "internal error"}
+	}
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: string(text)}}}, nil
+}
+
+func (s *mcpServer) write(resp rpcResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		logger.Errorf("Failed to encode MCP response: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	if _, err := s.out.Write(data); err != nil {
+		logger.Errorf("Failed to write MCP response: %v", err)
+	}
+}
+
+func (s *mcpServer) writeError(id json.RawMessage, code int, message string) {
+	s.write(rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{Code: code, Message: message}})
+}
+
+func mcpTools() []mcpTool {
+	stringProp := func(description string) map[string]interface{} {
+		return map[string]interface{}{"type": "string", "description": description}
+	}
+	stringListProp := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			},
+			"description": description,
+		}
+	}
+
+	return []mcpTool{
+		{
+			Name:        "search_secrets",
+			Description: "Find Vault secret paths whose path or key names match a term or regular expression. Returns paths only, never values.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"term":         stringProp("Case-insensitive substring matched against the path and key names"),
+					"regexp":       stringProp("Regular expression matched against the path and key names; mutually exclusive with term"),
+					"q":            stringProp("Boolean query, e.g. key:password AND path:prod/* NOT path:*/legacy/*; cannot be combined with term or regexp"),
+					"scope":        map[string]interface{}{"type": "string", "enum": []string{"path", "keys", "all"}, "description": "Match term/regexp against the path, each key name, or both individually"},
+					"in_path":      stringListProp("Restrict results to paths containing this path segment, e.g. prod or prod/db; several values are ORed"),
+					"path_glob":    stringListProp("Restrict results to paths matching a doublestar glob, e.g. prod/*/db/**; several values are ORed"),
+					"exclude_path": stringListProp("Drop paths containing this path segment, e.g. archive"),
+					"exclude_glob": stringListProp("Drop paths matching a doublestar glob, e.g. **/archive/**"),
+					"meta": map[string]interface{}{
+						"type":                 "object",
+						"additionalProperties": stringListProp("Accepted values; * matches any"),
+						"description":          "custom_metadata filters, e.g. {\"owner\": \"payments\"}; keys are ANDed, case-insensitive",
+					},
+					"updated_after":   stringProp("Only secrets updated after this RFC3339 time, date or age such as 30d"),
+					"updated_before":  stringProp("Only secrets last updated before this RFC3339 time, date or age such as 365d"),
+					"created_after":   stringProp("Only secrets created after this RFC3339 time, date or age"),
+					"created_before":  stringProp("Only secrets created before this RFC3339 time, date or age"),
+					"sort":            map[string]interface{}{"type": "string", "enum": []string{"asc", "desc", "relevance", sortUpdated}, "description": "updated puts the most recently updated secrets first"},
+					"versions":        map[string]interface{}{"type": "string", "enum": []string{versionsCurrent, versionsAll}, "description": "all also matches key names of older secret versions and reports which versions matched"},
+					"details":         map[string]interface{}{"type": "boolean", "description": "Return matched key names and highlight offsets for each path"},
+					"fuzzy":           map[string]interface{}{"type": "boolean", "description": "Also match key names and path segments within a few typos of term or of each q term"},
+					"include_deleted": map[string]interface{}{"type": "boolean", "description": "Also return secrets whose current version is deleted or destroyed"},
+					"capabilities":    map[string]interface{}{"type": "boolean", "description": "Say for each match whether the service token may read, create, update, delete and list it"},
+					"limit":           map[string]interface{}{"type": "integer", "minimum": 1, "description": "Maximum number of matches per page"},
+					"cursor":          stringProp("next_cursor from the previous page of the same search"),
+				},
+			},
+			handler: mcpSearchTool,
+		},
+		{
+			Name:        "cache_status",
+			Description: "Report the state of the secret index: age, size, rebuild progress and number of secrets and keys.",
+			InputSchema: map[string]interface{}{"type": "object", "properties": map[string]interface{}{}},
+			handler: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+				return cacheStatus(), nil
+			},
+		},
+		{
+			Name:        "path_tree",
+			Description: "List the folders and secrets directly under a path, with the number of secrets and keys below each folder and when they were last updated.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": stringProp("Folder to list, e.g. prod/ ; empty for the mount root"),
+				},
+			},
+			handler: mcpPathTreeTool,
+		},
+		{
+			Name:        "list_secret_keys",
+			Description: "List the key names (including keys nested in JSON, YAML, .env and other documents held in values) stored in one secret. Values are never returned.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": stringProp("Full secret path, e.g. prod/db/credentials"),
+				},
+				"required": []string{"path"},
+			},
+			handler: mcpKeyListTool,
+		},
+	}
+}
+
+func mcpStringArg(args map[string]interface{}, name string) (string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("argument '%s' must be a string", name)
+	}
+	return s, nil
+}
+
+// mcpStringListArg accepts a single string or an array of strings.
+func mcpStringListArg(args map[string]interface{}, name string) ([]string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("argument '%s' must be a string or an array of strings", name)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("argument '%s' must be a string or an array of strings", name)
+}
+
+func mcpSearchTool(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	query := url.Values{}
+	for _, name := range append([]string{"term", "regexp", "q", "scope", "sort", "cursor", "versions"}, timeFilterParams...) {
+		v, err := mcpStringArg(args, name)
+		if err != nil {
+			return nil, err
+		}
+		if v != "" {
+			query.Set(name, v)
+		}
+	}
+	for _, name := range []string{"in_path", "path_glob", "exclude_path", "exclude_glob"} {
+		values, err := mcpStringListArg(args, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 0 {
+			query[name] = values
+		}
+	}
+
+	if err := metaFilterArgs(args, query); err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"details", "fuzzy", "include_deleted", "capabilities"} {
+		if v, ok := args[name].(bool); ok && v {
+			query.Set(name, "true")
+		}
+	}
+	if limit, ok := args["limit"].(float64); ok {
+		query.Set("limit", strconv.Itoa(int(limit)))
+	}
+
+	params, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var regex *regexp.Regexp
+	if params.Regexp != "" {
+		regex, err = regexp.Compile(params.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression for 'regexp': %v", err)
+		}
+	}
+
+	searchCtx, cancel := context.WithTimeout(ctx, cfg.SearchTimeout)
+	defer cancel()
+
+	result, err := performSearch(params, regex, searchCtx)
+	if err != nil {
+		if errors.Is(err, errCursorExpired) {
+			return nil, err
+		}
+		if searchCtx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("search timeout exceeded")
+		}
+		return nil, fmt.Errorf("error during search: %v", err)
+	}
+
+	resp := searchResponse(params, result)
+	resp["vault_ui_base"] = result.VaultUIBase
+	return resp, nil
+}
+
+func mcpPathTreeTool(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	prefix, err := mcpStringArg(args, "path")
+	if err != nil {
+		return nil, err
+	}
+	return buildPathTree(prefix, nil), nil
+}
+
+func mcpKeyListTool(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	secretPath, err := mcpStringArg(args, "path")
+	if err != nil {
+		return nil, err
+	}
+	if secretPath == "" {
+		return nil, fmt.Errorf("argument 'path' is required")
+	}
+	if cfg.MetadataOnly {
+		return nil, errKeysNotIndexed
+	}
+
+	keys, ok := lookupSecretKeys(secretPath)
+	if !ok {
+		return nil, fmt.Errorf("secret not found in cache: %s", secretPath)
+	}
+	return map[string]interface{}{
+		"path": secretPath,
+		"keys": keys,
+	}, nil
+}
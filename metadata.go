@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const metaFilterPrefix = "meta."
+
+// SecretMetadata is the KV v2 metadata of a secret. CurrentVersion,
+// UpdatedTime and the deletion state are also known from a plain read; the
+// rest needs the metadata endpoint.
+type SecretMetadata struct {
+	CurrentVersion int               `json:"current_version,omitempty"`
+	MaxVersions    int               `json:"max_versions,omitempty"`
+	CASRequired    bool              `json:"cas_required,omitempty"`
+	CreatedTime    time.Time         `json:"created_time,omitzero"`
+	UpdatedTime    time.Time         `json:"updated_time,omitzero"`
+	CustomMetadata map[string]string `json:"custom_metadata,omitempty"`
+	// DeletionTime and Destroyed describe the current version. A deletion
+	// time in the future is a scheduled delete_version_after.
+	DeletionTime time.Time `json:"deletion_time,omitzero"`
+	Destroyed    bool      `json:"destroyed,omitempty"`
+}
+
+func (k *SecretKeys) metadata() *SecretMetadata {
+	if k == nil {
+		return nil
+	}
+	return k.Metadata
+}
+
+// updatedTime returns when the secret was last written, or the zero time.
+func (k *SecretKeys) updatedTime() time.Time {
+	if k == nil || k.Metadata == nil {
+		return time.Time{}
+	}
+	return k.Metadata.UpdatedTime
+}
+
+// metadataFromRead takes what a KV v2 read says about the version it
+// returned: its number, its creation time, which is when the secret was last
+// updated, and whether it is deleted.
+func metadataFromRead(data map[string]interface{}) *SecretMetadata {
+	version, ok := data["metadata"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	meta := &SecretMetadata{
+		CurrentVersion: jsonInt(version["version"]),
+		UpdatedTime:    jsonTime(version["created_time"]),
+		DeletionTime:   jsonTime(version["deletion_time"]),
+	}
+	meta.Destroyed, _ = version["destroyed"].(bool)
+	if meta.CurrentVersion == 0 && meta.UpdatedTime.IsZero() {
+		return nil
+	}
+	return meta
+}
+
+// secretMetadata returns the metadata of a secret: from the metadata endpoint
+// with cfg.IndexMetadata, otherwise or when that fails from read, the data of
+// a KV v2 read, which may be nil.
+func secretMetadata(ctx context.Context, secretPath string, read map[string]interface{}, logEntry *logrus.Entry) *SecretMetadata {
+	metadata := metadataFromRead(read)
+	if !cfg.IndexMetadata {
+		return metadata
+	}
+	m, err := readSecretMetadata(ctx, secretPath)
+	if err != nil {
+		if isPermissionDenied(err) {
+			logEntry.WithError(err).Warn("Access denied for secret metadata")
+		} else {
+			logEntry.WithError(err).Error("Failed to read secret metadata")
+		}
+		return metadata
+	}
+	if m != nil {
+		return m
+	}
+	return metadata
+}
+
+// deleted reports whether the current version is destroyed or its deletion
+// time has passed; with delete_version_after Vault sets it in advance.
+func (m *SecretMetadata) deleted(now time.Time) bool {
+	return m != nil && (m.Destroyed || !m.DeletionTime.IsZero() && !m.DeletionTime.After(now))
+}
+
+// readSecretMetadata reads the metadata endpoint of a secret.
+func readSecretMetadata(ctx context.Context, secretPath string) (*SecretMetadata, error) {
+	secret, err := vaultClient.Logical().ReadWithContext(ctx, fmt.Sprintf("%s/metadata/%s", cfg.VaultMountPoint, secretPath))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	return parseSecretMetadata(secret.Data), nil
+}
+
+func parseSecretMetadata(data map[string]interface{}) *SecretMetadata {
+	meta := &SecretMetadata{
+		CurrentVersion: jsonInt(data["current_version"]),
+		MaxVersions:    jsonInt(data["max_versions"]),
+		CreatedTime:    jsonTime(data["created_time"]),
+		UpdatedTime:    jsonTime(data["updated_time"]),
+	}
+	meta.CASRequired, _ = data["cas_required"].(bool)
+	versions, _ := data["versions"].(map[string]interface{})
+	if current, ok := versions[strconv.Itoa(meta.CurrentVersion)].(map[string]interface{}); ok {
+		meta.DeletionTime = jsonTime(current["deletion_time"])
+		meta.Destroyed, _ = current["destroyed"].(bool)
+	}
+	if custom, ok := data["custom_metadata"].(map[string]interface{}); ok && len(custom) > 0 {
+		meta.CustomMetadata = make(map[string]string, len(custom))
+		for k, v := range custom {
+			if s, ok := v.(string); ok {
+				meta.CustomMetadata[k] = s
+			}
+		}
+	}
+	return meta
+}
+
+// jsonInt reads a number decoded by the Vault client, which uses json.Number.
+func jsonInt(v interface{}) int {
+	switch n := v.(type) {
+	case json.Number:
+		i, _ := n.Int64()
+		return int(i)
+	case float64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+func jsonTime(v interface{}) time.Time {
+	s, _ := v.(string)
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func hasMetaFilter(query url.Values) bool {
+	for name, values := range query {
+		if strings.HasPrefix(name, metaFilterPrefix) {
+			for _, v := range values {
+				if v != "" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// errMetadataNotIndexed rejects custom_metadata filters and groupings when
+// rebuilds do not read the metadata endpoint, rather than match nothing.
+var errMetadataNotIndexed = errors.New("custom metadata is not indexed: set VAULT_READ_METADATA=true to filter or group by it")
+
+// parseMetaFilters reads meta.<key>=<value> parameters into params.Meta,
+// keyed and valued in lower case. Empty values are ignored.
+func parseMetaFilters(query url.Values, params *SearchParams) error {
+	for name, values := range query {
+		key, ok := strings.CutPrefix(name, metaFilterPrefix)
+		if !ok {
+			continue
+		}
+		if key == "" {
+			return fmt.Errorf("'meta.' needs a metadata key, e.g. meta.owner=payments")
+		}
+		for _, v := range values {
+			if v == "" {
+				continue
+			}
+			if params.Meta == nil {
+				params.Meta = make(map[string][]string)
+			}
+			key := strings.ToLower(key)
+			params.Meta[key] = append(params.Meta[key], strings.ToLower(v))
+		}
+	}
+	if params.Meta != nil && !cfg.IndexMetadata {
+		return errMetadataNotIndexed
+	}
+	return nil
+}
+
+// matchMetaFilters compares custom_metadata case-insensitively. Values of one
+// key are ORed, different keys are ANDed, and * matches any value.
+func matchMetaFilters(meta *SecretMetadata, filters map[string][]string) bool {
+	for key, values := range filters {
+		value, ok := customMetadataValue(meta, key)
+		if !ok || !matchMetaValue(value, values) {
+			return false
+		}
+	}
+	return true
+}
+
+func customMetadataValue(meta *SecretMetadata, key string) (string, bool) {
+	if meta == nil {
+		return "", false
+	}
+	if v, ok := meta.CustomMetadata[key]; ok {
+		return v, true
+	}
+	for k, v := range meta.CustomMetadata {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func matchMetaValue(value string, wanted []string) bool {
+	for _, w := range wanted {
+		if w == "*" || strings.EqualFold(value, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// metaFilterArgs turns an MCP meta object into meta.<key> parameters.
+func metaFilterArgs(args map[string]interface{}, query url.Values) error {
+	raw, ok := args["meta"]
+	if !ok || raw == nil {
+		return nil
+	}
+	meta, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("argument 'meta' must be an object")
+	}
+	for k := range meta {
+		values, err := mcpStringListArg(meta, k)
+		if err != nil {
+			return fmt.Errorf("argument 'meta.%s' must be a string or an array of strings", k)
+		}
+		query[metaFilterPrefix+k] = values
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errCursorExpired = errors.New("cursor expired: the cache has been rebuilt since the first page, restart the search without 'cursor'")
+
+// cacheSnapshot is a retired cache generation kept alive so cursors issued
+// against it keep returning consistent pages after a rebuild.
+type cacheSnapshot struct {
+	generation uint64
+	data       map[string]*SecretKeys
+	index      *trigramIndex
+	builtAt    time.Time
+}
+
+// pageCursor pins follow-up pages to the generation that served the first one.
+// The fingerprint ties it to the query it was issued for.
+type pageCursor struct {
+	generation  uint64
+	offset      int
+	fingerprint uint64
+}
+
+func encodeCursor(c pageCursor) string {
+	raw := fmt.Sprintf("%d:%d:%x", c.generation, c.offset, c.fingerprint)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid 'cursor'")
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 {
+		return c, fmt.Errorf("invalid 'cursor'")
+	}
+	if c.generation, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return c, fmt.Errorf("invalid 'cursor'")
+	}
+	if c.offset, err = strconv.Atoi(parts[1]); err != nil || c.offset < 0 {
+		return c, fmt.Errorf("invalid 'cursor'")
+	}
+	if c.fingerprint, err = strconv.ParseUint(parts[2], 16, 64); err != nil {
+		return c, fmt.Errorf("invalid 'cursor'")
+	}
+	return c, nil
+}
+
+// queryFingerprint hashes everything that decides the result set and its
+// order, i.e. all parameters except the paging ones.
+func queryFingerprint(query url.Values) uint64 {
+	canonical := url.Values{}
+	for key, values := range query {
+		switch key {
+		case "limit", "offset", "cursor", "show_ui", "details":
+			continue
+		}
+		canonical[key] = values
+	}
+	h := fnv.New64a()
+	h.Write([]byte(canonical.Encode()))
+	return h.Sum64()
+}
+
+// parsePaging reads limit, offset and cursor. A cursor replaces offset and
+// pins the search to a cache generation.
+func parsePaging(query url.Values, params *SearchParams) error {
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("'limit' must be a positive integer")
+		}
+		params.Limit = limit
+	}
+
+	offsetParam := query.Get("offset")
+	cursorParam := query.Get("cursor")
+	if offsetParam != "" && cursorParam != "" {
+		return fmt.Errorf("'offset' and 'cursor' are mutually exclusive, use only one")
+	}
+
+	if offsetParam != "" {
+		offset, err := strconv.Atoi(offsetParam)
+		if err != nil || offset < 0 {
+			return fmt.Errorf("'offset' must be a non-negative integer")
+		}
+		params.Offset = offset
+	}
+
+	params.fingerprint = queryFingerprint(query)
+	if cursorParam != "" {
+		c, err := decodeCursor(cursorParam)
+		if err != nil {
+			return err
+		}
+		if c.fingerprint != params.fingerprint {
+			return fmt.Errorf("'cursor' does not belong to this query")
+		}
+		params.Offset = c.offset
+		params.Generation = c.generation
+		params.Pinned = true
+	}
+	return nil
+}
+
+// snapshotLocked picks the cache generation a search should read. The caller
+// must hold the cache read lock.
+func (c *Cache) snapshotLocked(params *SearchParams) (*cacheSnapshot, error) {
+	if !params.Pinned || params.Generation == c.generation {
+		return &cacheSnapshot{generation: c.generation, data: c.data, index: c.index, builtAt: c.buildEndTime}, nil
+	}
+	if c.previous != nil && c.previous.generation == params.Generation {
+		return c.previous, nil
+	}
+	return nil, errCursorExpired
+}
+
+// noteCursorIssued records that a next_cursor points into generation, so a
+// rebuild keeps it for the following pages.
+func (c *Cache) noteCursorIssued(generation uint64) {
+	for {
+		issued := atomic.LoadUint64(&c.cursorGen)
+		if issued >= generation || atomic.CompareAndSwapUint64(&c.cursorGen, issued, generation) {
+			return
+		}
+	}
+}
+
+// retireSnapshotLocked keeps the outgoing generation for cfg.CursorTTL if a
+// next_cursor was issued for it; no page can ask for it otherwise. The caller
+// must hold the cache write lock.
+func (c *Cache) retireSnapshotLocked() {
+	c.previous = nil
+	if c.data == nil || atomic.LoadUint64(&c.cursorGen) != c.generation {
+		return
+	}
+	snap := &cacheSnapshot{generation: c.generation, data: c.data, index: c.index, builtAt: c.buildEndTime}
+	c.previous = snap
+	time.AfterFunc(cfg.CursorTTL, func() {
+		c.Lock()
+		if c.previous == snap {
+			c.previous = nil
+		}
+		c.Unlock()
+	})
+}
+
+func paginate(matches []string, offset, limit int) []string {
+	if offset >= len(matches) {
+		return []string{}
+	}
+	end := len(matches)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return matches[offset:end]
+}
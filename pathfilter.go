@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// compilePathGlob compiles a doublestar glob over a whole secret path. A
+// single star matches within one segment and ? matches one character other
+// than /. A double star that is a whole segment matches any number of
+// segments, including none. [a-z] and [!a-z] are character classes and {a,b}
+// matches either alternative. So prod/*/db/** matches prod/api/db and
+// prod/api/db/users/admin but not prod/api/cache/db. Paths are case-sensitive,
+// like in Vault.
+func compilePathGlob(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	depth := 0
+	for i := 0; i < len(glob); {
+		r, size := utf8.DecodeRuneInString(glob[i:])
+		switch r {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") {
+				atStart := i == 0 || glob[i-1] == '/'
+				atEnd := i+2 == len(glob) || glob[i+2] == '/'
+				if atStart && atEnd {
+					switch {
+					case i+2 == len(glob) && i > 0:
+						// "a/**" also matches "a" itself; the / is already written.
+						s := strings.TrimSuffix(sb.String(), "/")
+						sb.Reset()
+						sb.WriteString(s)
+						sb.WriteString("(?:/.*)?")
+						i += 2
+					case i+2 == len(glob):
+						sb.WriteString(".*")
+						i += 2
+					default:
+						sb.WriteString("(?:.*/)?")
+						i += 3 // and the / after **
+					}
+					continue
+				}
+				i++ // ** inside a segment is just *
+			}
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated '[' at position %d", i+1)
+			}
+			class := glob[i+1 : i+1+end]
+			if len(class) > 0 && (class[0] == '!' || class[0] == '^') {
+				// Like * and ?, a negated class stays within one segment.
+				class = "^/" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 2
+			continue
+		case '{':
+			depth++
+			sb.WriteString("(?:")
+		case '}':
+			if depth == 0 {
+				return nil, fmt.Errorf("unmatched '}' at position %d", i+1)
+			}
+			depth--
+			sb.WriteString(")")
+		case ',':
+			if depth > 0 {
+				sb.WriteString("|")
+			} else {
+				sb.WriteString(",")
+			}
+		case '\\':
+			if i+size < len(glob) {
+				i += size
+				r, size = utf8.DecodeRuneInString(glob[i:])
+			}
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+		i += size
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unterminated '{'")
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// parsePathFilters reads the repeatable in_path, path_glob, exclude_path and
+// exclude_glob parameters. Empty values are ignored.
+func parsePathFilters(values map[string][]string, params *SearchParams) error {
+	nonEmpty := func(name string) []string {
+		var out []string
+		for _, v := range values[name] {
+			if v != "" {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+	compile := func(name string, globs []string) ([]*regexp.Regexp, error) {
+		res := make([]*regexp.Regexp, 0, len(globs))
+		for _, glob := range globs {
+			re, err := compilePathGlob(glob)
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s' %q: %v", name, glob, err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+
+	params.InPaths = nonEmpty("in_path")
+	params.PathGlobs = nonEmpty("path_glob")
+	params.ExcludePaths = nonEmpty("exclude_path")
+	params.ExcludeGlobs = nonEmpty("exclude_glob")
+
+	var err error
+	if params.pathGlobs, err = compile("path_glob", params.PathGlobs); err != nil {
+		return err
+	}
+	if params.excludeGlobs, err = compile("exclude_glob", params.ExcludeGlobs); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *SearchParams) hasPathSearch() bool {
+	return len(p.InPaths) > 0 || len(p.PathGlobs) > 0
+}
+
+// matchPathFilters applies the including path filters. Repeated values of one
+// parameter are ORed; in_path and path_glob are ANDed with each other.
+func matchPathFilters(secretPath string, params *SearchParams) bool {
+	if len(params.InPaths) > 0 && !matchAnyInPath(secretPath, params.InPaths) {
+		return false
+	}
+	if len(params.pathGlobs) > 0 && !matchAnyGlob(secretPath, params.pathGlobs) {
+		return false
+	}
+	return true
+}
+
+// excludedPath reports whether exclude_path or exclude_glob drops secretPath.
+func excludedPath(secretPath string, params *SearchParams) bool {
+	return matchAnyInPath(secretPath, params.ExcludePaths) || matchAnyGlob(secretPath, params.excludeGlobs)
+}
+
+func matchAnyInPath(secretPath string, inPaths []string) bool {
+	for _, inPath := range inPaths {
+		if matchInPath(secretPath, inPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyGlob(secretPath string, globs []*regexp.Regexp) bool {
+	for _, re := range globs {
+		if re.MatchString(secretPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathFilterTrigramQuery plans the index lookup for the including path
+// filters, mirroring matchPathFilters.
+func pathFilterTrigramQuery(params *SearchParams) *trigramQuery {
+	inPaths := make([]*trigramQuery, 0, len(params.InPaths))
+	for _, inPath := range params.InPaths {
+		inPaths = append(inPaths, literalTrigramQuery(inPath))
+	}
+	globs := make([]*trigramQuery, 0, len(params.PathGlobs))
+	for _, glob := range params.PathGlobs {
+		if strings.ContainsAny(glob, "[{\\") {
+			// Alternatives and classes do not leave plain literal runs.
+			globs = append(globs, trigramQueryAll)
+			continue
+		}
+		globs = append(globs, globTrigramQuery(glob))
+	}
+
+	var qs []*trigramQuery
+	if len(inPaths) > 0 {
+		qs = append(qs, orTrigramQueries(inPaths...))
+	}
+	if len(globs) > 0 {
+		qs = append(qs, orTrigramQueries(globs...))
+	}
+	return andTrigramQueries(qs...)
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The q= query language:
+//
+//	key:password AND path:prod/* NOT path:*/legacy/*
+//	(key:/^api_/ OR key:token) "db password"
+//
+// Terms are ANDed when no operator is given. NOT binds tighter than AND, and
+// AND binds tighter than OR. A term without a field matches like term= under
+// the same scope=, and a bare glob must match the whole path or a whole key
+// name. Globs use * for any run of characters (including /) and ? for one;
+// unlike path_glob there is no ** and * is not held to one segment.
+// A trailing ~ makes a term typo-tolerant: pasword~ also matches a key name or
+// path segment within SEARCH_FUZZY_DISTANCE edits, and pasword~1 within one.
+
+const (
+	queryFieldAny  = ""
+	queryFieldKey  = "key"
+	queryFieldPath = "path"
+)
+
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query parse error at position %d: %s", e.Pos, e.Msg)
+}
+
+type queryExpr interface {
+	eval(path string, keys *SecretKeys) bool
+}
+
+type queryAnd struct{ left, right queryExpr }
+type queryOr struct{ left, right queryExpr }
+type queryNot struct{ expr queryExpr }
+
+type queryTerm struct {
+	field string
+	scope string // applies to terms without a field
+	value string // lowercased substring or glob
+	regex *regexp.Regexp
+	glob  bool
+	fuzzy int // max edit distance, 0 when the term is not fuzzy
+
+	tokens *tokenQuery // word and synonym match on key names, may be nil
+}
+
+func (q *queryAnd) eval(path string, keys *SecretKeys) bool {
+	return q.left.eval(path, keys) && q.right.eval(path, keys)
+}
+
+func (q *queryOr) eval(path string, keys *SecretKeys) bool {
+	return q.left.eval(path, keys) || q.right.eval(path, keys)
+}
+
+func (q *queryNot) eval(path string, keys *SecretKeys) bool {
+	return !q.expr.eval(path, keys)
+}
+
+func (q *queryTerm) eval(path string, keys *SecretKeys) bool {
+	if q.matchExact(path, keys) {
+		return true
+	}
+	if q.tokens != nil && q.field != queryFieldPath && q.scope != searchScopePath && q.tokens.matchKeys(keys) {
+		return true
+	}
+	return q.fuzzy > 0 && q.matchFuzzy(path, keys)
+}
+
+func (q *queryTerm) matchExact(path string, keys *SecretKeys) bool {
+	switch {
+	case q.field == queryFieldPath:
+		return q.matchString(path)
+	case q.field == queryFieldKey:
+		return matchFields(path, keys, searchScopeKeys, q.matchString)
+	case q.scope != "":
+		return matchFields(path, keys, q.scope, q.matchString)
+	case q.glob:
+		return matchFields(path, keys, searchScopeAll, q.matchString)
+	case q.regex != nil:
+		return q.regex.MatchString(keys.SearchString)
+	default:
+		return strings.Contains(keys.SearchString, q.value)
+	}
+}
+
+func (q *queryTerm) matchFuzzy(path string, keys *SecretKeys) bool {
+	scope := q.scope
+	switch {
+	case q.field == queryFieldPath:
+		scope = searchScopePath
+	case q.field == queryFieldKey:
+		scope = searchScopeKeys
+	case scope == "":
+		scope = searchScopeAll
+	}
+	return matchFields(path, keys, scope, func(s string) bool {
+		return fuzzyMatch(s, q.value, q.fuzzy)
+	})
+}
+
+func (q *queryTerm) matchString(s string) bool {
+	if q.regex != nil {
+		return q.regex.MatchString(s)
+	}
+	return strings.Contains(strings.ToLower(s), q.value)
+}
+
+type queryTokenKind int
+
+const (
+	queryTokEOF queryTokenKind = iota
+	queryTokTerm
+	queryTokAnd
+	queryTokOr
+	queryTokNot
+	queryTokLParen
+	queryTokRParen
+)
+
+type queryToken struct {
+	kind   queryTokenKind
+	pos    int
+	field  string
+	value  string
+	quoted bool
+	regex  bool
+	glob   bool
+	flags  string
+	fuzzy  bool
+	// fuzziness is the explicit distance of term~N, 0 for the default.
+	fuzziness int
+}
+
+// lexQuery splits a query into tokens. Positions are 1-based byte offsets.
+func lexQuery(input string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: queryTokLParen, pos: i + 1})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: queryTokRParen, pos: i + 1})
+			i++
+		default:
+			tok, next, err := lexQueryTerm(input, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i = next
+		}
+	}
+	tokens = append(tokens, queryToken{kind: queryTokEOF, pos: len(input) + 1})
+	return tokens, nil
+}
+
+func lexQueryTerm(input string, start int) (queryToken, int, error) {
+	tok := queryToken{kind: queryTokTerm, pos: start + 1}
+	i := start
+
+	if field, ok := scanQueryField(input, i); ok {
+		if field != queryFieldKey && field != queryFieldPath {
+			return tok, 0, &QueryError{Pos: start + 1, Msg: fmt.Sprintf("unknown field '%s', expected 'key' or 'path'", field)}
+		}
+		tok.field = field
+		i += len(field) + 1
+	}
+
+	if i >= len(input) || isQueryDelimiter(input[i]) {
+		return tok, 0, &QueryError{Pos: i + 1, Msg: fmt.Sprintf("missing value for field '%s'", tok.field)}
+	}
+
+	switch input[i] {
+	case '"':
+		value, next, err := scanQueryDelimited(input, i, '"')
+		if err != nil {
+			return tok, 0, err
+		}
+		tok.value = value
+		tok.quoted = true
+		i = next
+	case '/':
+		value, next, err := scanQueryDelimited(input, i, '/')
+		if err != nil {
+			return tok, 0, err
+		}
+		tok.value = value
+		tok.regex = true
+		i = next
+		for i < len(input) && input[i] == 'i' {
+			tok.flags = "i"
+			i++
+		}
+	default:
+		end := i
+		for end < len(input) && !isQueryDelimiter(input[end]) && input[end] != '~' {
+			end++
+		}
+		tok.value = input[i:end]
+		i = end
+	}
+
+	if i < len(input) && input[i] == '~' {
+		if tok.value == "" && !tok.quoted {
+			return tok, 0, &QueryError{Pos: i + 1, Msg: "'~' must follow a term"}
+		}
+		if tok.regex {
+			return tok, 0, &QueryError{Pos: i + 1, Msg: "'~' cannot be used with a regular expression"}
+		}
+		tok.fuzzy = true
+		i++
+		if i < len(input) && input[i] >= '1' && input[i] <= '9' {
+			tok.fuzziness = int(input[i] - '0')
+			i++
+		}
+	}
+
+	if i < len(input) && !isQueryDelimiter(input[i]) {
+		return tok, 0, &QueryError{Pos: i + 1, Msg: "unexpected character after term"}
+	}
+
+	if tok.field == "" && !tok.regex && !tok.quoted && !tok.fuzzy {
+		switch tok.value {
+		case "AND":
+			return queryToken{kind: queryTokAnd, pos: start + 1}, i, nil
+		case "OR":
+			return queryToken{kind: queryTokOr, pos: start + 1}, i, nil
+		case "NOT":
+			return queryToken{kind: queryTokNot, pos: start + 1}, i, nil
+		}
+	}
+
+	tok.glob = !tok.regex && !tok.quoted && strings.ContainsAny(tok.value, "*?")
+	if tok.glob && tok.fuzzy {
+		return tok, 0, &QueryError{Pos: start + 1, Msg: "'~' cannot be used with a glob"}
+	}
+	return tok, i, nil
+}
+
+func scanQueryField(input string, i int) (string, bool) {
+	end := i
+	for end < len(input) {
+		c := input[end]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' {
+			end++
+			continue
+		}
+		break
+	}
+	if end == i || end >= len(input) || input[end] != ':' {
+		return "", false
+	}
+	return strings.ToLower(input[i:end]), true
+}
+
+// scanQueryDelimited reads a quoted phrase or /regex/ starting at input[i].
+// A backslash escapes the delimiter; other escapes are kept for the regex.
+func scanQueryDelimited(input string, i int, delim byte) (string, int, error) {
+	var sb strings.Builder
+	for j := i + 1; j < len(input); j++ {
+		c := input[j]
+		if c == '\\' && j+1 < len(input) && input[j+1] == delim {
+			sb.WriteByte(delim)
+			j++
+			continue
+		}
+		if c == delim {
+			return sb.String(), j + 1, nil
+		}
+		sb.WriteByte(c)
+	}
+	what := "quote"
+	if delim == '/' {
+		what = "regular expression"
+	}
+	return "", 0, &QueryError{Pos: i + 1, Msg: fmt.Sprintf("unterminated %s", what)}
+}
+
+func isQueryDelimiter(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '(' || c == ')'
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	scope  string
+}
+
+// parseQuery parses a q= expression into an evaluable AST. scope is the
+// scope= parameter and decides what terms without a field are matched against.
+func parseQuery(input, scope string) (queryExpr, error) {
+	if strings.TrimSpace(input) == "" {
+		return nil, &QueryError{Pos: 1, Msg: "empty query"}
+	}
+	tokens, err := lexQuery(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens, scope: scope}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != queryTokEOF {
+		if tok.kind == queryTokRParen {
+			return nil, &QueryError{Pos: tok.pos, Msg: "unmatched ')'"}
+		}
+		return nil, &QueryError{Pos: tok.pos, Msg: "unexpected token"}
+	}
+	return expr, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != queryTokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == queryTokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case queryTokAnd:
+			p.next()
+		case queryTokTerm, queryTokNot, queryTokLParen:
+			// implicit AND
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryAnd{left: left, right: right}
+	}
+}
+
+func (p *queryParser) parseUnary() (queryExpr, error) {
+	if p.peek().kind == queryTokNot {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryExpr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case queryTokLParen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != queryTokRParen {
+			return nil, &QueryError{Pos: closing.pos, Msg: fmt.Sprintf("expected ')' to close '(' at position %d", tok.pos)}
+		}
+		return expr, nil
+	case queryTokTerm:
+		return newQueryTerm(tok, p.scope)
+	case queryTokEOF:
+		return nil, &QueryError{Pos: tok.pos, Msg: "unexpected end of query, expected a term"}
+	case queryTokRParen:
+		return nil, &QueryError{Pos: tok.pos, Msg: "unexpected ')', expected a term"}
+	default:
+		return nil, &QueryError{Pos: tok.pos, Msg: "unexpected operator, expected a term"}
+	}
+}
+
+func newQueryTerm(tok queryToken, scope string) (queryExpr, error) {
+	term := &queryTerm{field: tok.field, glob: tok.glob}
+	if tok.field == queryFieldAny {
+		term.scope = scope
+	}
+
+	switch {
+	case tok.regex:
+		pattern := tok.value
+		if tok.flags == "i" {
+			pattern = "(?i)" + pattern
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("invalid regular expression: %v", err)}
+		}
+		term.regex = regex
+	case tok.glob:
+		term.regex = globToRegexp(tok.value)
+		term.value = strings.ToLower(tok.value)
+	default:
+		term.value = strings.ToLower(tok.value)
+		term.tokens = newTokenQuery(tok.value, synonyms)
+	}
+
+	if tok.fuzzy {
+		term.fuzzy = tok.fuzziness
+		if term.fuzzy == 0 {
+			term.fuzzy = fuzzyDistance(term.value, cfg.FuzzyDistance)
+		}
+	}
+	return term, nil
+}
+
+// fuzzyQueryTerms applies fuzzy=true to every plain term of a parsed query that
+// does not already carry its own ~.
+func fuzzyQueryTerms(expr queryExpr, distance int) {
+	switch q := expr.(type) {
+	case *queryAnd:
+		fuzzyQueryTerms(q.left, distance)
+		fuzzyQueryTerms(q.right, distance)
+	case *queryOr:
+		fuzzyQueryTerms(q.left, distance)
+		fuzzyQueryTerms(q.right, distance)
+	case *queryNot:
+		fuzzyQueryTerms(q.expr, distance)
+	case *queryTerm:
+		if q.regex == nil && q.fuzzy == 0 {
+			q.fuzzy = fuzzyDistance(q.value, distance)
+		}
+	}
+}
+
+// searchesKeys reports whether a parsed query matches any term against key
+// names: a key: term, or a term without a field outside scope=path.
+func searchesKeys(expr queryExpr) bool {
+	switch q := expr.(type) {
+	case *queryAnd:
+		return searchesKeys(q.left) || searchesKeys(q.right)
+	case *queryOr:
+		return searchesKeys(q.left) || searchesKeys(q.right)
+	case *queryNot:
+		return searchesKeys(q.expr)
+	case *queryTerm:
+		return q.field == queryFieldKey || q.field == queryFieldAny && q.scope != searchScopePath
+	}
+	return false
+}
+
+// globToRegexp compiles a case-insensitive, fully anchored glob where * matches
+// any run of characters and ? matches exactly one.
+func globToRegexp(glob string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?is)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
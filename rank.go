@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+const sortRelevance = "relevance"
+
+// Relevance weights. Every key hit starts from scoreKeyHit, more than the best
+// path-only score, so any key hit outranks any path hit. An exact key name
+// outranks a substring of one, which outranks a misspelling, and nested keys
+// rank just below top-level keys of the same kind. Depth only breaks ties
+// between otherwise equal matches.
+const (
+	scoreKeyHit         = scorePathSegment + scorePathSubstring + scoreDepthTieBreak + 1
+	scoreExactKey       = 20.0
+	scoreSubstringKey   = 10.0
+	scoreFuzzyKey       = 9.0
+	scoreNestedPenalty  = 3.0
+	scoreExtraKey       = 0.5
+	scoreMaxExtraKeys   = 4
+	scorePathSegment    = 8.0
+	scorePathSubstring  = 5.0
+	scoreDepthTieBreak  = 1.0
+	scoreDecimalsFactor = 100
+)
+
+// relevanceScore rates a match from the explanation buildMatchDetail produced.
+func relevanceScore(detail *MatchDetail) float64 {
+	var best float64
+	for _, km := range detail.MatchedKeys {
+		s := scoreSubstringKey
+		switch {
+		case km.Fuzzy:
+			s = scoreFuzzyKey
+		case len(km.Offsets) == 1 && km.Offsets[0] == [2]int{0, len(km.Key)},
+			len(km.KeyPathOffsets) == 1 && km.KeyPathOffsets[0] == [2]int{0, len(km.KeyPath)}:
+			s = scoreExactKey
+		}
+		if km.Source == matchSourceNestedKey {
+			s -= scoreNestedPenalty
+		}
+		if s > best {
+			best = s
+		}
+	}
+	score := best
+	if len(detail.MatchedKeys) > 0 {
+		score += scoreKeyHit
+	}
+	if extra := len(detail.MatchedKeys) - 1; extra > 0 {
+		score += scoreExtraKey * float64(min(extra, scoreMaxExtraKeys))
+	}
+
+	if len(detail.PathOffsets) > 0 {
+		s := scorePathSubstring
+		for _, o := range detail.PathOffsets {
+			if isPathSegment(detail.Path, o) {
+				s = scorePathSegment
+				break
+			}
+		}
+		score += s
+	}
+
+	depth := strings.Count(detail.Path, "/") + 1
+	score += scoreDepthTieBreak / float64(depth)
+
+	return math.Round(score*scoreDecimalsFactor) / scoreDecimalsFactor
+}
+
+func isPathSegment(secretPath string, o [2]int) bool {
+	return (o[0] == 0 || secretPath[o[0]-1] == '/') && (o[1] == len(secretPath) || secretPath[o[1]] == '/')
+}
+
+// rankByRelevance sorts matches by descending score, then by path. data is
+// a cache snapshot.
+func rankByRelevance(matches []string, data map[string]*SecretKeys, params *SearchParams, hs []highlighter) {
+	scores := make(map[string]float64, len(matches))
+	for _, secretPath := range matches {
+		detail := buildMatchDetail(secretPath, data[secretPath], params, hs)
+		scores[secretPath] = relevanceScore(&detail)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		si, sj := scores[matches[i]], scores[matches[j]]
+		if si != sj {
+			return si > sj
+		}
+		return matches[i] < matches[j]
+	})
+}
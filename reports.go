@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	reportFormatJSON = "json"
+	reportFormatCSV  = "csv"
+
+	groupByPath  = "path"
+	groupByOwner = "owner"
+
+	// noGroup is the group of secrets without the metadata key grouped by.
+	noGroup = "(none)"
+)
+
+// StaleSecret is a secret whose current version is older than its maximum
+// age. UpdatedTime and AgeDays are missing for a secret listed as unknown,
+// one Vault did not say when it was written.
+type StaleSecret struct {
+	Path        string     `json:"path"`
+	UpdatedTime *time.Time `json:"updated_time,omitempty"`
+	AgeDays     *int       `json:"age_days,omitempty"`
+	MaxAge      string     `json:"max_age"`
+	Rule        string     `json:"rule,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Version     int        `json:"version,omitempty"`
+}
+
+// StaleGroup counts the checked and the stale secrets of one group. Secrets
+// with an unknown update time are neither stale nor fresh and are listed in
+// Unknown instead. SecretCount is nil for a caller filtered by its token.
+type StaleGroup struct {
+	Group        string        `json:"group"`
+	SecretCount  *int          `json:"secret_count,omitempty"`
+	StaleCount   int           `json:"stale_count"`
+	UnknownCount int           `json:"unknown_count"`
+	Secrets      []StaleSecret `json:"secrets"`
+	Unknown      []StaleSecret `json:"unknown"`
+}
+
+// StaleReport is the stale report. Only the stale and unknown secrets are
+// checked against a caller filtered by its token, so SecretCount and
+// UncheckedCount, which would need every secret checked, are nil then.
+type StaleReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	OlderThan   string    `json:"older_than,omitempty"`
+	GroupBy     string    `json:"group_by"`
+	SecretCount *int      `json:"secret_count,omitempty"`
+	StaleCount  int       `json:"stale_count"`
+	// UnknownCount is the number of checked secrets without an update time.
+	UnknownCount int `json:"unknown_count"`
+	// UncheckedCount is the number of secrets that passed the filters but
+	// have no maximum age, neither from older_than nor from a rule.
+	UncheckedCount *int         `json:"unchecked_count,omitempty"`
+	Groups         []StaleGroup `json:"groups"`
+}
+
+// reportFormat reads format=json|csv, falling back to the Accept header.
+func reportFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case reportFormatJSON, reportFormatCSV:
+		return format, nil
+	case "":
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			return reportFormatCSV, nil
+		}
+		return reportFormatJSON, nil
+	}
+	return "", fmt.Errorf("'format' must be 'json' or 'csv'")
+}
+
+func staleReportHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := reportFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := buildStaleReport(r.Context(), r.URL.Query(), time.Now())
+	if writeCallerError(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger.Infof("Stale report: %d secrets stale, %d unknown, older_than=%s, group_by=%s",
+		report.StaleCount, report.UnknownCount, report.OlderThan, report.GroupBy)
+
+	if format == reportFormatCSV {
+		writeStaleReportCSV(w, report)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// buildStaleReport checks every cached secret that passes the path and meta
+// filters in query against older_than, or against the rotation rules when
+// older_than is not given. Stale and unknown secrets the caller of ctx may
+// not see are then left out; the others are never asked about.
+func buildStaleReport(ctx context.Context, query url.Values, now time.Time) (*StaleReport, error) {
+	report := &StaleReport{GeneratedAt: now, GroupBy: query.Get("group_by"), Groups: []StaleGroup{}}
+
+	var olderThan *age
+	if v := query.Get("older_than"); v != "" {
+		a, err := parseAge(v)
+		if err != nil {
+			return nil, fmt.Errorf("'older_than' must be an age such as 180d, 2w, 1y or 12h: %q", v)
+		}
+		olderThan = &a
+		report.OlderThan = v
+	} else if rotation.empty() {
+		return nil, fmt.Errorf("'older_than' is required when no rotation rules are configured")
+	}
+
+	groupKey, err := reportGroupKey(report.GroupBy)
+	if err != nil {
+		return nil, err
+	}
+	if report.GroupBy == "" {
+		report.GroupBy = groupByPath
+	}
+
+	filter, err := parseReportFilters(query)
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		group  string
+		secret StaleSecret
+	}
+	var candidates []candidate
+	var checked, unchecked int
+	checkedByGroup := make(map[string]int)
+	cache.RLock()
+	for secretPath, keys := range cache.data {
+		meta := keys.metadata()
+		if keys.isDeleted() || !matchReportFilters(secretPath, meta, filter) {
+			continue
+		}
+
+		var maxAge age
+		var rule string
+		if olderThan != nil {
+			maxAge = *olderThan
+		} else {
+			var ok bool
+			if maxAge, rule, ok = rotation.maxAgeFor(secretPath); !ok {
+				unchecked++
+				continue
+			}
+		}
+
+		name := groupKey(secretPath, meta)
+		checkedByGroup[name]++
+		checked++
+
+		updated := keys.updatedTime()
+		if !updated.IsZero() && !updated.Before(maxAge.before(now)) {
+			continue
+		}
+		stale := StaleSecret{Path: secretPath, MaxAge: maxAge.String(), Rule: rule}
+		stale.Owner, _ = customMetadataValue(meta, groupByOwner)
+		if meta != nil {
+			stale.Version = meta.CurrentVersion
+		}
+		if !updated.IsZero() {
+			days := int(now.Sub(updated).Hours() / 24)
+			stale.UpdatedTime, stale.AgeDays = &updated, &days
+		}
+		candidates = append(candidates, candidate{name, stale})
+	}
+	cache.RUnlock()
+
+	groups := make(map[string]*StaleGroup)
+	groupOf := func(name string) *StaleGroup {
+		group, ok := groups[name]
+		if !ok {
+			group = &StaleGroup{Group: name, Secrets: []StaleSecret{}, Unknown: []StaleSecret{}}
+			groups[name] = group
+		}
+		return group
+	}
+
+	var visible visibility
+	if c := callerFrom(ctx); c != nil {
+		paths := make([]string, len(candidates))
+		for i, cand := range candidates {
+			paths[i] = cand.secret.Path
+		}
+		if visible, err = c.visibility(ctx, paths); err != nil {
+			return nil, err
+		}
+	} else {
+		report.SecretCount, report.UncheckedCount = &checked, &unchecked
+		for name, n := range checkedByGroup {
+			groupOf(name).SecretCount = &n
+		}
+	}
+
+	for _, cand := range candidates {
+		if !visible.allows(cand.secret.Path) {
+			continue
+		}
+		group := groupOf(cand.group)
+		if cand.secret.UpdatedTime == nil {
+			group.Unknown = append(group.Unknown, cand.secret)
+			group.UnknownCount++
+			report.UnknownCount++
+			continue
+		}
+		group.Secrets = append(group.Secrets, cand.secret)
+		group.StaleCount++
+		report.StaleCount++
+	}
+
+	for _, group := range groups {
+		sort.Slice(group.Secrets, func(i, j int) bool {
+			ti, tj := group.Secrets[i].UpdatedTime, group.Secrets[j].UpdatedTime
+			if !ti.Equal(*tj) {
+				return ti.Before(*tj)
+			}
+			return group.Secrets[i].Path < group.Secrets[j].Path
+		})
+		sort.Slice(group.Unknown, func(i, j int) bool { return group.Unknown[i].Path < group.Unknown[j].Path })
+		report.Groups = append(report.Groups, *group)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool { return report.Groups[i].Group < report.Groups[j].Group })
+	return report, nil
+}
+
+// matchReportFilters applies the path and meta filters a report accepts.
+func matchReportFilters(secretPath string, meta *SecretMetadata, filter *SearchParams) bool {
+	return matchPathFilters(secretPath, filter) && !excludedPath(secretPath, filter) && matchMetaFilters(meta, filter.Meta)
+}
+
+// parseReportFilters reads the path and meta filters of a report.
+func parseReportFilters(query url.Values) (*SearchParams, error) {
+	filter := &SearchParams{}
+	if err := parsePathFilters(query, filter); err != nil {
+		return nil, err
+	}
+	if err := parseMetaFilters(query, filter); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// reportGroupKey returns how group_by names the group of a secret: its
+// top-level path segment, its owner, or any custom_metadata key as meta.<key>.
+func reportGroupKey(groupBy string) (func(secretPath string, meta *SecretMetadata) string, error) {
+	metaKey := groupByOwner
+	switch {
+	case groupBy == "" || groupBy == groupByPath:
+		return func(secretPath string, _ *SecretMetadata) string {
+			top, _, _ := strings.Cut(secretPath, "/")
+			return top
+		}, nil
+	case groupBy == groupByOwner:
+	case strings.HasPrefix(groupBy, metaFilterPrefix) && len(groupBy) > len(metaFilterPrefix):
+		metaKey = groupBy[len(metaFilterPrefix):]
+	default:
+		return nil, fmt.Errorf("'group_by' must be 'path', 'owner' or 'meta.<key>'")
+	}
+	if !cfg.IndexMetadata {
+		return nil, errMetadataNotIndexed
+	}
+	return func(_ string, meta *SecretMetadata) string {
+		if v, ok := customMetadataValue(meta, metaKey); ok && v != "" {
+			return v
+		}
+		return noGroup
+	}, nil
+}
+
+// writeStaleReportCSV writes one row per stale secret, then one per secret
+// with an unknown update time; the status column tells them apart and the
+// group column allows counting per group in a spreadsheet.
+func writeStaleReportCSV(w http.ResponseWriter, report *StaleReport) {
+	var rows [][]string
+	for _, group := range report.Groups {
+		for _, s := range group.Secrets {
+			rows = append(rows, []string{group.Group, s.Path, "stale", s.UpdatedTime.Format(time.RFC3339), strconv.Itoa(*s.AgeDays), s.MaxAge, s.Rule, s.Owner, csvVersion(s.Version)})
+		}
+	}
+	for _, group := range report.Groups {
+		for _, s := range group.Unknown {
+			rows = append(rows, []string{group.Group, s.Path, "unknown", "", "", s.MaxAge, s.Rule, s.Owner, csvVersion(s.Version)})
+		}
+	}
+	writeCSV(w, "stale-secrets.csv", []string{"group", "path", "status", "updated_time", "age_days", "max_age", "rule", "owner", "version"}, rows)
+}
+
+// DeletedSecret is a secret whose current version is deleted, or destroyed
+// with include_destroyed=true.
+type DeletedSecret struct {
+	Path         string     `json:"path"`
+	Version      int        `json:"version,omitempty"`
+	DeletionTime *time.Time `json:"deletion_time,omitempty"`
+	Destroyed    bool       `json:"destroyed,omitempty"`
+	Owner        string     `json:"owner,omitempty"`
+}
+
+type DeletedReport struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Count       int             `json:"count"`
+	Secrets     []DeletedSecret `json:"secrets"`
+}
+
+func deletedReportHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := reportFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := buildDeletedReport(r.Context(), r.URL.Query(), time.Now())
+	if writeCallerError(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger.Infof("Deleted report: %d secrets", report.Count)
+
+	if format == reportFormatCSV {
+		var rows [][]string
+		for _, s := range report.Secrets {
+			var deleted string
+			if s.DeletionTime != nil {
+				deleted = s.DeletionTime.Format(time.RFC3339)
+			}
+			rows = append(rows, []string{s.Path, csvVersion(s.Version), deleted, strconv.FormatBool(s.Destroyed), s.Owner})
+		}
+		writeCSV(w, "deleted-secrets.csv", []string{"path", "version", "deletion_time", "destroyed", "owner"}, rows)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// buildDeletedReport lists the cached secrets whose current version is
+// soft-deleted and can still be undeleted, oldest deletion first. Destroyed
+// ones are only listed with include_destroyed=true. Only those are checked
+// against the caller of ctx.
+func buildDeletedReport(ctx context.Context, query url.Values, now time.Time) (*DeletedReport, error) {
+	filter, err := parseReportFilters(query)
+	if err != nil {
+		return nil, err
+	}
+	includeDestroyed := query.Get("include_destroyed") == "true"
+
+	report := &DeletedReport{GeneratedAt: now, Secrets: []DeletedSecret{}}
+	cache.RLock()
+	for secretPath, keys := range cache.data {
+		meta := keys.metadata()
+		if !keys.isDeleted() || meta.Destroyed && !includeDestroyed || !matchReportFilters(secretPath, meta, filter) {
+			continue
+		}
+		deleted := DeletedSecret{Path: secretPath, Version: meta.CurrentVersion, Destroyed: meta.Destroyed}
+		if !meta.DeletionTime.IsZero() {
+			t := meta.DeletionTime
+			deleted.DeletionTime = &t
+		}
+		deleted.Owner, _ = customMetadataValue(meta, groupByOwner)
+		report.Secrets = append(report.Secrets, deleted)
+	}
+	cache.RUnlock()
+
+	if c := callerFrom(ctx); c != nil {
+		paths := make([]string, len(report.Secrets))
+		for i, s := range report.Secrets {
+			paths[i] = s.Path
+		}
+		visible, err := c.visibility(ctx, paths)
+		if err != nil {
+			return nil, err
+		}
+		report.Secrets = slices.DeleteFunc(report.Secrets, func(s DeletedSecret) bool { return !visible(s.Path) })
+	}
+
+	sort.Slice(report.Secrets, func(i, j int) bool {
+		ti, tj := report.Secrets[i].DeletionTime, report.Secrets[j].DeletionTime
+		if (ti == nil) != (tj == nil) {
+			return tj == nil
+		}
+		if ti != nil && !ti.Equal(*tj) {
+			return ti.Before(*tj)
+		}
+		return report.Secrets[i].Path < report.Secrets[j].Path
+	})
+	report.Count = len(report.Secrets)
+	return report, nil
+}
+
+func csvVersion(version int) string {
+	if version == 0 {
+		return ""
+	}
+	return strconv.Itoa(version)
+}
+
+// writeCSV sends a report as a CSV attachment.
+func writeCSV(w http.ResponseWriter, filename string, header []string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write(header)
+	_ = cw.WriteAll(rows)
+	if err := cw.Error(); err != nil {
+		logger.Errorf("Failed to write CSV report: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rotation is loaded from cfg.RotationFile at startup; nil means no rules, so
+// the stale report needs older_than.
+var rotation *rotationConfig
+
+// rotationConfig is the rotation rules file:
+//
+//	max_age: 180d
+//	rules:
+//	  - path: prod/**
+//	    max_age: 90d
+//	  - path: prod/legacy/**
+//	    max_age: 365d
+//
+// The last rule whose path glob matches a secret wins. Secrets that match no
+// rule get the top-level max_age, or are not checked when it is unset.
+type rotationConfig struct {
+	MaxAge *age           `yaml:"max_age"`
+	Rules  []rotationRule `yaml:"rules"`
+}
+
+type rotationRule struct {
+	Path   string `yaml:"path"`
+	MaxAge *age   `yaml:"max_age"`
+
+	glob *regexp.Regexp
+}
+
+func (a *age) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := parseAge(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid age %q, expected e.g. 90d, 2w, 1y or 12h", node.Line, node.Value)
+	}
+	*a = parsed
+	return nil
+}
+
+func loadRotationConfig(path string) (*rotationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rc := &rotationConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(rc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for i := range rc.Rules {
+		r := &rc.Rules[i]
+		if r.Path == "" {
+			return nil, fmt.Errorf("%s: rule %d has no 'path'", path, i+1)
+		}
+		if r.MaxAge == nil {
+			return nil, fmt.Errorf("%s: rule %q has no 'max_age'", path, r.Path)
+		}
+		if r.glob, err = compilePathGlob(r.Path); err != nil {
+			return nil, fmt.Errorf("%s: invalid rule path %q: %v", path, r.Path, err)
+		}
+	}
+	return rc, nil
+}
+
+// maxAgeFor returns how old secretPath may get and the path glob of the rule
+// that says so; the glob is empty for the top-level max_age.
+func (rc *rotationConfig) maxAgeFor(secretPath string) (maxAge age, rule string, ok bool) {
+	if rc == nil {
+		return age{}, "", false
+	}
+	for i := len(rc.Rules) - 1; i >= 0; i-- {
+		if r := &rc.Rules[i]; r.glob.MatchString(secretPath) {
+			return *r.MaxAge, r.Path, true
+		}
+	}
+	if rc.MaxAge != nil {
+		return *rc.MaxAge, "", true
+	}
+	return age{}, "", false
+}
+
+func (rc *rotationConfig) empty() bool {
+	return rc == nil || rc.MaxAge == nil && len(rc.Rules) == 0
+}
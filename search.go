@@ -6,74 +6,165 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	searchScopePath = "path"
+	searchScopeKeys = "keys"
+	searchScopeAll  = "all"
+)
+
 type SearchParams struct {
-	Term   string
-	Regexp string
-	InPath string
-	Sort   string
-	ShowUI bool
+	Term         string
+	Regexp       string
+	Query        string
+	QueryExpr    queryExpr
+	Scope        string
+	InPaths      []string
+	PathGlobs    []string
+	ExcludePaths []string
+	ExcludeGlobs []string
+	Meta         map[string][]string // custom_metadata filters, lowercased
+	Updated      timeRange
+	Created      timeRange
+
+	pathGlobs    []*regexp.Regexp
+	excludeGlobs []*regexp.Regexp
+
+	Sort        string
+	ShowUI      bool
+	Details     bool
+	Fuzzy       int  // max edit distance for term=, 0 when fuzzy matching is off
+	AllVersions bool // versions=all: also match the indexed older versions
+	// IncludeDeleted also matches secrets whose current version is deleted
+	// or destroyed.
+	IncludeDeleted bool
+	// Capabilities annotates each match with what capabilitiesOf, or the
+	// service token when it is nil, may do with the secret.
+	Capabilities   bool
+	capabilitiesOf *caller
+
+	termTokens *tokenQuery // word and synonym match for term=, nil when not needed
+
+	Limit       int
+	Offset      int
+	Generation  uint64
+	Pinned      bool
+	fingerprint uint64
+}
+
+func (p *SearchParams) hasContentSearch() bool {
+	return p.Term != "" || p.Regexp != "" || p.QueryExpr != nil
+}
+
+// hasFilters reports whether the path, metadata or time filters select
+// secrets on their own, i.e. whether the filter pass runs.
+func (p *SearchParams) hasFilters() bool {
+	return p.hasPathSearch() || len(p.Meta) > 0 || p.Updated.isSet() || p.Created.isSet()
 }
 
 type SearchResult struct {
-	Matches     []string
-	VaultUIBase string
+	Matches      []string
+	Details      []MatchDetail
+	Versions     map[string][]int        // matching versions by path, with versions=all
+	Capabilities map[string]Capabilities // by path, with capabilities=true
+	VaultUIBase  string
+	Total        int
+	TotalPartial bool // total counts only the visible matches found so far
+	Offset       int
+	NextCursor   string
+	Suggestions  []string
+	Generation   uint64
+	CacheAge     time.Duration
+	Took         time.Duration
 }
 
 func performSearch(params *SearchParams, regex *regexp.Regexp, ctx context.Context) (*SearchResult, error) {
+	start := time.Now()
 	vaultUIBaseURL := fmt.Sprintf("%s/ui/vault/secrets/%s/show", cfg.VaultAddress, cfg.VaultMountPoint)
 
 	var contentMatches []string
 	var pathMatches []string
 
+	// A rebuild swaps in new maps rather than changing them, so the snapshot
+	// can be read without the lock, which is not held across Vault requests.
 	cache.RLock()
-	defer cache.RUnlock()
+	snap, err := cache.snapshotLocked(params)
+	cache.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	data := snap.data
 
-	estimatedCap := len(cache.data) / 10
+	estimatedCap := len(data) / 10
 	if estimatedCap < 8 {
 		estimatedCap = 8
 	}
 
 	eg, egCtx := errgroup.WithContext(ctx)
 
-	if params.Term != "" || params.Regexp != "" {
-		eg.Go(func() error {
-			local := make([]string, 0, estimatedCap)
-			for secretPath, secretKeys := range cache.data {
-				select {
-				case <-egCtx.Done():
-					return egCtx.Err()
-				default:
-				}
+	visible := func(keys *SecretKeys) bool {
+		return params.IncludeDeleted || !keys.isDeleted()
+	}
 
-				if matchSecret(secretPath, secretKeys, params, regex) {
-					local = append(local, secretPath)
+	// scan visits the secrets the trigram index cannot rule out for q, or all
+	// of them when there is no index or q cannot narrow the set.
+	scan := func(q *trigramQuery, match func(string, *SecretKeys) bool) ([]string, error) {
+		local := make([]string, 0, estimatedCap)
+		if snap.index != nil {
+			if ids, all := snap.index.candidates(q); !all {
+				for _, id := range ids {
+					select {
+					case <-egCtx.Done():
+						return nil, egCtx.Err()
+					default:
+					}
+
+					secretPath := snap.index.paths[id]
+					if visible(data[secretPath]) && match(secretPath, data[secretPath]) {
+						local = append(local, secretPath)
+					}
 				}
+				return local, nil
+			}
+		}
+
+		for secretPath, secretKeys := range data {
+			select {
+			case <-egCtx.Done():
+				return nil, egCtx.Err()
+			default:
+			}
+
+			if visible(secretKeys) && match(secretPath, secretKeys) {
+				local = append(local, secretPath)
 			}
+		}
+		return local, nil
+	}
+
+	if params.hasContentSearch() {
+		eg.Go(func() error {
+			local, err := scan(searchTrigramQuery(params), func(secretPath string, secretKeys *SecretKeys) bool {
+				return matchSecretVersions(secretPath, secretKeys, params, regex)
+			})
 			contentMatches = local
-			return nil
+			return err
 		})
 	}
 
-	if params.InPath != "" {
+	if params.hasFilters() {
 		eg.Go(func() error {
-			local := make([]string, 0, estimatedCap)
-			for secretPath := range cache.data {
-				select {
-				case <-egCtx.Done():
-					return egCtx.Err()
-				default:
-				}
-
-				if matchInPath(secretPath, params.InPath) {
-					local = append(local, secretPath)
-				}
-			}
+			local, err := scan(pathFilterTrigramQuery(params), func(secretPath string, secretKeys *SecretKeys) bool {
+				return matchPathFilters(secretPath, params) &&
+					matchMetaFilters(secretKeys.metadata(), params.Meta) &&
+					matchTimeFilters(secretKeys.metadata(), params)
+			})
 			pathMatches = local
-			return nil
+			return err
 		})
 	}
 
@@ -83,10 +174,112 @@ func performSearch(params *SearchParams, regex *regexp.Regexp, ctx context.Conte
 
 	matches := determineMatches(params, contentMatches, pathMatches)
 
-	sort.Strings(matches)
-	if params.Sort == "desc" {
-		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
-			matches[i], matches[j] = matches[j], matches[i]
+	var hs []highlighter
+	if params.Sort == sortRelevance || params.Details {
+		hs = searchHighlighters(params, regex)
+	}
+
+	switch params.Sort {
+	case sortRelevance:
+		rankByRelevance(matches, data, params, hs)
+	case sortUpdated:
+		sortByUpdated(matches, data)
+	default:
+		sort.Strings(matches)
+		if params.Sort == "desc" {
+			for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+				matches[i], matches[j] = matches[j], matches[i]
+			}
+		}
+	}
+
+	// A caller's matches are checked in sorted order only until the page and
+	// one more are found; total is then a lower bound.
+	caller := callerFrom(ctx)
+	want := 0
+	if params.Limit > 0 {
+		want = params.Offset + params.Limit + 1
+	}
+	// Key names need read, so a secret the caller may only list must match
+	// on its path and metadata alone, and is shown without its keys.
+	listed := make(map[string]*SecretKeys)
+	matches, exhausted, err := caller.visiblePaths(ctx, matches, want, func(secretPath string) bool {
+		keys := data[secretPath].listedOnly(secretPath)
+		if params.hasContentSearch() && !matchSecretVersions(secretPath, keys, params, regex) {
+			return false
+		}
+		listed[secretPath] = keys
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry := func(secretPath string) *SecretKeys {
+		if keys, ok := listed[secretPath]; ok {
+			return keys
+		}
+		return data[secretPath]
+	}
+
+	total := len(matches)
+	matches = paginate(matches, params.Offset, params.Limit)
+
+	var suggestions []string
+	// The vocabulary spans every cached secret, so a caller filtered by its
+	// own token gets no suggestions.
+	if total == 0 && caller == nil {
+		vocab := snap.index.keyVocabulary()
+		if vocab == nil {
+			vocab = buildKeyVocabulary(data)
+		}
+		suggestions = suggestKeys(vocab, params)
+	}
+
+	var nextCursor string
+	if params.Limit > 0 && params.Offset+len(matches) < total {
+		nextCursor = encodeCursor(pageCursor{
+			generation:  snap.generation,
+			offset:      params.Offset + len(matches),
+			fingerprint: params.fingerprint,
+		})
+		// The lock orders this with retireSnapshotLocked, so a rebuild that
+		// has not retired this generation yet keeps it.
+		cache.RLock()
+		cache.noteCursorIssued(snap.generation)
+		cache.RUnlock()
+	}
+
+	var versions map[string][]int
+	if params.AllVersions && params.hasContentSearch() {
+		versions = make(map[string][]int, len(matches))
+		for _, secretPath := range matches {
+			versions[secretPath] = matchedVersions(secretPath, entry(secretPath), params, regex)
+		}
+	}
+
+	// Only the page is looked up, and never under the cache lock: Vault may
+	// be slow to answer, and a rebuild must not wait for it.
+	var caps map[string]Capabilities
+	if params.Capabilities {
+		if caps, err = pathCapabilities(ctx, params.capabilitiesOf, matches); err != nil {
+			return nil, err
+		}
+	}
+
+	var details []MatchDetail
+	if params.Details {
+		details = make([]MatchDetail, 0, len(matches))
+		for _, secretPath := range matches {
+			detail := buildMatchDetail(secretPath, entry(secretPath), params, hs)
+			detail.Score = relevanceScore(&detail)
+			detail.Versions = versions[secretPath]
+			if c, ok := caps[secretPath]; ok {
+				detail.Capabilities = &c
+			}
+			if params.ShowUI {
+				detail.URL = fmt.Sprintf("%s/%s", vaultUIBaseURL, secretPath)
+			}
+			details = append(details, detail)
 		}
 	}
 
@@ -96,24 +289,91 @@ func performSearch(params *SearchParams, regex *regexp.Regexp, ctx context.Conte
 		}
 	}
 
+	var cacheAge time.Duration
+	if !snap.builtAt.IsZero() {
+		cacheAge = time.Since(snap.builtAt)
+	}
+
 	return &SearchResult{
-		Matches:     matches,
-		VaultUIBase: vaultUIBaseURL,
+		Matches:      matches,
+		Details:      details,
+		Versions:     versions,
+		Capabilities: caps,
+		VaultUIBase:  vaultUIBaseURL,
+		Total:        total,
+		TotalPartial: !exhausted,
+		Offset:       params.Offset,
+		NextCursor:   nextCursor,
+		Suggestions:  suggestions,
+		Generation:   snap.generation,
+		CacheAge:     cacheAge,
+		Took:         time.Since(start),
 	}, nil
 }
 
 func matchSecret(path string, keys *SecretKeys, params *SearchParams, regex *regexp.Regexp) bool {
+	if params.QueryExpr != nil {
+		return params.QueryExpr.eval(path, keys)
+	}
+
 	if params.Term != "" {
-		return strings.Contains(keys.SearchString, strings.ToLower(params.Term))
+		term := strings.ToLower(params.Term)
+		var matched bool
+		if params.Scope != "" {
+			matched = matchFields(path, keys, params.Scope, func(s string) bool {
+				return strings.Contains(strings.ToLower(s), term)
+			})
+		} else {
+			matched = strings.Contains(keys.SearchString, term)
+		}
+		if !matched && params.termTokens != nil && params.Scope != searchScopePath {
+			matched = params.termTokens.matchKeys(keys)
+		}
+		if !matched && params.Fuzzy > 0 {
+			scope := params.Scope
+			if scope == "" {
+				scope = searchScopeAll
+			}
+			distance := fuzzyDistance(term, params.Fuzzy)
+			matched = matchFields(path, keys, scope, func(s string) bool {
+				return fuzzyMatch(s, term, distance)
+			})
+		}
+		return matched
 	}
 
 	if params.Regexp != "" && regex != nil {
+		if params.Scope != "" {
+			return matchFields(path, keys, params.Scope, regex.MatchString)
+		}
 		return regex.MatchString(keys.SearchString)
 	}
 
 	return false
 }
 
+// matchFields tests the path and each key name separately, so a term cannot
+// straddle two keys and anchors apply to a single key. A nested key is also
+// tested by its dotted path. Without a scope the callers fall back to the
+// concatenated SearchString.
+func matchFields(path string, keys *SecretKeys, scope string, match func(string) bool) bool {
+	if scope != searchScopeKeys && match(path) {
+		return true
+	}
+	if scope == searchScopePath {
+		return false
+	}
+	for i, key := range keys.AllKeys {
+		if match(key) {
+			return true
+		}
+		if p := keys.keyPath(i); p != key && match(p) {
+			return true
+		}
+	}
+	return false
+}
+
 func matchInPath(secretPath, inPath string) bool {
 	if secretPath == inPath {
 		return true
@@ -130,10 +390,10 @@ func matchInPath(secretPath, inPath string) bool {
 func determineMatches(params *SearchParams, contentMatches, pathMatches []string) []string {
 	var matches []string
 
-	hasContentSearch := params.Term != "" || params.Regexp != ""
-	hasPathSearch := params.InPath != ""
+	hasContentSearch := params.hasContentSearch()
+	hasFilters := params.hasFilters()
 
-	if hasContentSearch && hasPathSearch {
+	if hasContentSearch && hasFilters {
 		contentSet := make(map[string]struct{})
 		for _, path := range contentMatches {
 			contentSet[path] = struct{}{}
@@ -145,9 +405,19 @@ func determineMatches(params *SearchParams, contentMatches, pathMatches []string
 		}
 	} else if hasContentSearch {
 		matches = contentMatches
-	} else if hasPathSearch {
+	} else if hasFilters {
 		matches = pathMatches
 	}
 
+	if len(params.ExcludePaths) > 0 || len(params.excludeGlobs) > 0 {
+		kept := matches[:0:0]
+		for _, path := range matches {
+			if !excludedPath(path, params) {
+				kept = append(kept, path)
+			}
+		}
+		matches = kept
+	}
+
 	return matches
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	suggestKindPath = "path"
+	suggestKindKey  = "key"
+
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 100
+)
+
+// Completion is one /suggest result. Type is set for path completions only.
+type Completion struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Secrets int    `json:"secrets"`
+}
+
+// completionSource returns the sorted paths and key vocabulary that /suggest
+// binary-searches. They come from the index built by rebuildCache; a cache
+// without one (e.g. set directly in tests) gets them built on the spot. It
+// must be called with the cache read lock held.
+func completionSource() ([]string, []keyUsage) {
+	if cache.index != nil {
+		return cache.index.paths, cache.index.keys
+	}
+	paths := make([]string, 0, len(cache.data))
+	for secretPath := range cache.data {
+		paths = append(paths, secretPath)
+	}
+	sort.Strings(paths)
+	return paths, buildKeyVocabulary(cache.data)
+}
+
+// suggestCompletions completes prefix as a path of the secrets the caller of
+// ctx may see, or as a key name of those it may read.
+func suggestCompletions(ctx context.Context, kind, prefix string, limit int) ([]Completion, error) {
+	c := callerFrom(ctx)
+	if kind == suggestKindKey {
+		vocab, err := c.keyVocabulary(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return completeKey(vocab, prefix, limit), nil
+	}
+
+	visible, err := c.visibility(ctx, cachedPaths(strings.TrimPrefix(prefix, "/")))
+	if err != nil {
+		return nil, err
+	}
+	cache.RLock()
+	defer cache.RUnlock()
+	paths, _ := completionSource()
+	if visible != nil {
+		paths = slices.DeleteFunc(slices.Clone(paths), func(p string) bool { return !visible(p) })
+	}
+	return completePath(paths, prefix, limit), nil
+}
+
+// keyVocabulary returns the key names of the secrets c may read. Building it
+// asks Vault about the data path of every cached secret that has keys, one
+// batch of 200 at a time, so a caller's vocabulary is kept with its
+// capabilities until the next rebuild, for at most CALLER_CAPABILITIES_TTL,
+// rather than built again on every keystroke.
+func (c *caller) keyVocabulary(ctx context.Context) ([]keyUsage, error) {
+	cache.RLock()
+	if c == nil {
+		defer cache.RUnlock()
+		_, vocab := completionSource()
+		return vocab, nil
+	}
+	// A rebuild swaps in new maps rather than changing them, so data can be
+	// read without the lock.
+	generation, data := cache.generation, cache.data
+	cache.RUnlock()
+	if vocab, ok := capabilities.vocabulary(c, generation); ok {
+		return vocab, nil
+	}
+
+	// Deleted secrets, and every secret in metadata-only mode, have no keys
+	// to contribute and are not asked about.
+	var paths []string
+	for p, keys := range data {
+		if keys != nil && len(keys.AllKeys) > 0 {
+			paths = append(paths, p)
+		}
+	}
+	readable, err := c.readable(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+	own := make(map[string]*SecretKeys)
+	for _, p := range paths {
+		if readable(p) {
+			own[p] = data[p]
+		}
+	}
+	vocab := buildKeyVocabulary(own)
+	capabilities.setVocabulary(c, generation, vocab)
+	return vocab, nil
+}
+
+// completePath completes one segment at a time, like a shell: the suggestions
+// for "prod/d" are "prod/db/" and "prod/dns/", never "prod/db/credentials".
+// Folders carry the number of secrets below them. Paths are case-sensitive.
+func completePath(paths []string, prefix string, limit int) []Completion {
+	prefix = strings.TrimPrefix(prefix, "/")
+	start := sort.SearchStrings(paths, prefix)
+
+	var completions []Completion
+	for i := start; i < len(paths) && strings.HasPrefix(paths[i], prefix); i++ {
+		value, kind := paths[i], treeNodeSecret
+		if idx := strings.IndexByte(paths[i][len(prefix):], '/'); idx >= 0 {
+			value, kind = paths[i][:len(prefix)+idx+1], treeNodeFolder
+		}
+
+		// Paths are sorted, so every secret below a folder is adjacent.
+		if n := len(completions); n > 0 && completions[n-1].Value == value {
+			completions[n-1].Secrets++
+			continue
+		}
+		if len(completions) == limit {
+			break
+		}
+		completions = append(completions, Completion{Value: value, Type: kind, Secrets: 1})
+	}
+	if completions == nil {
+		completions = []Completion{}
+	}
+	return completions
+}
+
+// completeKey returns the key names starting with prefix (case-insensitive),
+// the most widely used first.
+func completeKey(vocab []keyUsage, prefix string, limit int) []Completion {
+	prefix = strings.ToLower(prefix)
+	start := sort.Search(len(vocab), func(i int) bool {
+		return strings.ToLower(vocab[i].Key) >= prefix
+	})
+
+	completions := []Completion{}
+	for i := start; i < len(vocab) && strings.HasPrefix(strings.ToLower(vocab[i].Key), prefix); i++ {
+		completions = append(completions, Completion{Value: vocab[i].Key, Secrets: vocab[i].Secrets})
+	}
+	sort.SliceStable(completions, func(i, j int) bool {
+		return completions[i].Secrets > completions[j].Secrets
+	})
+	if len(completions) > limit {
+		completions = completions[:limit]
+	}
+	return completions
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const sortUpdated = "updated"
+
+// timeFilterParams are the query parameters read by parseTimeFilters.
+var timeFilterParams = []string{"updated_after", "updated_before", "created_after", "created_before"}
+
+// relativeAgePattern matches ages in units time.ParseDuration lacks.
+var relativeAgePattern = regexp.MustCompile(`^(\d+)([dwy])$`)
+
+// timeRange bounds a timestamp from both sides; a zero bound is open.
+type timeRange struct {
+	After  time.Time
+	Before time.Time
+}
+
+func (r timeRange) isSet() bool {
+	return !r.After.IsZero() || !r.Before.IsZero()
+}
+
+// contains reports whether t lies strictly between the bounds. An unknown
+// (zero) time is never contained in a set range.
+func (r timeRange) contains(t time.Time) bool {
+	if !r.isSet() {
+		return true
+	}
+	if t.IsZero() {
+		return false
+	}
+	return (r.After.IsZero() || t.After(r.After)) && (r.Before.IsZero() || t.Before(r.Before))
+}
+
+// String is for logging: an empty string for an open range.
+func (r timeRange) String() string {
+	if !r.isSet() {
+		return ""
+	}
+	bound := func(t time.Time) string {
+		if t.IsZero() {
+			return "*"
+		}
+		return t.Format(time.RFC3339)
+	}
+	return bound(r.After) + ".." + bound(r.Before)
+}
+
+func hasTimeFilter(query url.Values) bool {
+	for _, name := range timeFilterParams {
+		if query.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimeFilters reads updated_after, updated_before, created_after and
+// created_before into params. Relative ages count back from now.
+func parseTimeFilters(query url.Values, params *SearchParams, now time.Time) error {
+	bounds := []*time.Time{
+		&params.Updated.After, &params.Updated.Before,
+		&params.Created.After, &params.Created.Before,
+	}
+	for i, name := range timeFilterParams {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := parseTimeBound(v, now)
+		if err != nil {
+			return fmt.Errorf("'%s' must be an RFC3339 time, a date such as 2024-01-31 or an age such as 30d, 12h: %q", name, v)
+		}
+		*bounds[i] = t
+	}
+	if r := params.Updated; !r.After.IsZero() && !r.Before.IsZero() && !r.After.Before(r.Before) {
+		return fmt.Errorf("'updated_after' must be earlier than 'updated_before'")
+	}
+	if r := params.Created; !r.After.IsZero() && !r.Before.IsZero() && !r.After.Before(r.Before) {
+		return fmt.Errorf("'created_after' must be earlier than 'created_before'")
+	}
+	// Only the metadata endpoint knows when a secret was created; without it
+	// every secret would be excluded.
+	if params.Created.isSet() && !cfg.IndexMetadata {
+		return fmt.Errorf("'created_after' and 'created_before' need VAULT_READ_METADATA=true, the creation time is not indexed")
+	}
+	return nil
+}
+
+// parseTimeBound accepts an RFC3339 time, a date (midnight UTC), or an age
+// such as 90m, 12h, 30d, 2w or 1y.
+func parseTimeBound(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	a, err := parseAge(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return a.before(now), nil
+}
+
+// age is a span counted back from a moment. Days and years are calendar
+// days and years, so 1y before a leap day is the same date a year earlier.
+type age struct {
+	years, days int
+	d           time.Duration
+	text        string
+}
+
+// parseAge reads 30d, 2w, 1y or a Go duration such as 12h.
+func parseAge(v string) (age, error) {
+	if m := relativeAgePattern.FindStringSubmatch(v); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return age{}, err
+		}
+		switch m[2] {
+		case "d":
+			return age{days: n, text: v}, nil
+		case "w":
+			return age{days: 7 * n, text: v}, nil
+		default:
+			return age{years: n, text: v}, nil
+		}
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return age{}, err
+	}
+	if d < 0 {
+		return age{}, fmt.Errorf("negative age %s", v)
+	}
+	return age{d: d, text: v}, nil
+}
+
+// before returns the moment a ago from now.
+func (a age) before(now time.Time) time.Time {
+	return now.AddDate(-a.years, 0, -a.days).Add(-a.d)
+}
+
+func (a age) String() string {
+	return a.text
+}
+
+func matchTimeFilters(meta *SecretMetadata, params *SearchParams) bool {
+	if !params.Updated.isSet() && !params.Created.isSet() {
+		return true
+	}
+	if meta == nil {
+		return false
+	}
+	return params.Updated.contains(meta.UpdatedTime) && params.Created.contains(meta.CreatedTime)
+}
+
+// sortByUpdated puts the most recently updated secrets first. Secrets without
+// an update time go last, and ties are sorted by path. data is a cache
+// snapshot.
+func sortByUpdated(matches []string, data map[string]*SecretKeys) {
+	sort.Slice(matches, func(i, j int) bool {
+		ti, tj := data[matches[i]].updatedTime(), data[matches[j]].updatedTime()
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return matches[i] < matches[j]
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// keyToken is one word of a key name: lowercased text and its byte range in
+// the original name.
+type keyToken struct {
+	text       string
+	start, end int
+}
+
+// tokenizeKey splits a key name into words on '_', '-', '.', spaces and case
+// changes, so db_password, dbPassword, DB-PASSWORD and HTTPServer become
+// [db password], [db password], [db password] and [http server].
+func tokenizeKey(key string) []keyToken {
+	var tokens []keyToken
+	start := -1
+	flush := func(end int) {
+		if start >= 0 && end > start {
+			tokens = append(tokens, keyToken{text: strings.ToLower(key[start:end]), start: start, end: end})
+		}
+		start = -1
+	}
+
+	var prev rune
+	for i, r := range key {
+		if r == '_' || r == '-' || r == '.' || unicode.IsSpace(r) {
+			flush(i)
+			prev = r
+			continue
+		}
+		if start >= 0 && unicode.IsUpper(r) {
+			next, _ := utf8.DecodeRuneInString(key[i+utf8.RuneLen(r):])
+			// dbPassword splits before P; HTTPServer splits before S.
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && unicode.IsLower(next)) {
+				flush(i)
+			}
+		}
+		if start < 0 {
+			start = i
+		}
+		prev = r
+	}
+	flush(len(key))
+	return tokens
+}
+
+func tokenTexts(tokens []keyToken) []string {
+	texts := make([]string, len(tokens))
+	for i, t := range tokens {
+		texts[i] = t.text
+	}
+	return texts
+}
+
+// tokenizeKeys runs at index time; the result is parallel to keys.
+func tokenizeKeys(keys []string) [][]string {
+	tokens := make([][]string, len(keys))
+	for i, key := range keys {
+		tokens[i] = tokenTexts(tokenizeKey(key))
+	}
+	return tokens
+}
+
+// synonymSet maps a word, or several words joined by a space, to every
+// spelling in its group, each already tokenized.
+type synonymSet map[string][][]string
+
+// synonyms is loaded from cfg.SynonymsFile at startup and applied at query time.
+var synonyms synonymSet
+
+// loadSynonyms reads one group per line, spellings separated by commas:
+//
+//	# comment
+//	pwd, pass, password
+//	token, apikey, api_key
+func loadSynonyms(path string) (synonymSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := make(synonymSet)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var group [][]string
+		for _, entry := range strings.Split(line, ",") {
+			if tokens := tokenTexts(tokenizeKey(strings.TrimSpace(entry))); len(tokens) > 0 {
+				group = append(group, tokens)
+			}
+		}
+		if len(group) < 2 {
+			return nil, fmt.Errorf("%s:%d: a synonym group needs at least two spellings", path, lineNo)
+		}
+		for _, tokens := range group {
+			word := strings.Join(tokens, " ")
+			set[word] = append(set[word], group...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// alternatives returns the spellings that may stand for tokens, including
+// tokens itself.
+func (s synonymSet) alternatives(tokens []string) [][]string {
+	alts := [][]string{tokens}
+	for _, alt := range s[strings.Join(tokens, " ")] {
+		if !equalTokens(alt, tokens) {
+			alts = append(alts, alt)
+		}
+	}
+	return alts
+}
+
+func equalTokens(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenQuery matches a search term against the words of a key name rather
+// than its characters: term=db_password finds dbPassword, and with a pwd,
+// pass, password synonym group term=password finds dbPwd. words holds the
+// alternatives for each word of the term in order, whole the alternatives for
+// the term as a unit.
+type tokenQuery struct {
+	words [][][]string
+	whole [][]string
+}
+
+// newTokenQuery returns nil when matching words could not find anything a
+// plain substring search does not, i.e. for a single word without synonyms.
+func newTokenQuery(term string, syn synonymSet) *tokenQuery {
+	tokens := tokenTexts(tokenizeKey(term))
+	if len(tokens) == 0 {
+		return nil
+	}
+	q := &tokenQuery{}
+	expanded := false
+	for _, t := range tokens {
+		alts := syn.alternatives([]string{t})
+		expanded = expanded || len(alts) > 1
+		q.words = append(q.words, alts)
+	}
+	if len(tokens) > 1 {
+		q.whole = syn.alternatives(tokens)[1:]
+	}
+	if !expanded && len(tokens) == 1 {
+		return nil
+	}
+	return q
+}
+
+// match returns the token range [from, to) of keyTokens the term matched.
+func (q *tokenQuery) match(keyTokens []string) (from, to int, ok bool) {
+	for start := range keyTokens {
+		for _, alt := range q.whole {
+			if hasTokensAt(keyTokens, start, alt) {
+				return start, start + len(alt), true
+			}
+		}
+		if end, ok := q.matchWords(keyTokens, 0, start); ok {
+			return start, end, true
+		}
+	}
+	return 0, 0, false
+}
+
+func (q *tokenQuery) matchWords(keyTokens []string, word, pos int) (int, bool) {
+	if word == len(q.words) {
+		return pos, true
+	}
+	for _, alt := range q.words[word] {
+		if hasTokensAt(keyTokens, pos, alt) {
+			if end, ok := q.matchWords(keyTokens, word+1, pos+len(alt)); ok {
+				return end, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func hasTokensAt(keyTokens []string, pos int, want []string) bool {
+	if pos+len(want) > len(keyTokens) {
+		return false
+	}
+	for i, t := range want {
+		if keyTokens[pos+i] != t {
+			return false
+		}
+	}
+	return true
+}
+
+// matchKeys reports whether any key name of the secret matches.
+func (q *tokenQuery) matchKeys(keys *SecretKeys) bool {
+	for i := range keys.AllKeys {
+		if _, _, ok := q.match(keys.keyTokens(i)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// offsets returns the byte range of the matched words in key.
+func (q *tokenQuery) offsets(key string) [][2]int {
+	tokens := tokenizeKey(key)
+	from, to, ok := q.match(tokenTexts(tokens))
+	if !ok {
+		return nil
+	}
+	return [][2]int{{tokens[from].start, tokens[to-1].end}}
+}
+
+// trigramQuery is the index plan for the word match: every word must appear
+// in one of its spellings, or the whole term in one of its spellings. Trigrams
+// never span two words, because a word boundary in the term need not be one
+// in the key.
+func (q *tokenQuery) trigramQuery() *trigramQuery {
+	spelling := func(tokens []string) *trigramQuery {
+		qs := make([]*trigramQuery, 0, len(tokens))
+		for _, t := range tokens {
+			qs = append(qs, literalTrigramQuery(t))
+		}
+		return andTrigramQueries(qs...)
+	}
+
+	words := make([]*trigramQuery, 0, len(q.words))
+	for _, alts := range q.words {
+		qs := make([]*trigramQuery, 0, len(alts))
+		for _, alt := range alts {
+			qs = append(qs, spelling(alt))
+		}
+		words = append(words, orTrigramQueries(qs...))
+	}
+	qs := []*trigramQuery{andTrigramQueries(words...)}
+	for _, alt := range q.whole {
+		qs = append(qs, spelling(alt))
+	}
+	return orTrigramQueries(qs...)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	treeNodeFolder = "folder"
+	treeNodeSecret = "secret"
+)
+
+type TreeNode struct {
+	Name        string     `json:"name"`
+	Path        string     `json:"path"`
+	Type        string     `json:"type"`
+	SecretCount int        `json:"secret_count"`
+	KeyCount    int        `json:"key_count"`
+	LastUpdated *time.Time `json:"last_updated,omitempty"`
+}
+
+// PathTree is a folder with its immediate children. The folder's own counts
+// cover everything below it.
+type PathTree struct {
+	TreeNode
+	Children []TreeNode `json:"children"`
+}
+
+// addSecret counts a secret below n.
+func (n *TreeNode) addSecret(keys *SecretKeys) {
+	n.SecretCount++
+	if keys == nil {
+		return
+	}
+	n.KeyCount += len(keys.AllKeys)
+	if updated := keys.updatedTime(); !updated.IsZero() && (n.LastUpdated == nil || updated.After(*n.LastUpdated)) {
+		n.LastUpdated = &updated
+	}
+}
+
+// normalizeTreePrefix turns "prod", "/prod" and "prod/" into "prod/" and an
+// empty or "/" prefix into the mount root.
+func normalizeTreePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// buildPathTree returns the immediate children of prefix. Folders carry the
+// number of secrets and keys below them and the newest update among them; a
+// secret and a folder may share a name. Secrets the caller may not see are
+// left out, and so are folders with nothing visible below them.
+func buildPathTree(prefix string, visible visibility) PathTree {
+	prefix = normalizeTreePrefix(prefix)
+	tree := PathTree{TreeNode: TreeNode{Name: path.Base(prefix), Path: prefix, Type: treeNodeFolder}}
+	if prefix == "" {
+		tree.Name = ""
+	}
+
+	folders := make(map[string]*TreeNode)
+	var secrets []TreeNode
+
+	cache.RLock()
+	for secretPath, keys := range cache.data {
+		if !strings.HasPrefix(secretPath, prefix) || keys.isDeleted() || !visible.allows(secretPath) {
+			continue
+		}
+		tree.addSecret(keys)
+		rest := secretPath[len(prefix):]
+		if idx := strings.IndexByte(rest, '/'); idx >= 0 {
+			name := rest[:idx]
+			node, ok := folders[name]
+			if !ok {
+				node = &TreeNode{Name: name, Path: prefix + name + "/", Type: treeNodeFolder}
+				folders[name] = node
+			}
+			node.addSecret(keys)
+			continue
+		}
+		node := TreeNode{Name: rest, Path: secretPath, Type: treeNodeSecret}
+		node.addSecret(keys)
+		secrets = append(secrets, node)
+	}
+	cache.RUnlock()
+
+	nodes := make([]TreeNode, 0, len(folders)+len(secrets))
+	for _, node := range folders {
+		nodes = append(nodes, *node)
+	}
+	nodes = append(nodes, secrets...)
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Type != nodes[j].Type {
+			return nodes[i].Type == treeNodeFolder
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	tree.Children = nodes
+	return tree
+}
+
+// lookupSecretKeys returns the sorted, de-duplicated key names indexed for a
+// single secret. Nested keys are included; values never are.
+func lookupSecretKeys(secretPath string) ([]string, bool) {
+	secretPath = strings.Trim(secretPath, "/")
+
+	cache.RLock()
+	secretKeys, ok := cache.data[secretPath]
+	cache.RUnlock()
+	if !ok || secretKeys == nil {
+		return nil, false
+	}
+
+	seen := make(map[string]struct{}, len(secretKeys.AllKeys))
+	keys := make([]string, 0, len(secretKeys.AllKeys))
+	for _, key := range secretKeys.AllKeys {
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
+// KeyNode is one key of a secret in the key tree. Nested keys sit under the
+// key whose value held them; format says how that value was parsed.
+type KeyNode struct {
+	Key      string     `json:"key"`
+	Path     string     `json:"path"`
+	Format   string     `json:"format,omitempty"`
+	Children []*KeyNode `json:"children,omitempty"`
+}
+
+// SecretKeyTree describes the cached keys of one secret. Values are never
+// part of it.
+type SecretKeyTree struct {
+	Path           string          `json:"path"`
+	KeyCount       int             `json:"key_count"`
+	NestedKeyCount int             `json:"nested_key_count"`
+	Metadata       *SecretMetadata `json:"metadata,omitempty"`
+	Deleted        bool            `json:"deleted,omitempty"`
+	MetadataOnly   bool            `json:"metadata_only,omitempty"` // key names were not read, Keys is empty
+	Keys           []*KeyNode      `json:"keys"`
+}
+
+// arrayIndexSuffix matches the trailing [n] indexes of a key path.
+var arrayIndexSuffix = regexp.MustCompile(`(\[\d+\])+$`)
+
+// buildSecretKeyTree groups the keys of a secret under the key they were
+// found in. Keys repeated across array elements, such as
+// clusters[0].endpoint and clusters[1].endpoint, are listed once with the
+// first path.
+func buildSecretKeyTree(secretPath string) (*SecretKeyTree, bool) {
+	secretPath = strings.Trim(secretPath, "/")
+
+	cache.RLock()
+	keys, ok := cache.data[secretPath]
+	cache.RUnlock()
+	if !ok || keys == nil {
+		return nil, false
+	}
+
+	tree := &SecretKeyTree{
+		Path:           secretPath,
+		KeyCount:       len(keys.AllKeys),
+		NestedKeyCount: keys.NestedKeys,
+		Metadata:       keys.Metadata,
+		Deleted:        keys.Deleted,
+		MetadataOnly:   cfg.MetadataOnly,
+		Keys:           []*KeyNode{},
+	}
+
+	byPath := make(map[string]*KeyNode, len(keys.AllKeys))
+	type childKey struct {
+		parent *KeyNode
+		key    string
+	}
+	children := make(map[childKey]*KeyNode)
+	for i, key := range keys.AllKeys {
+		keyPath := keys.keyPath(i)
+		if byPath[keyPath] != nil {
+			continue
+		}
+		var parent *KeyNode
+		if keyPath != key {
+			parentPath := arrayIndexSuffix.ReplaceAllString(strings.TrimSuffix(keyPath, "."+key), "")
+			parent = byPath[parentPath]
+		}
+		if node := children[childKey{parent, key}]; node != nil {
+			// Keys below a repeated one join the first node.
+			byPath[keyPath] = node
+			continue
+		}
+
+		node := &KeyNode{Key: key, Path: keyPath, Format: keys.Formats[keyPath]}
+		children[childKey{parent, key}] = node
+		byPath[keyPath] = node
+		if parent != nil {
+			parent.Children = append(parent.Children, node)
+		} else {
+			tree.Keys = append(tree.Keys, node)
+		}
+	}
+	sortKeyNodes(tree.Keys)
+	return tree, true
+}
+
+func sortKeyNodes(nodes []*KeyNode) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Key < nodes[j].Key })
+	for _, node := range nodes {
+		sortKeyNodes(node.Children)
+	}
+}
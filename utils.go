@@ -51,13 +51,55 @@ func estimateCacheSize(cacheData map[string]*SecretKeys) uint64 {
 		size += mapEntryOverhead
 		size += stringHeaderSize + uint64(len(path))
 		size += pointerSize
-		if secretKeys != nil {
-			size += stringHeaderSize + uint64(len(secretKeys.SearchString))
-			size += sliceHeaderSize
-			for _, s := range secretKeys.AllKeys {
-				size += stringHeaderSize + uint64(len(s))
-			}
+		size += secretKeysSize(secretKeys)
+	}
+	return size
+}
+
+func secretKeysSize(secretKeys *SecretKeys) uint64 {
+	if secretKeys == nil {
+		return 0
+	}
+	var size uint64
+	size += stringHeaderSize + uint64(len(secretKeys.SearchString))
+	size += sliceHeaderSize
+	for _, s := range secretKeys.AllKeys {
+		size += stringHeaderSize + uint64(len(s))
+	}
+	if secretKeys.KeyPaths != nil {
+		size += sliceHeaderSize
+	}
+	for i, p := range secretKeys.KeyPaths {
+		size += stringHeaderSize
+		// Top-level keys share the key name's backing array.
+		if i >= len(secretKeys.AllKeys) || p != secretKeys.AllKeys[i] {
+			size += uint64(len(p))
 		}
 	}
+	if secretKeys.KeyTokens != nil {
+		size += sliceHeaderSize
+	}
+	if m := secretKeys.Metadata; m != nil {
+		size += pointerSize
+		for k, v := range m.CustomMetadata {
+			size += mapEntryOverhead + 2*stringHeaderSize + uint64(len(k)) + uint64(len(v))
+		}
+	}
+	for path := range secretKeys.Formats {
+		// Format names are shared constants.
+		size += mapEntryOverhead + 2*stringHeaderSize + uint64(len(path))
+	}
+	for _, tokens := range secretKeys.KeyTokens {
+		size += sliceHeaderSize
+		for _, t := range tokens {
+			size += stringHeaderSize + uint64(len(t))
+		}
+	}
+	if secretKeys.History != nil {
+		size += sliceHeaderSize
+	}
+	for _, old := range secretKeys.History {
+		size += pointerSize + secretKeysSize(old)
+	}
 	return size
 }